@@ -0,0 +1,447 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	admin_app "mcpgo/backend/apps/admin"
+	"mcpgo/backend/apps/gateway"
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/mcp"
+
+	"github.com/gorilla/mux"
+)
+
+// approvalKeepalive is the interval of the comments that keep an idle
+// stream of approval events open through proxies.
+const approvalKeepalive = 30 * time.Second
+
+// serverRequest is the body accepted when adding or updating a server.
+type serverRequest struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	Protocol  string `json:"protocol"`
+	Disabled  bool   `json:"disabled"`
+	Stateless bool   `json:"stateless"`
+	// Aggregate lists the servers a virtual server combines, used instead
+	// of address.
+	Aggregate []string `json:"aggregate,omitempty"`
+	// Endpoints lists replicas of the server, used instead of address.
+	Endpoints []endpointRequest `json:"endpoints,omitempty"`
+	// Balancing is round-robin, least-connections or consistent-hash.
+	Balancing string `json:"balancing,omitempty"`
+}
+
+// endpointRequest is one replica in a serverRequest.
+type endpointRequest struct {
+	Address string `json:"address"`
+	Weight  int    `json:"weight,omitempty"`
+}
+
+// rejectRequest is the body accepted when rejecting a held tool call.
+type rejectRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// apply sets the settings the request describes on cfg, keeping the
+// server's other settings, such as its approval rules, as they are.
+func (s serverRequest) apply(cfg config.ServerConfig) config.ServerConfig {
+	if s.ID != "" {
+		cfg.ID = s.ID
+	}
+	cfg.Name = s.Name
+	cfg.Address = s.Address
+	cfg.Protocol = s.Protocol
+	cfg.Disabled = s.Disabled
+	cfg.Stateless = s.Stateless
+	cfg.Aggregate = s.Aggregate
+	cfg.Balancing.Strategy = s.Balancing
+	cfg.Endpoints = nil
+	for _, endpoint := range s.Endpoints {
+		cfg.Endpoints = append(cfg.Endpoints, config.EndpointConfig{Address: endpoint.Address, Weight: endpoint.Weight})
+	}
+	return cfg
+}
+
+// @Summary List upstream servers
+// @Description Lists every configured upstream MCP server with its current status.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Success 200 {array} gateway.ServerInfo
+// @Failure 401 {object} map[string]string
+// @Router /admin/servers [get]
+func (r *Router) listServers(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, r.app.ListServers())
+}
+
+// @Summary Add an upstream server
+// @Description Registers a new upstream MCP server, persists it to the configuration file and probes it.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security AdminToken
+// @Param server body serverRequest true "Server definition"
+// @Success 201 {object} gateway.ServerInfo
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Router /admin/servers [post]
+func (r *Router) addServer(w http.ResponseWriter, req *http.Request) {
+	var body serverRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	info, err := r.app.AddServer(req.Context(), body.apply(config.ServerConfig{}))
+	if err != nil {
+		r.writeAppError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// @Summary Inspect an upstream server
+// @Description Returns an upstream server's status, capabilities and tool catalog.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param id path string true "Server ID"
+// @Param refresh query bool false "Probe the server before answering"
+// @Success 200 {object} gateway.ServerInfo
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /admin/servers/{id} [get]
+func (r *Router) getServer(w http.ResponseWriter, req *http.Request) {
+	refresh, _ := strconv.ParseBool(req.URL.Query().Get("refresh"))
+	info, err := r.app.GetServer(req.Context(), mux.Vars(req)["id"], refresh)
+	if err != nil {
+		r.writeAppError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// @Summary Update an upstream server
+// @Description Replaces the settings of an upstream server the body describes and persists the change; settings the body does not describe, such as approval rules, are kept. Connected sessions keep their current upstream.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security AdminToken
+// @Param id path string true "Server ID"
+// @Param server body serverRequest true "Server definition"
+// @Success 200 {object} gateway.ServerInfo
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Router /admin/servers/{id} [put]
+func (r *Router) updateServer(w http.ResponseWriter, req *http.Request) {
+	var body serverRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	info, err := r.app.UpdateServer(req.Context(), mux.Vars(req)["id"], body.apply)
+	if err != nil {
+		r.writeAppError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// @Summary Remove an upstream server
+// @Description Unregisters an upstream server and removes it from the configuration file. A server that other servers aggregate or fail over to is not removed.
+// @Tags admin
+// @Security AdminToken
+// @Param id path string true "Server ID"
+// @Success 204
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Router /admin/servers/{id} [delete]
+func (r *Router) removeServer(w http.ResponseWriter, req *http.Request) {
+	if err := r.app.RemoveServer(mux.Vars(req)["id"]); err != nil {
+		r.writeAppError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Summary List an upstream server's tools
+// @Description Returns the tool catalog last fetched from an upstream server.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param id path string true "Server ID"
+// @Success 200 {array} mcp.Tool
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /admin/servers/{id}/tools [get]
+func (r *Router) listServerTools(w http.ResponseWriter, req *http.Request) {
+	info, err := r.app.GetServer(req.Context(), mux.Vars(req)["id"], false)
+	if err != nil {
+		r.writeAppError(w, err)
+		return
+	}
+	tools := info.Tools
+	if tools == nil {
+		tools = []mcp.Tool{}
+	}
+	writeJSON(w, http.StatusOK, tools)
+}
+
+// @Summary Refresh an upstream server
+// @Description Probes an upstream server for its status, capabilities and tool catalog.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param id path string true "Server ID"
+// @Success 200 {object} gateway.ServerInfo
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /admin/servers/{id}/refresh [post]
+func (r *Router) refreshServer(w http.ResponseWriter, req *http.Request) {
+	info, err := r.app.GetServer(req.Context(), mux.Vars(req)["id"], true)
+	if err != nil {
+		r.writeAppError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// @Summary Disable an upstream server
+// @Description Stops routing new sessions to an upstream server and persists the change.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param id path string true "Server ID"
+// @Success 200 {object} gateway.ServerInfo
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Router /admin/servers/{id}/disable [post]
+func (r *Router) disableServer(w http.ResponseWriter, req *http.Request) {
+	r.setDisabled(w, req, true)
+}
+
+// @Summary Enable an upstream server
+// @Description Resumes routing new sessions to a disabled upstream server and persists the change.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param id path string true "Server ID"
+// @Success 200 {object} gateway.ServerInfo
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Router /admin/servers/{id}/enable [post]
+func (r *Router) enableServer(w http.ResponseWriter, req *http.Request) {
+	r.setDisabled(w, req, false)
+}
+
+// @Summary List agent sessions
+// @Description Lists the live agent sessions with the protocol versions negotiated with the agent and the upstream server.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Success 200 {array} gateway.SessionInfo
+// @Failure 401 {object} map[string]string
+// @Router /admin/sessions [get]
+func (r *Router) listSessions(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, r.app.ListSessions())
+}
+
+// @Summary List held tool calls
+// @Description Lists the tool calls held until they are approved, oldest first.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Success 200 {array} gateway.ApprovalInfo
+// @Failure 401 {object} map[string]string
+// @Router /admin/approvals [get]
+func (r *Router) listApprovals(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, r.app.ListApprovals())
+}
+
+// @Summary Stream approval events
+// @Description Streams server-sent events for held tool calls: "requested" for every call awaiting a decision, starting with those already held, then "approved", "rejected", "expired" and "cancelled" as they are settled.
+// @Tags admin
+// @Produce text/event-stream
+// @Security AdminToken
+// @Success 200 {object} gateway.ApprovalEvent
+// @Failure 401 {object} map[string]string
+// @Router /admin/approvals/events [get]
+func (r *Router) watchApprovals(w http.ResponseWriter, req *http.Request) {
+	// The stream outlives the server's write timeout.
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	events := r.app.WatchApprovals(req.Context())
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event gateway.ApprovalEvent) bool {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	for _, info := range r.app.ListApprovals() {
+		if !send(gateway.ApprovalEvent{Type: gateway.ApprovalRequested, Approval: info}) {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+	keepalive := time.NewTicker(approvalKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok || !send(event) {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// @Summary Approve a held tool call
+// @Description Forwards a held tool call to its upstream server.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param id path string true "Approval ID"
+// @Success 200 {object} gateway.ApprovalInfo
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /admin/approvals/{id}/approve [post]
+func (r *Router) approve(w http.ResponseWriter, req *http.Request) {
+	info, err := r.app.DecideApproval(mux.Vars(req)["id"], true, "")
+	if err != nil {
+		r.writeAppError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// @Summary Reject a held tool call
+// @Description Answers a held tool call with a JSON-RPC error carrying the optional reason.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security AdminToken
+// @Param id path string true "Approval ID"
+// @Param rejection body rejectRequest false "Reason given to the agent"
+// @Success 200 {object} gateway.ApprovalInfo
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /admin/approvals/{id}/reject [post]
+func (r *Router) reject(w http.ResponseWriter, req *http.Request) {
+	// The body is optional.
+	var body rejectRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	info, err := r.app.DecideApproval(mux.Vars(req)["id"], false, body.Reason)
+	if err != nil {
+		r.writeAppError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// @Summary List changed tools
+// @Description Lists the tools whose definitions changed since they were pinned in the lockfile, with the action taken until they are approved and a diff of the definitions.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Success 200 {array} gateway.ToolChange
+// @Failure 401 {object} map[string]string
+// @Failure 500 {object} map[string]string
+// @Router /admin/tools/changes [get]
+func (r *Router) listToolChanges(w http.ResponseWriter, req *http.Request) {
+	changes, err := r.app.ListToolChanges()
+	if err != nil {
+		r.logger.Printf("warning: admin request failed: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, changes)
+}
+
+// @Summary Approve a changed tool
+// @Description Pins the changed definition of a server's tool, so that it is no longer blocked, quarantined or flagged, and asks the server's agents to list its tools again.
+// @Tags admin
+// @Produce json
+// @Security AdminToken
+// @Param id path string true "Server ID"
+// @Param tool path string true "Tool name"
+// @Success 200 {object} gateway.ToolChange
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Router /admin/servers/{id}/tools/{tool}/approve [post]
+func (r *Router) approveTool(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	change, err := r.app.ApproveTool(vars["id"], vars["tool"])
+	if err != nil {
+		r.writeAppError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, change)
+}
+
+func (r *Router) setDisabled(w http.ResponseWriter, req *http.Request, disabled bool) {
+	info, err := r.app.SetServerDisabled(mux.Vars(req)["id"], disabled)
+	if err != nil {
+		r.writeAppError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (r *Router) writeAppError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, gateway.ErrServerNotFound), errors.Is(err, gateway.ErrApprovalNotFound),
+		errors.Is(err, gateway.ErrToolNotChanged):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, gateway.ErrServerExists), errors.Is(err, admin_app.ErrServerReadOnly),
+		errors.Is(err, admin_app.ErrServerInUse),
+		errors.Is(err, gateway.ErrPinningDisabled):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, admin_app.ErrPersistFailed):
+		r.logger.Printf("warning: admin request failed: %v", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		r.logger.Printf("warning: admin request failed: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,84 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	admin_app "mcpgo/backend/apps/admin"
+
+	"github.com/gorilla/mux"
+)
+
+// Router exposes the admin application over a REST API under /admin. Every
+// request must carry the configured admin bearer token.
+type Router struct {
+	app    *admin_app.App
+	token  atomic.Pointer[string]
+	logger *log.Logger
+}
+
+// NewRouter creates a new admin API router. When token is empty all admin
+// requests are refused.
+func NewRouter(app *admin_app.App, token string, logger *log.Logger) *Router {
+	if logger == nil {
+		logger = log.Default()
+	}
+	r := &Router{
+		app:    app,
+		logger: logger,
+	}
+	r.SetToken(token)
+	return r
+}
+
+// SetToken replaces the admin bearer token, e.g. after a configuration
+// reload. An empty token disables the admin API.
+func (r *Router) SetToken(token string) {
+	r.token.Store(&token)
+}
+
+// RegisterRoutes attaches the admin routes to the provided mux.Router.
+func (r *Router) RegisterRoutes(mux *mux.Router) {
+	admin := mux.PathPrefix("/admin").Subrouter()
+	admin.Use(r.authenticate)
+
+	admin.HandleFunc("/servers", r.listServers).Methods(http.MethodGet)
+	admin.HandleFunc("/servers", r.addServer).Methods(http.MethodPost)
+	admin.HandleFunc("/servers/{id}", r.getServer).Methods(http.MethodGet)
+	admin.HandleFunc("/servers/{id}", r.updateServer).Methods(http.MethodPut)
+	admin.HandleFunc("/servers/{id}", r.removeServer).Methods(http.MethodDelete)
+	admin.HandleFunc("/servers/{id}/tools", r.listServerTools).Methods(http.MethodGet)
+	admin.HandleFunc("/servers/{id}/refresh", r.refreshServer).Methods(http.MethodPost)
+	admin.HandleFunc("/servers/{id}/disable", r.disableServer).Methods(http.MethodPost)
+	admin.HandleFunc("/servers/{id}/enable", r.enableServer).Methods(http.MethodPost)
+	admin.HandleFunc("/servers/{id}/tools/{tool}/approve", r.approveTool).Methods(http.MethodPost)
+	admin.HandleFunc("/tools/changes", r.listToolChanges).Methods(http.MethodGet)
+	admin.HandleFunc("/sessions", r.listSessions).Methods(http.MethodGet)
+	admin.HandleFunc("/approvals", r.listApprovals).Methods(http.MethodGet)
+	admin.HandleFunc("/approvals/events", r.watchApprovals).Methods(http.MethodGet)
+	admin.HandleFunc("/approvals/{id}/approve", r.approve).Methods(http.MethodPost)
+	admin.HandleFunc("/approvals/{id}/reject", r.reject).Methods(http.MethodPost)
+}
+
+// authenticate rejects requests that do not present the admin bearer token.
+func (r *Router) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := *r.token.Load()
+		if token == "" {
+			writeError(w, http.StatusForbidden, "admin API is disabled; set admin.token in the configuration")
+			return
+		}
+		const prefix = "Bearer "
+		header := req.Header.Get("Authorization")
+		if !strings.HasPrefix(header, prefix) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, prefix)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mcpgo-admin"`)
+			writeError(w, http.StatusUnauthorized, "invalid or missing admin token")
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
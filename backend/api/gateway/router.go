@@ -1,7 +1,7 @@
 package gateway
 
 import (
-	"context"
+	"errors"
 	"log"
 	"net/http"
 	"strings"
@@ -9,7 +9,6 @@ import (
 	gateway_app "mcpgo/backend/apps/gateway"
 
 	"github.com/gorilla/mux"
-	"golang.org/x/net/websocket"
 )
 
 // Router wires HTTP/WebSocket requests to the gateway application.
@@ -32,38 +31,68 @@ func NewRouter(app *gateway_app.App, logger *log.Logger) *Router {
 // RegisterRoutes attaches the gateway routes to the provided mux.Router.
 func (r *Router) RegisterRoutes(mux *mux.Router) {
 	mux.Handle("/mcp", r.websocketHandler()).Methods(http.MethodGet)
+	mux.Handle("/mcp/{server}", r.websocketHandler()).Methods(http.MethodGet)
 }
 
 func (r *Router) websocketHandler() http.Handler {
-	return websocket.Server{
-		Handshake: r.handshake,
-		Handler:   r.handleWebSocket,
-	}
+	return http.HandlerFunc(r.handleWebSocket)
 }
 
-func (r *Router) handshake(cfg *websocket.Config, req *http.Request) error {
-	requested := selectSubprotocol(req.Header["Sec-Websocket-Protocol"])
-	if requested == "" {
-		requested = "mcp"
+func (r *Router) handleWebSocket(w http.ResponseWriter, req *http.Request) {
+	header := make(http.Header)
+	if requested := selectSubprotocol(req.Header["Sec-Websocket-Protocol"]); requested != "" {
+		header.Set("Sec-WebSocket-Protocol", requested)
+	}
+
+	// Agents resume a session by presenting the token they were issued,
+	// either as a header or, for clients that cannot set headers, as the
+	// resume query parameter. Unknown tokens are refused so the agent knows
+	// to start a new session.
+	resume := resumeToken(req)
+	if resume != "" && !r.app.CanResume(resume) {
+		http.Error(w, gateway_app.ErrSessionNotFound.Error(), http.StatusForbidden)
+		return
 	}
-	cfg.Protocol = []string{requested}
-	if cfg.Origin == nil {
-		if origin, err := websocket.Origin(cfg, req); err == nil {
-			cfg.Origin = origin
+	// Sessions for servers that cannot be routed to are refused before the
+	// upgrade, so the agent gets an HTTP status instead of a bare close.
+	if resume == "" {
+		if err := r.app.Routable(mux.Vars(req)["server"]); err != nil {
+			status := http.StatusServiceUnavailable
+			if errors.Is(err, gateway_app.ErrServerNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
 		}
 	}
-	return nil
-}
+	token := resume
+	if token == "" {
+		token = r.app.NewResumeToken()
+	}
+	if token != "" {
+		header.Set(gateway_app.ResumeTokenHeader, token)
+	}
 
-func (r *Router) handleWebSocket(conn *websocket.Conn) {
-	var ctx = context.Background()
-	if req := conn.Request(); req != nil {
-		ctx = req.Context()
+	conn, err := r.app.Upgrade(w, req, header)
+	if err != nil {
+		r.logger.Printf("warning: gateway error: %v", err)
+		return
+	}
+	if resume != "" {
+		err = r.app.ResumeSession(req.Context(), resume, conn)
+	} else {
+		err = r.app.StartSession(req.Context(), mux.Vars(req)["server"], token, conn)
 	}
+	if err != nil {
+		r.logger.Printf("warning: gateway error: %v", err)
+	}
+}
 
-	if err := r.app.HandleConnection(ctx, conn); err != nil {
-		r.logger.Printf("gateway error: %v", err)
+func resumeToken(req *http.Request) string {
+	if token := req.Header.Get(gateway_app.ResumeTokenHeader); token != "" {
+		return token
 	}
+	return req.URL.Query().Get("resume")
 }
 
 func selectSubprotocol(headers []string) string {
@@ -0,0 +1,277 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"mcpgo/backend/apps/gateway"
+	"mcpgo/backend/services/config"
+)
+
+// ErrPersistFailed is returned when a change could not be written back to the
+// configuration file. The change is rolled back in that case.
+var ErrPersistFailed = errors.New("failed to persist configuration")
+
+// ErrServerInUse is returned when removing a server that other servers
+// aggregate or fail over to.
+var ErrServerInUse = errors.New("server is in use")
+
+// ErrServerReadOnly is returned when a change targets a server defined in an
+// included configuration fragment, which the admin API does not rewrite.
+var ErrServerReadOnly = errors.New("server is read-only")
+
+// App implements runtime management of the gateway's upstream servers. Every
+// change is applied to the running gateway and then persisted back to the
+// configuration file so it survives a restart.
+type App struct {
+	gateway    *gateway.App
+	configPath string
+	logger     *log.Logger
+
+	// mu serialises mutations so the persisted file always reflects the
+	// order in which changes were applied.
+	mu sync.Mutex
+}
+
+// NewApp creates an admin app managing the servers of gatewayApp. When
+// configPath is empty, changes are applied in memory only.
+func NewApp(gatewayApp *gateway.App, configPath string, logger *log.Logger) (*App, error) {
+	if gatewayApp == nil {
+		return nil, errors.New("gateway app is required")
+	}
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &App{
+		gateway:    gatewayApp,
+		configPath: configPath,
+		logger:     logger,
+	}, nil
+}
+
+// ListServers returns every upstream server with its current status.
+func (a *App) ListServers() []gateway.ServerInfo {
+	return a.gateway.Servers()
+}
+
+// ListSessions returns every live agent session with the protocol versions
+// negotiated on each side.
+func (a *App) ListSessions() []gateway.SessionInfo {
+	return a.gateway.Sessions()
+}
+
+// ListApprovals returns the tool calls held for approval.
+func (a *App) ListApprovals() []gateway.ApprovalInfo {
+	return a.gateway.Approvals()
+}
+
+// DecideApproval approves or rejects a held tool call.
+func (a *App) DecideApproval(id string, approved bool, reason string) (gateway.ApprovalInfo, error) {
+	return a.gateway.DecideApproval(id, approved, reason)
+}
+
+// ListToolChanges returns the tools whose definitions changed since they
+// were approved.
+func (a *App) ListToolChanges() ([]gateway.ToolChange, error) {
+	return a.gateway.ToolChanges()
+}
+
+// ApproveTool approves the changed definition of a server's tool.
+func (a *App) ApproveTool(server, tool string) (gateway.ToolChange, error) {
+	return a.gateway.ApproveTool(server, tool)
+}
+
+// WatchApprovals streams the approval events until ctx ends.
+func (a *App) WatchApprovals(ctx context.Context) <-chan gateway.ApprovalEvent {
+	return a.gateway.WatchApprovals(ctx)
+}
+
+// GetServer returns an upstream server including its capabilities and tool
+// catalog. When refresh is set the server is probed first.
+func (a *App) GetServer(ctx context.Context, id string, refresh bool) (gateway.ServerInfo, error) {
+	if refresh {
+		return a.gateway.RefreshServer(ctx, id)
+	}
+	return a.gateway.Server(id)
+}
+
+// AddServer registers a new upstream server, persists it and probes it.
+func (a *App) AddServer(ctx context.Context, cfg config.ServerConfig) (gateway.ServerInfo, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := a.serverConfig(cfg.ID); err == nil {
+		return gateway.ServerInfo{}, fmt.Errorf("%w: %s", gateway.ErrServerExists, cfg.ID)
+	}
+	if err := a.gateway.ValidateServers(append(a.gateway.ServerConfigs(), cfg)); err != nil {
+		return gateway.ServerInfo{}, err
+	}
+	if err := a.gateway.AddServer(cfg); err != nil {
+		return gateway.ServerInfo{}, err
+	}
+	if err := a.persist(); err != nil {
+		_ = a.gateway.RemoveServer(cfg.ID)
+		return gateway.ServerInfo{}, err
+	}
+	a.logger.Printf("admin: added upstream server %s", cfg.ID)
+	return a.refreshEnabled(ctx, cfg.ID)
+}
+
+// UpdateServer changes the configuration of an upstream server with update,
+// which is given the current one, persists it and probes it.
+func (a *App) UpdateServer(ctx context.Context, id string, update func(config.ServerConfig) config.ServerConfig) (gateway.ServerInfo, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	previous, err := a.editableServer(id)
+	if err != nil {
+		return gateway.ServerInfo{}, err
+	}
+	cfg := update(previous)
+	servers := a.gateway.ServerConfigs()
+	for i := range servers {
+		if servers[i].ID == id {
+			servers[i] = cfg
+		}
+	}
+	if err := a.gateway.ValidateServers(servers); err != nil {
+		return gateway.ServerInfo{}, err
+	}
+	if err := a.gateway.UpdateServer(id, cfg); err != nil {
+		return gateway.ServerInfo{}, err
+	}
+	if err := a.persist(); err != nil {
+		_ = a.gateway.UpdateServer(id, previous)
+		return gateway.ServerInfo{}, err
+	}
+	a.logger.Printf("admin: updated upstream server %s", id)
+	return a.refreshEnabled(ctx, id)
+}
+
+// SetServerDisabled disables or re-enables an upstream server.
+func (a *App) SetServerDisabled(id string, disabled bool) (gateway.ServerInfo, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	previous, err := a.editableServer(id)
+	if err != nil {
+		return gateway.ServerInfo{}, err
+	}
+	if err := a.gateway.SetServerDisabled(id, disabled); err != nil {
+		return gateway.ServerInfo{}, err
+	}
+	if err := a.persist(); err != nil {
+		_ = a.gateway.SetServerDisabled(id, previous.Disabled)
+		return gateway.ServerInfo{}, err
+	}
+	a.logger.Printf("admin: set upstream server %s disabled=%t", id, disabled)
+	return a.gateway.Server(id)
+}
+
+// RemoveServer unregisters an upstream server and persists the change. A
+// server that other servers aggregate or fail over to is not removed.
+func (a *App) RemoveServer(id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := a.editableServer(id); err != nil {
+		return err
+	}
+	before := a.gateway.ServerConfigs()
+	if users := referencing(before, id); len(users) > 0 {
+		return fmt.Errorf("%w: %s is referenced by %s", ErrServerInUse, id, strings.Join(users, ", "))
+	}
+	if err := a.gateway.RemoveServer(id); err != nil {
+		return err
+	}
+	if err := a.persist(); err != nil {
+		a.restore(before)
+		return err
+	}
+	a.logger.Printf("admin: removed upstream server %s", id)
+	return nil
+}
+
+// referencing returns the servers that aggregate id or fail over to it.
+func referencing(servers []config.ServerConfig, id string) []string {
+	var users []string
+	for _, server := range servers {
+		failovers := []config.FailoverConfig{server.Failover}
+		for _, tool := range server.Tools {
+			failovers = append(failovers, tool.Failover)
+		}
+		uses := false
+		for _, member := range server.Aggregate {
+			uses = uses || member == id
+		}
+		for _, failover := range failovers {
+			for _, fallback := range failover.Fallbacks {
+				uses = uses || fallback.Server == id
+			}
+		}
+		if uses {
+			users = append(users, server.ID)
+		}
+	}
+	return users
+}
+
+func (a *App) serverConfig(id string) (config.ServerConfig, error) {
+	for _, cfg := range a.gateway.ServerConfigs() {
+		if cfg.ID == id {
+			return cfg, nil
+		}
+	}
+	return config.ServerConfig{}, fmt.Errorf("%w: %s", gateway.ErrServerNotFound, id)
+}
+
+// editableServer returns the configuration of a server the admin API may
+// change.
+func (a *App) editableServer(id string) (config.ServerConfig, error) {
+	cfg, err := a.serverConfig(id)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.Source != "" {
+		return cfg, fmt.Errorf("%w: %s is defined in %s", ErrServerReadOnly, id, cfg.Source)
+	}
+	return cfg, nil
+}
+
+func (a *App) refreshEnabled(ctx context.Context, id string) (gateway.ServerInfo, error) {
+	info, err := a.gateway.Server(id)
+	if err != nil || info.Disabled {
+		return info, err
+	}
+	return a.gateway.RefreshServer(ctx, id)
+}
+
+func (a *App) persist() error {
+	if a.configPath == "" {
+		return nil
+	}
+	if err := config.SaveServers(a.configPath, a.gateway.ServerConfigs()); err != nil {
+		return fmt.Errorf("%w to %s: %v", ErrPersistFailed, a.configPath, err)
+	}
+	return nil
+}
+
+// restore re-registers the servers that were present before a failed
+// removal, keeping the running gateway consistent with the file on disk.
+func (a *App) restore(servers []config.ServerConfig) {
+	current := make(map[string]bool)
+	for _, cfg := range a.gateway.ServerConfigs() {
+		current[cfg.ID] = true
+	}
+	for _, cfg := range servers {
+		if !current[cfg.ID] {
+			if err := a.gateway.AddServer(cfg); err != nil {
+				a.logger.Printf("warning: admin: failed to restore upstream server %s: %v", cfg.ID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	admin_api "mcpgo/backend/api/admin"
+	gateway_api "mcpgo/backend/api/gateway"
+	admin_app "mcpgo/backend/apps/admin"
+	gateway_app "mcpgo/backend/apps/gateway"
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/mcp"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/websocket"
+)
+
+func TestAdminAPIManagesServers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	content := []byte("# gateway config\nagent:\n  http:\n    addr: \":9000\"\nservers:\n  - id: \"first\"\n    name: \"First\"\n    address: \"ws://127.0.0.1:${FIRST_PORT:-1}/mcp\"\n    protocol: \"mcp/v1\"\n    request_timeout: 5s\n")
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	logger := log.New(io.Discard, "", 0)
+	gatewayApp, err := gateway_app.NewAppFromConfig(cfg, logger)
+	if err != nil {
+		t.Fatalf("failed to create gateway app: %v", err)
+	}
+	adminApp, err := admin_app.NewApp(gatewayApp, path, logger)
+	if err != nil {
+		t.Fatalf("failed to create admin app: %v", err)
+	}
+
+	router := mux.NewRouter()
+	admin_api.NewRouter(adminApp, "secret", logger).RegisterRoutes(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	do := func(method, path, token, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to build request: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	if resp := do(http.MethodGet, "/admin/servers", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodGet, "/admin/servers", "wrong", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with wrong token, got %d", resp.StatusCode)
+	}
+
+	resp := do(http.MethodPost, "/admin/servers", "secret", `{"id":"second","name":"Second","address":"ws://127.0.0.1:1/other","protocol":"mcp/v1"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 from add, got %d", resp.StatusCode)
+	}
+	var added gateway_app.ServerInfo
+	if err := json.NewDecoder(resp.Body).Decode(&added); err != nil {
+		t.Fatalf("failed to decode added server: %v", err)
+	}
+	if added.Status != gateway_app.StatusOffline {
+		t.Fatalf("expected unreachable server to be offline, got %q", added.Status)
+	}
+
+	if resp := do(http.MethodPost, "/admin/servers", "secret", `{"id":"second","address":"ws://127.0.0.1:1/other"}`); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for duplicate server, got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodPost, "/admin/servers/first/disable", "secret", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from disable, got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodDelete, "/admin/servers/missing", "secret", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown server, got %d", resp.StatusCode)
+	}
+
+	resp = do(http.MethodGet, "/admin/servers", "secret", "")
+	var servers []gateway_app.ServerInfo
+	if err := json.NewDecoder(resp.Body).Decode(&servers); err != nil {
+		t.Fatalf("failed to decode servers: %v", err)
+	}
+	if len(servers) != 2 || servers[0].Status != gateway_app.StatusDisabled || servers[1].ID != "second" {
+		t.Fatalf("unexpected server list %+v", servers)
+	}
+
+	persisted, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("failed to reload persisted config: %v", err)
+	}
+	if len(persisted.Servers) != 2 || !persisted.Servers[0].Disabled || persisted.Servers[1].Address != "ws://127.0.0.1:1/other" {
+		t.Fatalf("unexpected persisted servers %+v", persisted.Servers)
+	}
+	if persisted.Agent.HTTP.Addr != ":9000" {
+		t.Fatalf("expected unrelated settings to be preserved, got addr %q", persisted.Agent.HTTP.Addr)
+	}
+	raw, _ := os.ReadFile(path)
+	if !strings.Contains(string(raw), "# gateway config") {
+		t.Fatalf("expected comments to be preserved, got:\n%s", raw)
+	}
+
+	// Updates keep the settings the request does not describe, and the
+	// references in the file.
+	if resp := do(http.MethodPut, "/admin/servers/first", "secret", `{"name":"Renamed","address":"ws://127.0.0.1:1/mcp","protocol":"mcp/v1","disabled":true}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from update, got %d", resp.StatusCode)
+	}
+	persisted, err = config.Load(path)
+	if err != nil || persisted.Servers[0].Name != "Renamed" || persisted.Servers[0].RequestTimeout.Duration != 5*time.Second {
+		t.Fatalf("expected the update to keep the request timeout, got %+v (%v)", persisted.Servers, err)
+	}
+	if raw, _ := os.ReadFile(path); !strings.Contains(string(raw), "${FIRST_PORT:-1}") {
+		t.Fatalf("expected the address reference to be kept, got:\n%s", raw)
+	}
+	if resp := do(http.MethodPost, "/admin/servers", "secret", `{"id":"bad","address":"http://127.0.0.1:1/mcp"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a server the configuration would reject, got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodPost, "/admin/servers", "secret", `{"id":"group","aggregate":["second"]}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 from adding an aggregated server, got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodDelete, "/admin/servers/second", "secret", ""); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 removing an aggregated member, got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodDelete, "/admin/servers/group", "secret", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 from delete, got %d", resp.StatusCode)
+	}
+
+	if resp := do(http.MethodDelete, "/admin/servers/second", "secret", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 from delete, got %d", resp.StatusCode)
+	}
+	persisted, err = config.Load(path)
+	if err != nil {
+		t.Fatalf("failed to reload persisted config: %v", err)
+	}
+	if len(persisted.Servers) != 1 || persisted.Servers[0].ID != "first" {
+		t.Fatalf("unexpected persisted servers after delete %+v", persisted.Servers)
+	}
+
+	resp = do(http.MethodGet, "/admin/approvals", "secret", "")
+	var approvals []gateway_app.ApprovalInfo
+	if err := json.NewDecoder(resp.Body).Decode(&approvals); err != nil || resp.StatusCode != http.StatusOK || len(approvals) != 0 {
+		t.Fatalf("expected no held calls, got %d %+v (%v)", resp.StatusCode, approvals, err)
+	}
+	if resp := do(http.MethodPost, "/admin/approvals/1/reject", "secret", `{"reason":"no"}`); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 rejecting an unknown call, got %d", resp.StatusCode)
+	}
+
+	resp = do(http.MethodGet, "/admin/tools/changes", "secret", "")
+	var changes []gateway_app.ToolChange
+	if err := json.NewDecoder(resp.Body).Decode(&changes); err != nil || resp.StatusCode != http.StatusOK || len(changes) != 0 {
+		t.Fatalf("expected no changed tools, got %d %+v (%v)", resp.StatusCode, changes, err)
+	}
+	if resp := do(http.MethodPost, "/admin/servers/first/tools/echo/approve", "secret", ""); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 approving a tool without a lockfile, got %d", resp.StatusCode)
+	}
+	// The stream stays open until the client goes away.
+	resp = do(http.MethodGet, "/admin/approvals/events", "secret", "")
+	resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestServerUpdatesKeepApprovalRules(t *testing.T) {
+	upstream := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		defer conn.Close()
+		for {
+			var msg mcp.Message
+			if err := websocket.JSON.Receive(conn, &msg); err != nil {
+				return
+			}
+			if !msg.IsRequest() {
+				continue
+			}
+			reply, _ := mcp.NewResult(msg.ID, json.RawMessage(`{"content":[]}`))
+			if err := websocket.JSON.Send(conn, reply); err != nil {
+				return
+			}
+		}
+	}))
+	defer upstream.Close()
+	address := "ws" + strings.TrimPrefix(upstream.URL, "http")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "servers:\n  - id: \"repos\"\n    address: \"" + address + "\"\n    approval:\n      rules:\n        - tools: [\"delete_*\"]\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	logger := log.New(io.Discard, "", 0)
+	gatewayApp, err := gateway_app.NewAppFromConfig(cfg, logger)
+	if err != nil {
+		t.Fatalf("failed to create gateway app: %v", err)
+	}
+	adminApp, err := admin_app.NewApp(gatewayApp, path, logger)
+	if err != nil {
+		t.Fatalf("failed to create admin app: %v", err)
+	}
+	router := mux.NewRouter()
+	admin_api.NewRouter(adminApp, "secret", logger).RegisterRoutes(router)
+	gateway_api.NewRouter(gatewayApp, logger).RegisterRoutes(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/admin/servers/repos", strings.NewReader(`{"name":"Repositories","address":"`+address+`"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from update, got %v (%v)", resp, err)
+	}
+	resp.Body.Close()
+	if persisted, err := config.Load(path); err != nil || len(persisted.Servers[0].Approval.Rules) != 1 {
+		t.Fatalf("expected the approval rules to be persisted, got %+v (%v)", persisted, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := gatewayApp.WatchApprovals(ctx)
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/mcp/repos", "mcp", "http://localhost")
+	if err != nil {
+		t.Fatalf("failed to dial gateway: %v", err)
+	}
+	defer conn.Close()
+	call, _ := mcp.NewRequest(json.RawMessage("1"), "tools/call", map[string]string{"name": "delete_repo"})
+	if err := websocket.JSON.Send(conn, call); err != nil {
+		t.Fatalf("failed to send the call: %v", err)
+	}
+	select {
+	case event := <-events:
+		if event.Type != gateway_app.ApprovalRequested || event.Approval.Tool != "delete_repo" {
+			t.Fatalf("expected the call to be held, got %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the call to be held for approval after the update")
+	}
+}
@@ -0,0 +1,688 @@
+package gateway
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"mcpgo/backend/services/mcp"
+)
+
+// memberSeparator joins a member's server id and the name of one of its
+// tools or prompts in the catalog of an aggregated server.
+const memberSeparator = "__"
+
+// listKinds describes the list methods an aggregated server pages through
+// its members for: the capability a member needs to be asked and the field
+// of the result holding the items.
+var listKinds = map[string]struct{ capability, field string }{
+	"tools/list":               {"tools", "tools"},
+	"prompts/list":             {"prompts", "prompts"},
+	"resources/list":           {"resources", "resources"},
+	"resources/templates/list": {"resources", "resourceTemplates"},
+}
+
+// aggregate connects a session of an aggregated server to each of its
+// members. The agent sees a single server: the members' catalogs are
+// listed one after another, with tool and prompt names prefixed by the
+// member's id, and requests are routed to the member they concern. Every
+// agent request is handled on its own goroutine.
+type aggregate struct {
+	s       *session
+	members []*member
+	// key signs the pagination cursors.
+	key []byte
+
+	mu     sync.Mutex
+	nextID int64
+	calls  map[string]*aggregateCall
+	// owners maps the URIs of listed resources to the member listing them.
+	owners map[string]*member
+}
+
+// member is the connection of an aggregated session to one member server.
+type member struct {
+	id   string
+	up   *upstream
+	ep   *endpoint
+	conn *Conn
+	// init is the member's initialize result, guarded by the aggregate's
+	// mutex; stop ends the watch on the member being retired.
+	init *mcp.InitializeResult
+	stop func() bool
+
+	mu      sync.Mutex
+	pending map[string]chan *mcp.Message
+	lost    bool
+}
+
+// aggregateCall is an agent request being handled.
+type aggregateCall struct {
+	cancel context.CancelFunc
+}
+
+// aggregateCursor is the content of a pagination cursor issued by an
+// aggregated server: the member to list next and the member's own cursor.
+type aggregateCursor struct {
+	Server string `json:"s"`
+	Method string `json:"l"`
+	Member string `json:"m"`
+	Cursor string `json:"c,omitempty"`
+}
+
+// dialAggregate connects to every enabled member of the aggregated server
+// up, picking each member's replica for the agent's request.
+func (a *App) dialAggregate(ctx context.Context, up *upstream, req *http.Request, subproto string) (*aggregate, error) {
+	a.mu.RLock()
+	key := a.cursorKey
+	a.mu.RUnlock()
+	agg := &aggregate{
+		key:    key,
+		calls:  make(map[string]*aggregateCall),
+		owners: make(map[string]*member),
+	}
+	for _, id := range up.config.Aggregate {
+		memberUp, err := a.route(id)
+		switch {
+		case errors.Is(err, ErrServerDisabled):
+			continue
+		case err != nil:
+			return nil, err
+		case memberUp.balancer == nil:
+			return nil, fmt.Errorf("server %s cannot aggregate the aggregated server %s", up.id, id)
+		}
+		agg.members = append(agg.members, &member{
+			id:      id,
+			up:      memberUp,
+			pending: make(map[string]chan *mcp.Message),
+		})
+	}
+	if len(agg.members) == 0 {
+		return nil, fmt.Errorf("%w: every member of %s is disabled", ErrNoUpstream, up.id)
+	}
+
+	errs := make([]error, len(agg.members))
+	var wg sync.WaitGroup
+	for i, m := range agg.members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.ep = m.up.balancer.pick(m.up.balancer.callerKey(req))
+			m.conn, errs[i] = a.dialUpstream(ctx, m.up, m.ep, subproto)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		for _, m := range agg.members {
+			if m.conn != nil {
+				_ = m.conn.Close()
+			}
+		}
+		return nil, err
+	}
+	return agg, nil
+}
+
+// start attaches the aggregate to its session and starts reading from the
+// members. The session ends when any member is retired.
+func (a *aggregate) start(s *session) {
+	a.s = s
+	for _, m := range a.members {
+		m.up.sessions.Add(1)
+		m.ep.active.Add(1)
+		up := m.up
+		m.stop = context.AfterFunc(up.ctx, func() {
+			s.cancel(context.Cause(up.ctx))
+		})
+		go a.read(m)
+	}
+}
+
+// close closes the member connections when the session ends.
+func (a *aggregate) close(cause error) {
+	for _, m := range a.members {
+		m.stop()
+		_ = m.conn.closeWith(closeStatus(cause))
+		m.up.sessions.Add(-1)
+		m.ep.active.Add(-1)
+	}
+}
+
+// forward handles a message the agent sent. Notifications other than
+// cancellations go to every member. Responses to the members' requests
+// never reach it; the session passes them on.
+func (a *aggregate) forward(msg rawMessage) {
+	var m mcp.Message
+	if json.Unmarshal(msg.Data, &m) != nil {
+		return
+	}
+	switch {
+	case m.IsRequest():
+		ctx, cancel := context.WithCancel(a.s.ctx)
+		call := &aggregateCall{cancel: cancel}
+		a.mu.Lock()
+		a.calls[string(m.ID)] = call
+		a.mu.Unlock()
+		go func() {
+			defer cancel()
+			reply := a.handle(ctx, &m)
+			a.mu.Lock()
+			if a.calls[string(m.ID)] == call {
+				delete(a.calls, string(m.ID))
+			}
+			a.mu.Unlock()
+			if reply != nil && ctx.Err() == nil {
+				reply.ID = m.ID
+				a.s.respond(reply)
+			}
+		}()
+	case m.IsNotification() && m.Method == "notifications/cancelled":
+		var params struct {
+			RequestID json.RawMessage `json:"requestId"`
+		}
+		if json.Unmarshal(m.Params, &params) == nil {
+			a.cancel(params.RequestID)
+		}
+	case m.IsNotification():
+		for _, member := range a.members {
+			_ = member.conn.send(msg)
+		}
+	}
+}
+
+// cancel stops handling the agent's request id; the members working on it
+// are sent notifications/cancelled.
+func (a *aggregate) cancel(id json.RawMessage) {
+	a.mu.Lock()
+	call := a.calls[string(id)]
+	delete(a.calls, string(id))
+	a.mu.Unlock()
+	if call != nil {
+		call.cancel()
+	}
+}
+
+// handle answers an agent request, returning nil when ctx ended first.
+func (a *aggregate) handle(ctx context.Context, m *mcp.Message) *mcp.Message {
+	switch m.Method {
+	case "initialize":
+		return a.initialize(ctx, m)
+	case "ping":
+		reply, _ := mcp.NewResult(nil, struct{}{})
+		return reply
+	case "tools/list", "prompts/list", "resources/list", "resources/templates/list":
+		return a.list(ctx, m)
+	case "tools/call", "prompts/get":
+		var params struct {
+			Name string `json:"name"`
+		}
+		_ = json.Unmarshal(m.Params, &params)
+		target, name, ok := a.byName(params.Name)
+		if ok {
+			name, ok = target.resolve(m.Method, name)
+		}
+		if !ok {
+			return mcp.NewError(nil, mcp.CodeInvalidParams, fmt.Sprintf("unknown name %q", params.Name))
+		}
+		forwarded := setParam(m.Params, "name", quote(name))
+		if m.Method == "tools/call" {
+			if refusal := a.s.app.blockedCall(target.up, name); refusal != nil {
+				return refusal
+			}
+			var err error
+			if forwarded, err = a.s.transformArguments(target.up.toolArguments(name), forwarded); err != nil {
+				return mcp.NewError(nil, mcp.CodeInternalError, fmt.Sprintf("cannot call tool %q: %v", params.Name, err))
+			}
+			var call struct {
+				Arguments json.RawMessage `json:"arguments"`
+			}
+			_ = json.Unmarshal(forwarded, &call)
+			if cfg, ok := a.s.approvalFor(target.up, name, call.Arguments); ok {
+				if refusal := a.s.awaitApproval(ctx, target.up, cfg, name, call.Arguments); refusal != nil {
+					return refusal
+				}
+			}
+		}
+		return a.call(ctx, target, m.Method, forwarded)
+	case "resources/read", "resources/subscribe", "resources/unsubscribe":
+		uri, _ := resourceURI(m.Params)
+		return a.byURI(ctx, uri, m.Method, m.Params)
+	case "completion/complete":
+		return a.complete(ctx, m)
+	case "logging/setLevel":
+		return a.broadcast(ctx, m)
+	}
+	return a.first(ctx, a.members, m.Method, m.Params)
+}
+
+// initialize sends the agent's initialize request to every member and
+// merges their results: the oldest protocol version any member chose, the
+// union of their capabilities and their instructions.
+func (a *aggregate) initialize(ctx context.Context, m *mcp.Message) *mcp.Message {
+	replies := make([]*mcp.Message, len(a.members))
+	var wg sync.WaitGroup
+	for i, member := range a.members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replies[i] = a.call(ctx, member, "initialize", m.Params)
+		}()
+	}
+	wg.Wait()
+
+	result := mcp.InitializeResult{
+		ServerInfo: mcp.Implementation{Name: "mcpgo/" + a.s.up.id, Version: mcp.ClientInfo.Version},
+	}
+	var capabilities []json.RawMessage
+	var instructions []string
+	for i, reply := range replies {
+		if reply == nil || reply.Error != nil {
+			return reply
+		}
+		var init mcp.InitializeResult
+		if err := json.Unmarshal(reply.Result, &init); err != nil {
+			return mcp.NewError(nil, mcp.CodeInternalError, fmt.Sprintf("invalid initialize result from %s: %v", a.members[i].id, err))
+		}
+		a.mu.Lock()
+		a.members[i].init = &init
+		a.mu.Unlock()
+		if result.ProtocolVersion == "" || init.ProtocolVersion < result.ProtocolVersion {
+			result.ProtocolVersion = init.ProtocolVersion
+		}
+		capabilities = append(capabilities, init.Capabilities)
+		if init.Instructions != "" {
+			instructions = append(instructions, init.Instructions)
+		}
+	}
+	result.Capabilities = mergeCapabilities(capabilities)
+	result.Instructions = strings.Join(instructions, "\n\n")
+	reply, _ := mcp.NewResult(nil, result)
+	return reply
+}
+
+// list returns one page of a member's list. The cursor of the page names
+// the member and the member's cursor for the next page or, after a
+// member's last page, the next member to list.
+func (a *aggregate) list(ctx context.Context, m *mcp.Message) *mcp.Message {
+	kind := listKinds[m.Method]
+	var params mcp.PaginatedParams
+	_ = json.Unmarshal(m.Params, &params)
+	index, cursor := a.nextLister(0, kind.capability), ""
+	if params.Cursor != "" {
+		var ok bool
+		if index, cursor, ok = a.parseCursor(m.Method, params.Cursor); !ok {
+			return mcp.NewError(nil, mcp.CodeInvalidParams, "invalid cursor")
+		}
+	}
+	if index < 0 {
+		reply, _ := mcp.NewResult(nil, map[string]interface{}{kind.field: []interface{}{}})
+		return reply
+	}
+
+	target := a.members[index]
+	reply := a.call(ctx, target, m.Method, withCursor(m.Params, cursor))
+	if reply == nil || reply.Error != nil {
+		return reply
+	}
+	var result map[string]json.RawMessage
+	if err := json.Unmarshal(reply.Result, &result); err != nil {
+		return mcp.NewError(nil, mcp.CodeInternalError, fmt.Sprintf("invalid %s result from %s: %v", m.Method, target.id, err))
+	}
+	if m.Method == "tools/list" {
+		result[kind.field] = a.s.app.pinTools(target.up, result[kind.field])
+		target.up.learnTools(result[kind.field])
+	}
+	if c := target.up.catalog(); c.rewrites() {
+		result[kind.field] = c.list(m.Method, result[kind.field])
+	}
+	switch kind.field {
+	case "tools", "prompts":
+		result[kind.field] = prefixNames(result[kind.field], target.id)
+	case "resources":
+		a.recordOwners(result[kind.field], target)
+	}
+
+	var next string
+	_ = json.Unmarshal(result["nextCursor"], &next)
+	delete(result, "nextCursor")
+	if next != "" {
+		result["nextCursor"] = quote(a.signCursor(m.Method, target, next))
+	} else if after := a.nextLister(index+1, kind.capability); after >= 0 {
+		result["nextCursor"] = quote(a.signCursor(m.Method, a.members[after], ""))
+	}
+	reply, _ = mcp.NewResult(nil, result)
+	return reply
+}
+
+// nextLister returns the index of the first member from start on that
+// advertises capability, or -1.
+func (a *aggregate) nextLister(start int, capability string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := start; i < len(a.members); i++ {
+		if init := a.members[i].init; init == nil || hasCapability(init.Capabilities, capability) {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordOwners remembers which member listed each resource, so that reads
+// and subscriptions go to it.
+func (a *aggregate) recordOwners(items json.RawMessage, owner *member) {
+	var resources []struct {
+		URI string `json:"uri"`
+	}
+	if json.Unmarshal(items, &resources) != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, resource := range resources {
+		a.owners[resource.URI] = owner
+	}
+}
+
+// byName resolves a prefixed tool or prompt name to its member and the
+// member's own name for it. The longest matching member id wins.
+func (a *aggregate) byName(name string) (*member, string, bool) {
+	var target *member
+	for _, m := range a.members {
+		if strings.HasPrefix(name, m.id+memberSeparator) && (target == nil || len(m.id) > len(target.id)) {
+			target = m
+		}
+	}
+	if target == nil {
+		return nil, "", false
+	}
+	return target, strings.TrimPrefix(name, target.id+memberSeparator), true
+}
+
+// byURI sends a request concerning the resource uri to the member that
+// listed it or, for a resource not listed yet, to each member exposing it
+// in turn until one succeeds.
+func (a *aggregate) byURI(ctx context.Context, uri, method string, params json.RawMessage) *mcp.Message {
+	a.mu.Lock()
+	owner := a.owners[uri]
+	a.mu.Unlock()
+	if owner != nil {
+		return a.call(ctx, owner, method, params)
+	}
+	var members []*member
+	for _, m := range a.members {
+		if m.up.catalog().expose.Resources.Allows(uri) {
+			members = append(members, m)
+		}
+	}
+	if len(members) == 0 {
+		return mcp.NewError(nil, mcp.CodeInvalidParams, fmt.Sprintf("unknown resource %q", uri))
+	}
+	return a.first(ctx, members, method, params)
+}
+
+// resolve maps the name of a tool or prompt as the member's catalog exposes
+// it to the member's own name, reporting false when the catalog hides it.
+func (m *member) resolve(method, name string) (string, bool) {
+	c := m.up.catalog()
+	if method == "tools/call" {
+		return c.toolName(name)
+	}
+	return name, c.filter(method).Allows(name)
+}
+
+// complete routes completion/complete by the prompt or resource it
+// completes an argument of.
+func (a *aggregate) complete(ctx context.Context, m *mcp.Message) *mcp.Message {
+	var params struct {
+		Ref struct {
+			Type string `json:"type"`
+			Name string `json:"name"`
+			URI  string `json:"uri"`
+		} `json:"ref"`
+	}
+	_ = json.Unmarshal(m.Params, &params)
+	if params.Ref.Type != "ref/prompt" {
+		return a.byURI(ctx, params.Ref.URI, m.Method, m.Params)
+	}
+	target, name, ok := a.byName(params.Ref.Name)
+	if !ok {
+		return mcp.NewError(nil, mcp.CodeInvalidParams, fmt.Sprintf("unknown prompt %q", params.Ref.Name))
+	}
+	var fields map[string]json.RawMessage
+	_ = json.Unmarshal(m.Params, &fields)
+	return a.call(ctx, target, m.Method, setParam(m.Params, "ref", setParam(fields["ref"], "name", quote(name))))
+}
+
+// broadcast sends a request to every member, answering with the first
+// error or an empty result.
+func (a *aggregate) broadcast(ctx context.Context, m *mcp.Message) *mcp.Message {
+	for _, member := range a.members {
+		if reply := a.call(ctx, member, m.Method, m.Params); reply == nil || reply.Error != nil {
+			return reply
+		}
+	}
+	reply, _ := mcp.NewResult(nil, struct{}{})
+	return reply
+}
+
+// first sends a request to each of members in turn until one answers it
+// without an error, returning the last answer.
+func (a *aggregate) first(ctx context.Context, members []*member, method string, params json.RawMessage) *mcp.Message {
+	var reply *mcp.Message
+	for _, m := range members {
+		if reply = a.call(ctx, m, method, params); reply == nil || reply.Error == nil {
+			return reply
+		}
+	}
+	return reply
+}
+
+// call sends a request to a member and waits for the answer. It returns
+// nil when ctx ends first, after cancelling the request on the member.
+func (a *aggregate) call(ctx context.Context, m *member, method string, params json.RawMessage) *mcp.Message {
+	a.mu.Lock()
+	a.nextID++
+	id := strconv.FormatInt(a.nextID, 10)
+	a.mu.Unlock()
+
+	replies := make(chan *mcp.Message, 1)
+	m.mu.Lock()
+	if m.lost {
+		m.mu.Unlock()
+		return upstreamUnavailable()
+	}
+	m.pending[id] = replies
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.pending, id)
+		m.mu.Unlock()
+	}()
+
+	// A failed write means the connection is broken; its read loop fails
+	// the pending requests.
+	_ = send(m.conn, &mcp.Message{JSONRPC: "2.0", ID: json.RawMessage(id), Method: method, Params: params})
+	select {
+	case reply := <-replies:
+		return reply
+	case <-ctx.Done():
+		cancelled, _ := mcp.NewNotification("notifications/cancelled", map[string]interface{}{
+			"requestId": json.RawMessage(id),
+			"reason":    "request cancelled",
+		})
+		_ = send(m.conn, cancelled)
+		return nil
+	}
+}
+
+// read dispatches a member's messages until its connection fails, which
+// ends the session.
+func (a *aggregate) read(m *member) {
+	for {
+		msg, err := m.conn.receive()
+		if err != nil {
+			m.mu.Lock()
+			m.lost = true
+			for id, replies := range m.pending {
+				replies <- upstreamUnavailable()
+				delete(m.pending, id)
+			}
+			m.mu.Unlock()
+			a.s.cancel(fmt.Errorf("member %s: %w: %w", m.id, errUpstreamLost, err))
+			return
+		}
+		parts, _ := splitBatch(msg)
+		for _, part := range parts {
+			a.dispatch(m, part)
+		}
+	}
+}
+
+// dispatch routes a message from the connection to m.
+func (a *aggregate) dispatch(m *member, msg rawMessage) {
+	var reply mcp.Message
+	if json.Unmarshal(msg.Data, &reply) != nil {
+		return
+	}
+	switch {
+	case reply.IsResponse():
+		m.mu.Lock()
+		replies := m.pending[string(reply.ID)]
+		delete(m.pending, string(reply.ID))
+		m.mu.Unlock()
+		if replies != nil {
+			replies <- &reply
+		}
+	case reply.IsNotification():
+		a.s.up.invalidateCache(&msg)
+		a.s.deliver(msg)
+	case reply.IsRequest():
+		a.s.serverRequest(m.up, &reply, func(answer *mcp.Message) {
+			_ = send(m.conn, answer)
+		})
+	}
+}
+
+// signCursor issues a cursor for listing target from its cursor next. The
+// cursor is signed so that an agent cannot forge one naming a server the
+// aggregated server does not include.
+func (a *aggregate) signCursor(method string, target *member, next string) string {
+	payload, _ := json.Marshal(aggregateCursor{
+		Server: a.s.up.id,
+		Method: method,
+		Member: target.id,
+		Cursor: next,
+	})
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(a.mac(payload))
+}
+
+// parseCursor verifies a cursor issued by signCursor for method, returning
+// the index of the member it names and the member's cursor.
+func (a *aggregate) parseCursor(method, cursor string) (int, string, bool) {
+	encoded, signature, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return 0, "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0, "", false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, a.mac(payload)) {
+		return 0, "", false
+	}
+	var c aggregateCursor
+	if json.Unmarshal(payload, &c) != nil || c.Server != a.s.up.id || c.Method != method {
+		return 0, "", false
+	}
+	for i, m := range a.members {
+		if m.id == c.Member {
+			return i, c.Cursor, true
+		}
+	}
+	return 0, "", false
+}
+
+func (a *aggregate) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, a.key)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// mergeCapabilities combines the members' capabilities. Boolean flags such
+// as listChanged and subscribe are set when any member sets them; other
+// settings are taken from the first member declaring them.
+func mergeCapabilities(all []json.RawMessage) json.RawMessage {
+	merged := make(map[string]map[string]interface{})
+	for _, raw := range all {
+		var capabilities map[string]map[string]interface{}
+		if json.Unmarshal(raw, &capabilities) != nil {
+			continue
+		}
+		for name, settings := range capabilities {
+			if merged[name] == nil {
+				merged[name] = make(map[string]interface{})
+			}
+			for key, value := range settings {
+				if set, ok := value.(bool); ok {
+					previous, _ := merged[name][key].(bool)
+					merged[name][key] = previous || set
+				} else if _, ok := merged[name][key]; !ok {
+					merged[name][key] = value
+				}
+			}
+		}
+	}
+	out, _ := json.Marshal(merged)
+	return out
+}
+
+// prefixNames prefixes the names of listed tools or prompts with the id of
+// the member listing them.
+func prefixNames(items json.RawMessage, id string) json.RawMessage {
+	var entries []map[string]json.RawMessage
+	if json.Unmarshal(items, &entries) != nil {
+		return items
+	}
+	for _, entry := range entries {
+		var name string
+		if json.Unmarshal(entry["name"], &name) == nil {
+			entry["name"] = quote(id + memberSeparator + name)
+		}
+	}
+	out, err := json.Marshal(entries)
+	if err != nil {
+		return items
+	}
+	return out
+}
+
+// withCursor replaces the cursor of list params, removing it when cursor
+// is empty.
+func withCursor(params json.RawMessage, cursor string) json.RawMessage {
+	fields := make(map[string]json.RawMessage)
+	_ = json.Unmarshal(params, &fields)
+	if fields == nil {
+		fields = make(map[string]json.RawMessage)
+	}
+	delete(fields, "cursor")
+	if cursor != "" {
+		fields["cursor"] = quote(cursor)
+	}
+	out, _ := json.Marshal(fields)
+	return out
+}
+
+// quote encodes s as a JSON string.
+func quote(s string) json.RawMessage {
+	out, _ := json.Marshal(s)
+	return out
+}
@@ -2,193 +2,243 @@ package gateway
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net"
-	"net/http"
-	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/net/websocket"
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/mcp"
+	"mcpgo/backend/services/pinning"
 )
 
-// rawMessage captures both the payload bytes and the frame type so that we can
-// faithfully forward text and binary frames.
-type rawMessage struct {
-	Data        []byte
-	PayloadType byte
-}
-
-var rawCodec = websocket.Codec{
-	Marshal: func(v interface{}) ([]byte, byte, error) {
-		msg, ok := v.(rawMessage)
-		if !ok {
-			return nil, websocket.UnknownFrame, fmt.Errorf("unexpected type %T", v)
-		}
-		return msg.Data, msg.PayloadType, nil
-	},
-	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
-		msg, ok := v.(*rawMessage)
-		if !ok {
-			return fmt.Errorf("unexpected type %T", v)
-		}
-		msg.PayloadType = payloadType
-		msg.Data = append(msg.Data[:0], data...)
-		return nil
-	},
-}
-
-// App encapsulates the MCP gateway logic. It maintains a connection to an
-// upstream MCP server and proxies messages between the client and the upstream
-// service.
+// App encapsulates the MCP gateway logic. It keeps a registry of upstream MCP
+// servers and proxies messages between connected clients and the upstream
+// service they are routed to.
 type App struct {
-	upstreamURL *url.URL
-	baseConfig  *websocket.Config
-	dialTimeout time.Duration
-	logger      *log.Logger
+	mu           sync.RWMutex
+	servers      map[string]*upstream
+	order        []string
+	policies     map[string]config.PolicyConfig
+	drainTimeout time.Duration
+	dialTimeout  time.Duration
+	limiter      *limiter
+	resumeGrace  time.Duration
+	resumeBuffer int
+	reconnect    config.ReconnectConfig
+	agent        config.AgentWSConfig
+	messages     config.MessagesConfig
+	logger       *log.Logger
+
+	// cursorKey signs the pagination cursors of aggregated servers. It is
+	// the configured secret or, without one, randomCursorKey.
+	cursorKey       []byte
+	randomCursorKey []byte
+
+	// shutdownTimeout bounds the drain of a shutdown; stopping is set once
+	// it has begun.
+	shutdownTimeout time.Duration
+	stopping        atomic.Bool
+
+	// sessions holds the resumable sessions by resume token and live every
+	// session that has not been closed; sessionIDs numbers the sessions.
+	sessionsMu sync.Mutex
+	sessions   map[string]*session
+	live       map[*session]struct{}
+	sessionIDs atomic.Int64
+
+	// approvals holds the tool calls awaiting approval.
+	approvals approvals
+
+	// pins holds the approved tool definitions, nil without a lockfile;
+	// pinOnChange is what happens to changed tools by default.
+	pins        *pinning.Store
+	pinOnChange string
 }
 
 // NewApp creates a new gateway app for the provided upstream address. The
 // address must be a valid WebSocket URL.
 func NewApp(upstreamAddress string, logger *log.Logger) (*App, error) {
-	if upstreamAddress == "" {
-		return nil, errors.New("upstream address is required")
-	}
-	parsed, err := url.Parse(upstreamAddress)
-	if err != nil {
-		return nil, fmt.Errorf("invalid upstream address %q: %w", upstreamAddress, err)
-	}
-	if parsed.Scheme != "ws" && parsed.Scheme != "wss" {
-		return nil, fmt.Errorf("unsupported upstream scheme %q", parsed.Scheme)
-	}
+	return NewAppFromConfig(&config.Config{
+		Servers: []config.ServerConfig{{
+			ID:      "default",
+			Name:    "default",
+			Address: upstreamAddress,
+		}},
+	}, logger)
+}
+
+// NewAppFromConfig creates a gateway app serving every upstream server in
+// cfg. The first enabled server is used for clients that do not select a
+// server explicitly.
+func NewAppFromConfig(cfg *config.Config, logger *log.Logger) (*App, error) {
 	if logger == nil {
 		logger = log.Default()
 	}
-
-	originScheme := "http"
-	if parsed.Scheme == "wss" {
-		originScheme = "https"
+	randomCursorKey := make([]byte, 32)
+	if _, err := rand.Read(randomCursorKey); err != nil {
+		return nil, fmt.Errorf("failed to generate the cursor key: %w", err)
 	}
-	origin := fmt.Sprintf("%s://%s", originScheme, parsed.Host)
-	baseConfig, err := websocket.NewConfig(upstreamAddress, origin)
-	if err != nil {
-		return nil, fmt.Errorf("failed to build upstream config: %w", err)
+	app := &App{
+		servers:         make(map[string]*upstream),
+		sessions:        make(map[string]*session),
+		live:            make(map[*session]struct{}),
+		dialTimeout:     10 * time.Second,
+		limiter:         newLimiter(),
+		logger:          logger,
+		randomCursorKey: randomCursorKey,
+	}
+	if err := app.Apply(cfg); err != nil {
+		return nil, err
 	}
-	baseConfig.Protocol = []string{"mcp"}
-	baseConfig.Dialer = &net.Dialer{Timeout: 10 * time.Second}
+	return app, nil
+}
 
-	return &App{
-		upstreamURL: parsed,
-		baseConfig:  baseConfig,
-		dialTimeout: 10 * time.Second,
-		logger:      logger,
-	}, nil
+// HandleConnection proxies the client to the default upstream server.
+func (a *App) HandleConnection(ctx context.Context, clientConn *Conn) error {
+	return a.HandleServerConnection(ctx, "", clientConn)
 }
 
-// HandleConnection establishes a new upstream connection and proxies all MCP
-// traffic between the connected client and the upstream server.
-func (a *App) HandleConnection(ctx context.Context, clientConn *websocket.Conn) error {
+// HandleServerConnection establishes a new connection to the upstream server
+// identified by serverID and proxies all MCP traffic between the connected
+// client and that server. An empty serverID selects the default server.
+func (a *App) HandleServerConnection(ctx context.Context, serverID string, clientConn *Conn) error {
+	return a.StartSession(ctx, serverID, "", clientConn)
+}
+
+// StartSession is HandleServerConnection for a session that the agent can
+// resume with token after its connection drops. An empty token disables
+// resumption for the session.
+func (a *App) StartSession(ctx context.Context, serverID, token string, clientConn *Conn) error {
 	if clientConn == nil {
 		return errors.New("client connection is nil")
 	}
+	if a.stopping.Load() {
+		_ = clientConn.closeWith(closeStatus(ErrShuttingDown))
+		return ErrShuttingDown
+	}
 
-	subproto := "mcp"
-	if cfg := clientConn.Config(); cfg != nil && len(cfg.Protocol) > 0 {
-		if cfg.Protocol[0] != "" {
-			subproto = cfg.Protocol[0]
-		}
+	up, err := a.route(serverID)
+	if err != nil {
+		_ = clientConn.closeWith(closeStatus(err))
+		return err
 	}
 
-	clientAddr := "unknown"
-	if req := clientConn.Request(); req != nil {
-		clientAddr = req.RemoteAddr
+	subproto := clientConn.Subprotocol()
+	if subproto == "" {
+		subproto = "mcp"
 	}
-	a.logger.Printf("Connecting client %s to upstream %s using protocol %s", clientAddr, a.upstreamURL, subproto)
 
-	upstreamConfig := cloneConfig(a.baseConfig)
-	upstreamConfig.Protocol = []string{subproto}
-	upstreamConfig.Header = cloneHeader(a.baseConfig.Header)
-	if upstreamConfig.Dialer == nil {
-		upstreamConfig.Dialer = &net.Dialer{}
+	// A resumable session outlives the request of the connection that
+	// started it.
+	if token != "" {
+		ctx = context.WithoutCancel(ctx)
 	}
-	upstreamConfig.Dialer.Timeout = a.dialTimeout
 
-	upstreamConn, err := upstreamConfig.DialContext(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to connect to upstream %s: %w", a.upstreamURL, err)
+	// Sessions of a stateless server share the pool's connections.
+	if up.config.Stateless {
+		return a.newSession(ctx, up, nil, nil, subproto, token, nil).serve(clientConn)
 	}
-	defer upstreamConn.Close()
-	defer clientConn.Close()
 
-	errCh := make(chan error, 2)
-	var once sync.Once
-	closeBoth := func() {
-		once.Do(func() {
+	// Sessions of an aggregated server connect to every member.
+	if len(up.config.Aggregate) > 0 {
+		agg, err := a.dialAggregate(ctx, up, clientConn.Request(), subproto)
+		if err != nil {
 			_ = clientConn.Close()
-			_ = upstreamConn.Close()
-		})
+			return err
+		}
+		return a.newSession(ctx, up, nil, nil, subproto, token, agg).serve(clientConn)
 	}
 
-	go func() {
-		errCh <- pump("client->upstream", clientConn, upstreamConn)
-	}()
-	go func() {
-		errCh <- pump("upstream->client", upstreamConn, clientConn)
-	}()
-
-	select {
-	case <-ctx.Done():
-		closeBoth()
-		return ctx.Err()
-	case err := <-errCh:
-		closeBoth()
-		if errors.Is(err, io.EOF) {
-			return nil
-		}
-		if errors.Is(err, context.Canceled) {
-			return nil
-		}
+	clientAddr := "unknown"
+	req := clientConn.Request()
+	if req != nil {
+		clientAddr = req.RemoteAddr
+	}
+	ep := up.balancer.pick(up.balancer.callerKey(req))
+	a.logger.Printf("Connecting client %s to upstream %s using protocol %s", clientAddr, ep.url, subproto)
+
+	upstreamConn, err := a.dialUpstream(ctx, up, ep, subproto)
+	if err != nil {
+		_ = clientConn.Close()
 		return err
 	}
+	return a.newSession(ctx, up, ep, upstreamConn, subproto, token, nil).serve(clientConn)
 }
 
-func pump(direction string, src, dst *websocket.Conn) error {
-	for {
-		var msg rawMessage
-		if err := rawCodec.Receive(src, &msg); err != nil {
-			return fmt.Errorf("%s receive: %w", direction, err)
-		}
-		if err := rawCodec.Send(dst, msg); err != nil {
-			return fmt.Errorf("%s send: %w", direction, err)
+// dialUpstream opens a connection to the replica ep of up using the client's
+// subprotocol. The outcome counts towards the replica's outlier ejection.
+func (a *App) dialUpstream(ctx context.Context, up *upstream, ep *endpoint, subproto string) (*Conn, error) {
+	conn, err := dial(ctx, ep.url.String(), ep.origin, subproto, a.dialTimeout, a.messageSettings().MaxUpstreamSize)
+	if err != nil {
+		up.recordFailure(err)
+		if up.balancer.recordFailure(ep) {
+			a.logger.Printf("warning: ejecting replica %s of upstream %s after repeated connection failures", ep.url, up.id)
 		}
+		return nil, fmt.Errorf("failed to connect to upstream %s: %w", ep.url, err)
 	}
+	up.balancer.recordSuccess(ep)
+	return conn, nil
 }
 
-func cloneConfig(cfg *websocket.Config) *websocket.Config {
-	if cfg == nil {
-		return &websocket.Config{}
+// initializeUpstream performs the MCP handshake on conn on behalf of the
+// gateway. params are the initialize request's parameters; nil selects the
+// gateway's own client information.
+func (a *App) initializeUpstream(conn *Conn, params json.RawMessage) (*mcp.InitializeResult, error) {
+	_ = conn.setDeadline(time.Now().Add(a.dialTimeout))
+	defer conn.setDeadline(time.Time{})
+
+	if params == nil {
+		params, _ = json.Marshal(mcp.InitializeParams{
+			ProtocolVersion: mcp.LatestProtocolVersion,
+			Capabilities:    json.RawMessage("{}"),
+			ClientInfo:      mcp.ClientInfo,
+		})
+	}
+	id := json.RawMessage(`"mcpgo-init"`)
+	req, _ := mcp.NewRequest(id, "initialize", params)
+	if err := send(conn, req); err != nil {
+		return nil, err
+	}
+	reply, err := awaitResponse(conn, id)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Error != nil {
+		return nil, reply.Error
+	}
+	var init mcp.InitializeResult
+	if err := json.Unmarshal(reply.Result, &init); err != nil {
+		return nil, err
 	}
-	copyCfg := *cfg
-	copyCfg.Header = cloneHeader(cfg.Header)
-	if cfg.Dialer != nil {
-		dialerCopy := *cfg.Dialer
-		copyCfg.Dialer = &dialerCopy
+	initialized, _ := mcp.NewNotification("notifications/initialized", nil)
+	if err := send(conn, initialized); err != nil {
+		return nil, err
 	}
-	return &copyCfg
+	return &init, nil
 }
 
-func cloneHeader(h http.Header) http.Header {
-	if h == nil {
-		return nil
-	}
-	clone := make(http.Header, len(h))
-	for k, values := range h {
-		vv := make([]string, len(values))
-		copy(vv, values)
-		clone[k] = vv
+// awaitResponse reads from conn until the response to the request id
+// arrives, discarding anything else.
+func awaitResponse(conn *Conn, id json.RawMessage) (*mcp.Message, error) {
+	for {
+		msg, err := conn.receive()
+		if err != nil {
+			return nil, err
+		}
+		var reply mcp.Message
+		if json.Unmarshal(msg.Data, &reply) == nil && reply.IsResponse() && string(reply.ID) == string(id) {
+			return &reply, nil
+		}
 	}
-	return clone
+}
+
+// encodeMessage serialises a JSON-RPC message generated by the gateway
+// itself.
+func encodeMessage(msg *mcp.Message) ([]byte, error) {
+	return json.Marshal(msg)
 }
@@ -0,0 +1,479 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/mcp"
+)
+
+// CodeApprovalDenied is the JSON-RPC error code returned for tool calls
+// held for approval that were rejected or not approved in time. The call
+// never reached the upstream.
+const CodeApprovalDenied = -32004
+
+const (
+	defaultApprovalTimeout = 5 * time.Minute
+	defaultMaxPending      = 100
+)
+
+// ErrApprovalNotFound is returned when deciding a call that is not, or no
+// longer, held for approval.
+var ErrApprovalNotFound = errors.New("approval not found or already decided")
+
+// Types of ApprovalEvent.
+const (
+	ApprovalRequested = "requested"
+	ApprovalApproved  = "approved"
+	ApprovalRejected  = "rejected"
+	// ApprovalExpired reports a call rejected because it was not decided
+	// in time, and ApprovalCancelled one the agent cancelled or left by
+	// closing its session.
+	ApprovalExpired   = "expired"
+	ApprovalCancelled = "cancelled"
+)
+
+// ApprovalInfo describes a tool call held for approval.
+type ApprovalInfo struct {
+	ID      string `json:"id"`
+	Server  string `json:"server"`
+	Session string `json:"session"`
+	// Tool is the server's name of the tool and Arguments the arguments
+	// the call is forwarded with once approved.
+	Tool        string              `json:"tool"`
+	Arguments   json.RawMessage     `json:"arguments,omitempty" swaggertype:"object"`
+	ClientInfo  *mcp.Implementation `json:"clientInfo,omitempty"`
+	RequestedAt time.Time           `json:"requestedAt"`
+	ExpiresAt   time.Time           `json:"expiresAt"`
+}
+
+// ApprovalEvent reports a change to the calls held for approval.
+type ApprovalEvent struct {
+	Type     string       `json:"type"`
+	Approval ApprovalInfo `json:"approval"`
+	// Reason explains a rejection.
+	Reason string `json:"reason,omitempty"`
+}
+
+type approvalDecision struct {
+	approved bool
+	reason   string
+}
+
+// pendingApproval is a held call; its decision is sent on decided.
+type pendingApproval struct {
+	info    ApprovalInfo
+	decided chan approvalDecision
+}
+
+// approvals holds the calls awaiting a decision, by id, and the channels
+// of the watchers of their events; stopped is set once the gateway shut
+// down and closed them.
+type approvals struct {
+	mu       sync.Mutex
+	ids      int64
+	pending  map[string]*pendingApproval
+	watchers map[chan ApprovalEvent]struct{}
+	stopped  bool
+}
+
+// stop closes the watchers' channels.
+func (r *approvals) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = true
+	for watcher := range r.watchers {
+		close(watcher)
+	}
+	r.watchers = nil
+}
+
+// publish sends event to every watcher that has room for it. The caller
+// holds r.mu.
+func (r *approvals) publish(event ApprovalEvent) {
+	for watcher := range r.watchers {
+		select {
+		case watcher <- event:
+		default:
+		}
+	}
+}
+
+// hold registers a call awaiting a decision, reporting false when its
+// server already has limit calls awaiting one.
+func (r *approvals) hold(info ApprovalInfo, limit int) (*pendingApproval, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending == nil {
+		r.pending = make(map[string]*pendingApproval)
+	}
+	held := 0
+	for _, p := range r.pending {
+		if p.info.Server == info.Server {
+			held++
+		}
+	}
+	if held >= limit {
+		return nil, false
+	}
+	r.ids++
+	info.ID = strconv.FormatInt(r.ids, 10)
+	p := &pendingApproval{info: info, decided: make(chan approvalDecision, 1)}
+	r.pending[info.ID] = p
+	r.publish(ApprovalEvent{Type: ApprovalRequested, Approval: info})
+	return p, true
+}
+
+// decide settles the pending approval id, reporting false when it is not
+// pending.
+func (r *approvals) decide(id string, decision approvalDecision) (ApprovalInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.pending[id]
+	if !ok {
+		return ApprovalInfo{}, false
+	}
+	delete(r.pending, id)
+	p.decided <- decision
+	event := ApprovalEvent{Type: ApprovalApproved, Approval: p.info}
+	if !decision.approved {
+		event.Type, event.Reason = ApprovalRejected, decision.reason
+	}
+	r.publish(event)
+	return p.info, true
+}
+
+// withdraw removes p without a decision, reporting false when it was
+// decided first.
+func (r *approvals) withdraw(p *pendingApproval, eventType string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending[p.info.ID] != p {
+		return false
+	}
+	delete(r.pending, p.info.ID)
+	r.publish(ApprovalEvent{Type: eventType, Approval: p.info})
+	return true
+}
+
+// Approvals returns the tool calls held for approval, oldest first.
+func (a *App) Approvals() []ApprovalInfo {
+	a.approvals.mu.Lock()
+	infos := make([]ApprovalInfo, 0, len(a.approvals.pending))
+	for _, p := range a.approvals.pending {
+		infos = append(infos, p.info)
+	}
+	a.approvals.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].RequestedAt.Equal(infos[j].RequestedAt) {
+			return infos[i].RequestedAt.Before(infos[j].RequestedAt)
+		}
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// DecideApproval approves or rejects the held call id. The reason of a
+// rejection is passed on to the agent.
+func (a *App) DecideApproval(id string, approved bool, reason string) (ApprovalInfo, error) {
+	info, ok := a.approvals.decide(id, approvalDecision{approved: approved, reason: reason})
+	if !ok {
+		return ApprovalInfo{}, fmt.Errorf("%w: %s", ErrApprovalNotFound, id)
+	}
+	verdict := "approved"
+	if !approved {
+		verdict = "rejected"
+	}
+	a.logger.Printf("tool call %s on upstream %s %s by an operator", info.Tool, info.Server, verdict)
+	return info, nil
+}
+
+// WatchApprovals returns a channel receiving the approval events until ctx
+// ends or the gateway shuts down, when it is closed. Events are dropped for
+// a watcher that does not keep up.
+func (a *App) WatchApprovals(ctx context.Context) <-chan ApprovalEvent {
+	events := make(chan ApprovalEvent, 64)
+	r := &a.approvals
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		close(events)
+		return events
+	}
+	if r.watchers == nil {
+		r.watchers = make(map[chan ApprovalEvent]struct{})
+	}
+	r.watchers[events] = struct{}{}
+	go func() {
+		<-ctx.Done()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if _, ok := r.watchers[events]; ok {
+			delete(r.watchers, events)
+			close(events)
+		}
+	}()
+	return events
+}
+
+// approvalRequired returns u's approval settings when they select a call
+// of its tool name with arguments.
+func (u *upstream) approvalRequired(name string, arguments json.RawMessage) (config.ApprovalConfig, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	cfg := u.config.Approval
+	if len(cfg.Rules) == 0 {
+		return cfg, false
+	}
+	var fields map[string]json.RawMessage
+	_ = json.Unmarshal(arguments, &fields)
+	values := make(map[string]string, len(fields))
+	for argument, value := range fields {
+		var text string
+		if json.Unmarshal(value, &text) != nil {
+			var compact bytes.Buffer
+			if json.Compact(&compact, value) == nil {
+				value = compact.Bytes()
+			}
+			text = string(value)
+		}
+		values[argument] = text
+	}
+	destructive := u.destructive(name)
+	for _, rule := range cfg.Rules {
+		if rule.Matches(name, destructive, values) {
+			return cfg, true
+		}
+	}
+	return cfg, false
+}
+
+// destructive reports whether the tool name may destroy data: it is not
+// declared read-only and the server does not annotate it as read-only or
+// as not destructive. The caller holds u.mu.
+func (u *upstream) destructive(name string) bool {
+	if u.config.Tools[name].ReadOnly {
+		return false
+	}
+	tool, ok := u.seen[name]
+	if !ok {
+		for _, t := range u.tools {
+			if t.Name == name {
+				tool = t
+				break
+			}
+		}
+	}
+	hints := tool.Annotations
+	if hints == nil {
+		return true
+	}
+	return !(hints.ReadOnlyHint != nil && *hints.ReadOnlyHint) && (hints.DestructiveHint == nil || *hints.DestructiveHint)
+}
+
+// awaitApproval holds a call of the tool name of up until it is decided,
+// returning nil once it is approved and otherwise the error answering it:
+// when it is rejected, not decided within the timeout or ctx ends first,
+// or when too many calls of up await a decision already.
+func (s *session) awaitApproval(ctx context.Context, up *upstream, cfg config.ApprovalConfig, name string, arguments json.RawMessage) *mcp.Message {
+	timeout := cfg.Timeout.Duration
+	if timeout <= 0 {
+		timeout = defaultApprovalTimeout
+	}
+	now := time.Now()
+	info := ApprovalInfo{
+		Server:      up.id,
+		Session:     s.id,
+		Tool:        name,
+		Arguments:   arguments,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(timeout),
+	}
+	s.versions.mu.Lock()
+	info.ClientInfo = s.versions.client
+	s.versions.mu.Unlock()
+	limit := cfg.MaxPending
+	if limit <= 0 {
+		limit = defaultMaxPending
+	}
+	p, ok := s.app.approvals.hold(info, limit)
+	if !ok {
+		s.app.logger.Printf("warning: refusing tool call %s on upstream %s: %d calls await approval already", name, up.id, limit)
+		return mcp.NewError(nil, CodeLimitExceeded, fmt.Sprintf("too many tool calls awaiting approval on %s", up.id))
+	}
+	s.app.logger.Printf("tool call %s on upstream %s held for approval %s", name, up.id, p.info.ID)
+
+	var elicitation string
+	if cfg.Elicit {
+		elicitation = s.elicitApproval(p)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var decision approvalDecision
+	select {
+	case decision = <-p.decided:
+	case <-timer.C:
+		if s.app.approvals.withdraw(p, ApprovalExpired) {
+			s.cancelElicitation(elicitation, "the approval timed out")
+			return mcp.NewError(nil, CodeApprovalDenied, fmt.Sprintf("tool call %q was not approved within %s", name, timeout))
+		}
+		decision = <-p.decided
+	case <-ctx.Done():
+		if s.app.approvals.withdraw(p, ApprovalCancelled) {
+			s.cancelElicitation(elicitation, "the call was cancelled")
+			return mcp.NewError(nil, CodeApprovalDenied, fmt.Sprintf("tool call %q was cancelled", name))
+		}
+		decision = <-p.decided
+	}
+	s.cancelElicitation(elicitation, "the call was decided")
+	if decision.approved {
+		return nil
+	}
+	message := fmt.Sprintf("tool call %q was rejected", name)
+	if decision.reason != "" {
+		message += ": " + decision.reason
+	}
+	return mcp.NewError(nil, CodeApprovalDenied, message)
+}
+
+// elicitApproval asks the agent's user to approve p with an elicitation
+// request, returning its id, or "" when the agent does not support
+// elicitation. Accepting approves the call and declining rejects it; a
+// request the agent fails leaves the decision to an operator.
+func (s *session) elicitApproval(p *pendingApproval) string {
+	if s.agentRevision() < revisionStructured || !s.agentHas("elicitation") {
+		return ""
+	}
+	id := s.registerServerRequest(serverRequest{
+		method: "elicitation/create",
+		reply: func(answer *mcp.Message) {
+			var result struct {
+				Action string `json:"action"`
+			}
+			if answer.Error != nil || json.Unmarshal(answer.Result, &result) != nil {
+				return
+			}
+			approved := result.Action == "accept"
+			if _, ok := s.app.approvals.decide(p.info.ID, approvalDecision{approved: approved, reason: "declined by the user"}); ok {
+				s.app.logger.Printf("tool call %s on upstream %s %sed by the agent's user", p.info.Tool, p.info.Server, result.Action)
+			}
+		},
+	})
+	arguments := string(p.info.Arguments)
+	if arguments == "" {
+		arguments = "{}"
+	}
+	req, err := mcp.NewRequest(json.RawMessage(id), "elicitation/create", map[string]interface{}{
+		"message":         fmt.Sprintf("Allow the tool %s of %s to run with the arguments %s?", p.info.Tool, p.info.Server, arguments),
+		"requestedSchema": map[string]interface{}{"type": "object", "properties": map[string]interface{}{}},
+	})
+	if err != nil {
+		return ""
+	}
+	_ = s.deliverMessage(req)
+	return id
+}
+
+// cancelElicitation withdraws the elicitation request id from the agent
+// when it is still unanswered.
+func (s *session) cancelElicitation(id, reason string) {
+	if id == "" {
+		return
+	}
+	s.callsMu.Lock()
+	_, ok := s.serverRequests[id]
+	delete(s.serverRequests, id)
+	s.callsMu.Unlock()
+	if !ok {
+		return
+	}
+	cancelled, err := mcp.NewNotification("notifications/cancelled", map[string]interface{}{
+		"requestId": json.RawMessage(id),
+		"reason":    reason,
+	})
+	if err == nil {
+		_ = s.deliverMessage(cancelled)
+	}
+}
+
+// holdForApproval holds the agent's tools/call until it is decided when
+// the server's approval rules select it or the tool is quarantined,
+// reporting whether it was held.
+// An approved call continues to the upstream and any other is answered
+// with an error. The agent's cancellation of a held call ends the wait
+// and is not forwarded, since the upstream never saw the call.
+func (s *session) holdForApproval(clientConn *Conn, msg *rawMessage) bool {
+	env, ok := peekEnvelope(msg)
+	if !ok {
+		return false
+	}
+	if env.Method == "notifications/cancelled" {
+		var body struct {
+			Params struct {
+				RequestID json.RawMessage `json:"requestId"`
+			} `json:"params"`
+		}
+		if json.Unmarshal(msg.Data, &body) != nil {
+			return false
+		}
+		s.callsMu.Lock()
+		cancel, ok := s.held[string(body.Params.RequestID)]
+		s.callsMu.Unlock()
+		if ok {
+			cancel()
+		}
+		return ok
+	}
+	if env.Method != "tools/call" || len(env.ID) == 0 {
+		return false
+	}
+	var body struct {
+		Params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		} `json:"params"`
+	}
+	if json.Unmarshal(msg.Data, &body) != nil {
+		return false
+	}
+	cfg, ok := s.approvalFor(s.up, body.Params.Name, body.Params.Arguments)
+	if !ok {
+		return false
+	}
+
+	id := string(env.ID)
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.callsMu.Lock()
+	if s.held == nil {
+		s.held = make(map[string]context.CancelFunc)
+	}
+	s.held[id] = cancel
+	s.callsMu.Unlock()
+	held := *msg
+	go func() {
+		defer cancel()
+		refusal := s.awaitApproval(ctx, s.up, cfg, body.Params.Name, body.Params.Arguments)
+		s.callsMu.Lock()
+		delete(s.held, id)
+		if refusal != nil {
+			delete(s.outputs, id)
+		}
+		s.callsMu.Unlock()
+		switch {
+		case refusal == nil:
+			s.forwardClient(clientConn, held)
+		case ctx.Err() == nil:
+			refusal.ID = env.ID
+			_ = s.deliverMessage(refusal)
+		}
+	}()
+	return true
+}
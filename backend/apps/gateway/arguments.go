@@ -0,0 +1,185 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"text/template"
+
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/mcp"
+)
+
+// argumentContext is what the templates of argument settings draw on. The
+// gateway does not authenticate agents, so the headers and client info are
+// what the agent sent.
+type argumentContext struct {
+	Session struct {
+		ID     string
+		Server string
+	}
+	Client     mcp.Implementation
+	RemoteAddr string
+	header     http.Header
+}
+
+// Header returns the value of a header of the agent's connection request,
+// which the agent controls unless a proxy in front of the gateway sets it.
+func (c argumentContext) Header(name string) string {
+	return c.header.Get(name)
+}
+
+func (s *session) argumentContext() argumentContext {
+	var c argumentContext
+	c.Session.ID, c.Session.Server = s.id, s.up.id
+	if req := s.caller.Load(); req != nil {
+		c.RemoteAddr, c.header = req.RemoteAddr, req.Header
+	}
+	s.versions.mu.Lock()
+	if client := s.versions.client; client != nil {
+		c.Client = *client
+	}
+	s.versions.mu.Unlock()
+	return c
+}
+
+func (u *upstream) toolArguments(name string) map[string]config.ArgumentConfig {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.config.Tools[name].Arguments
+}
+
+// transformArguments applies argument settings to the params of a
+// tools/call: defaults fill unset arguments, values replace what the agent
+// set and hidden arguments the agent set are dropped.
+func (s *session) transformArguments(settings map[string]config.ArgumentConfig, params json.RawMessage) (json.RawMessage, error) {
+	if len(settings) == 0 {
+		return params, nil
+	}
+	var fields struct {
+		Arguments map[string]json.RawMessage `json:"arguments"`
+	}
+	_ = json.Unmarshal(params, &fields)
+	arguments := fields.Arguments
+	if arguments == nil {
+		arguments = make(map[string]json.RawMessage)
+	}
+	c := s.argumentContext()
+	for name, setting := range settings {
+		_, set := arguments[name]
+		value := setting.Value
+		switch {
+		case value != nil:
+		case setting.Default != nil && !set:
+			value = setting.Default
+		case setting.Hidden:
+			delete(arguments, name)
+			continue
+		default:
+			continue
+		}
+		data, err := renderArgument(value, c)
+		if err != nil {
+			return nil, fmt.Errorf("argument %s: %w", name, err)
+		}
+		arguments[name] = data
+	}
+	data, err := json.Marshal(arguments)
+	if err != nil {
+		return nil, err
+	}
+	return setParam(params, "arguments", data), nil
+}
+
+// renderArgument encodes a configured argument value, executing it as a
+// template when it is a string.
+func renderArgument(value interface{}, c argumentContext) (json.RawMessage, error) {
+	text, ok := value.(string)
+	if !ok || !strings.Contains(text, "{{") {
+		return json.Marshal(value)
+	}
+	tmpl, err := template.New("argument").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, c); err != nil {
+		return nil, err
+	}
+	return json.Marshal(b.String())
+}
+
+// applyArguments applies the argument settings of the called tool to the
+// agent's tools/call, reporting whether the call was answered with an
+// error instead because a value could not be computed.
+func (s *session) applyArguments(msg *rawMessage) bool {
+	env, ok := peekEnvelope(msg)
+	if !ok || env.Method != "tools/call" || len(env.ID) == 0 {
+		return false
+	}
+	var body struct {
+		Params json.RawMessage `json:"params"`
+	}
+	if json.Unmarshal(msg.Data, &body) != nil {
+		return false
+	}
+	var params struct {
+		Name string `json:"name"`
+	}
+	_ = json.Unmarshal(body.Params, &params)
+	settings := s.up.toolArguments(params.Name)
+	if len(settings) == 0 {
+		return false
+	}
+	transformed, err := s.transformArguments(settings, body.Params)
+	if err != nil {
+		_ = s.deliverMessage(mcp.NewError(env.ID, mcp.CodeInternalError, fmt.Sprintf("cannot call tool %q: %v", params.Name, err)))
+		return true
+	}
+	rewriteParams(msg, func(json.RawMessage) json.RawMessage {
+		return transformed
+	})
+	return false
+}
+
+// argumentSchema adjusts a tool's inputSchema to its argument settings:
+// hidden arguments are removed, defaults advertised, and arguments the
+// gateway supplies are no longer required.
+func argumentSchema(schema json.RawMessage, settings map[string]config.ArgumentConfig) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(schema, &fields) != nil || fields == nil {
+		return schema
+	}
+	var properties map[string]json.RawMessage
+	_ = json.Unmarshal(fields["properties"], &properties)
+	var required []string
+	_ = json.Unmarshal(fields["required"], &required)
+	for name, setting := range settings {
+		switch {
+		case setting.Hidden:
+			delete(properties, name)
+		case setting.Default != nil:
+			if text, ok := setting.Default.(string); !ok || !strings.Contains(text, "{{") {
+				if value, err := json.Marshal(setting.Default); err == nil && properties[name] != nil {
+					properties[name] = setParam(properties[name], "default", value)
+				}
+			}
+		case setting.Value == nil:
+			continue
+		}
+		required = slices.DeleteFunc(required, func(r string) bool { return r == name })
+	}
+	if properties != nil {
+		fields["properties"], _ = json.Marshal(properties)
+	}
+	if _, ok := fields["required"]; ok {
+		fields["required"], _ = json.Marshal(required)
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return schema
+	}
+	return out
+}
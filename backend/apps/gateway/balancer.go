@@ -0,0 +1,251 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mcpgo/backend/services/config"
+)
+
+const (
+	defaultEjectionFailures = 5
+	defaultEjectionDuration = 30 * time.Second
+)
+
+// endpoint is one replica of an upstream server.
+type endpoint struct {
+	url    *url.URL
+	origin string
+	weight int
+
+	// active counts the sessions, or for a stateless server the pooled
+	// connections, currently using the replica.
+	active atomic.Int64
+
+	// The fields below are guarded by the balancer's mutex.
+	current      int
+	failures     int
+	ejectedUntil time.Time
+}
+
+func newEndpoint(cfg config.EndpointConfig) (*endpoint, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("upstream address is required")
+	}
+	parsed, err := url.Parse(cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream address %q: %w", cfg.Address, err)
+	}
+	if parsed.Scheme != "ws" && parsed.Scheme != "wss" {
+		return nil, fmt.Errorf("unsupported upstream scheme %q", parsed.Scheme)
+	}
+
+	originScheme := "http"
+	if parsed.Scheme == "wss" {
+		originScheme = "https"
+	}
+	origin := fmt.Sprintf("%s://%s", originScheme, parsed.Host)
+
+	weight := cfg.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	return &endpoint{url: parsed, origin: origin, weight: weight}, nil
+}
+
+// balancer chooses the replica of an upstream that a new session, or a new
+// pooled connection, is opened to. Replicas whose connection attempts keep
+// failing are ejected from rotation for a while.
+type balancer struct {
+	strategy   string
+	hashHeader string
+	ejectAfter int
+	ejectFor   time.Duration
+	endpoints  []*endpoint
+
+	mu sync.Mutex
+}
+
+func newBalancer(cfg config.ServerConfig) (*balancer, error) {
+	b := &balancer{
+		strategy:   cfg.Balancing.Strategy,
+		hashHeader: cfg.Balancing.HashHeader,
+		ejectAfter: cfg.Balancing.Ejection.ConsecutiveFailures,
+		ejectFor:   cfg.Balancing.Ejection.Duration.Duration,
+	}
+	if b.strategy == "" {
+		b.strategy = "round-robin"
+	}
+	if !slices.Contains(config.SupportedBalancingStrategies, b.strategy) {
+		return nil, fmt.Errorf("unsupported balancing strategy %q", b.strategy)
+	}
+	if b.ejectAfter <= 0 {
+		b.ejectAfter = defaultEjectionFailures
+	}
+	if b.ejectFor <= 0 {
+		b.ejectFor = defaultEjectionDuration
+	}
+	for _, endpointCfg := range cfg.ReplicaEndpoints() {
+		ep, err := newEndpoint(endpointCfg)
+		if err != nil {
+			return nil, err
+		}
+		b.endpoints = append(b.endpoints, ep)
+	}
+	return b, nil
+}
+
+// callerKey identifies the agent behind req for consistent hashing.
+func (b *balancer) callerKey(req *http.Request) string {
+	if b.strategy != "consistent-hash" || req == nil {
+		return ""
+	}
+	if b.hashHeader != "" {
+		if value := req.Header.Get(b.hashHeader); value != "" {
+			return value
+		}
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// pick chooses a replica. key identifies the caller for consistent
+// hashing and is ignored by the other strategies.
+func (b *balancer) pick(key string) *endpoint {
+	if len(b.endpoints) == 1 {
+		return b.endpoints[0]
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	candidates := b.available(time.Now())
+	switch b.strategy {
+	case "least-connections":
+		var best *endpoint
+		var bestLoad float64
+		for _, ep := range candidates {
+			load := float64(ep.active.Load()) / float64(ep.weight)
+			if best == nil || load < bestLoad {
+				best, bestLoad = ep, load
+			}
+		}
+		return best
+	case "consistent-hash":
+		// Weighted rendezvous hashing: a caller keeps its replica as long
+		// as that replica is available, and only the callers of a removed
+		// replica move.
+		var best *endpoint
+		var bestScore float64
+		for _, ep := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			h.Write([]byte{0})
+			h.Write([]byte(ep.url.String()))
+			unit := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+			score := float64(ep.weight) / -math.Log(unit)
+			if best == nil || score > bestScore {
+				best, bestScore = ep, score
+			}
+		}
+		return best
+	default:
+		// Smooth weighted round-robin.
+		var best *endpoint
+		total := 0
+		for _, ep := range candidates {
+			ep.current += ep.weight
+			total += ep.weight
+			if best == nil || ep.current > best.current {
+				best = ep
+			}
+		}
+		best.current -= total
+		return best
+	}
+}
+
+// available returns the replicas that are not ejected, or every replica
+// when all of them are. The caller holds b.mu.
+func (b *balancer) available(now time.Time) []*endpoint {
+	candidates := make([]*endpoint, 0, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		if !now.Before(ep.ejectedUntil) {
+			candidates = append(candidates, ep)
+		}
+	}
+	if len(candidates) == 0 {
+		return b.endpoints
+	}
+	return candidates
+}
+
+// others returns the available replicas other than ep.
+func (b *balancer) others(ep *endpoint) []*endpoint {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var others []*endpoint
+	for _, candidate := range b.available(time.Now()) {
+		if candidate != ep {
+			others = append(others, candidate)
+		}
+	}
+	return others
+}
+
+// recordFailure counts a failed connection attempt to ep and reports
+// whether it got ejected as a result.
+func (b *balancer) recordFailure(ep *endpoint) bool {
+	if len(b.endpoints) == 1 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ep.failures++
+	if ep.failures < b.ejectAfter {
+		return false
+	}
+	ep.failures = 0
+	ep.ejectedUntil = time.Now().Add(b.ejectFor)
+	return true
+}
+
+func (b *balancer) recordSuccess(ep *endpoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ep.failures = 0
+}
+
+// EndpointInfo is a point-in-time snapshot of one replica of a server.
+type EndpointInfo struct {
+	Address        string `json:"address"`
+	Weight         int    `json:"weight"`
+	ActiveSessions int64  `json:"activeSessions"`
+	Ejected        bool   `json:"ejected,omitempty"`
+}
+
+func (b *balancer) info() []EndpointInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	infos := make([]EndpointInfo, 0, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		infos = append(infos, EndpointInfo{
+			Address:        ep.url.String(),
+			Weight:         ep.weight,
+			ActiveSessions: ep.active.Load(),
+			Ejected:        now.Before(ep.ejectedUntil),
+		})
+	}
+	return infos
+}
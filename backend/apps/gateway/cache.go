@@ -0,0 +1,347 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"mcpgo/backend/services/mcp"
+)
+
+const (
+	defaultCacheListTTL    = 5 * time.Minute
+	defaultCacheMaxEntries = 1000
+)
+
+// listChanged maps the list_changed notifications to the list methods whose
+// cached results they invalidate.
+var listChanged = map[string][]string{
+	"notifications/tools/list_changed":     {"tools/list"},
+	"notifications/resources/list_changed": {"resources/list", "resources/templates/list"},
+	"notifications/prompts/list_changed":   {"prompts/list"},
+}
+
+// CacheStats describes how the response cache of an upstream server has
+// been used since the server was added or last replaced.
+type CacheStats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	// Invalidations counts the entries dropped because the server reported
+	// a change, and Evictions those dropped to make room.
+	Invalidations uint64                      `json:"invalidations"`
+	Evictions     uint64                      `json:"evictions"`
+	Methods       map[string]CacheMethodStats `json:"methods,omitempty"`
+}
+
+// CacheMethodStats counts the cache lookups for a single method.
+type CacheMethodStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// cacheRequest is a request whose response may be cached.
+type cacheRequest struct {
+	key    string
+	method string
+	uri    string
+	ttl    time.Duration
+}
+
+type cacheEntry struct {
+	method  string
+	uri     string
+	result  json.RawMessage
+	expires time.Time
+}
+
+// responseCache holds the cached responses of an upstream server.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	stats   CacheStats
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		entries: make(map[string]*cacheEntry),
+		stats:   CacheStats{Methods: make(map[string]CacheMethodStats)},
+	}
+}
+
+// get returns the cached result for req, counting the lookup.
+func (c *responseCache) get(req cacheRequest) (json.RawMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[req.key]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, req.key)
+		ok = false
+	}
+	counts := c.stats.Methods[req.method]
+	if ok {
+		c.stats.Hits++
+		counts.Hits++
+	} else {
+		c.stats.Misses++
+		counts.Misses++
+	}
+	c.stats.Methods[req.method] = counts
+	if !ok {
+		return nil, false
+	}
+	return entry.result, true
+}
+
+// put caches result for req, evicting expired entries, or an arbitrary one,
+// when the cache holds maxEntries.
+func (c *responseCache) put(req cacheRequest, result json.RawMessage, maxEntries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[req.key]; !ok && len(c.entries) >= maxEntries {
+		now := time.Now()
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		for key := range c.entries {
+			if len(c.entries) < maxEntries {
+				break
+			}
+			delete(c.entries, key)
+			c.stats.Evictions++
+		}
+	}
+	c.entries[req.key] = &cacheEntry{
+		method:  req.method,
+		uri:     req.uri,
+		result:  result,
+		expires: time.Now().Add(req.ttl),
+	}
+}
+
+// invalidate drops the entries for which match reports true.
+func (c *responseCache) invalidate(match func(*cacheEntry) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if match(entry) {
+			delete(c.entries, key)
+			c.stats.Invalidations++
+		}
+	}
+}
+
+func (c *responseCache) snapshot() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Methods = make(map[string]CacheMethodStats, len(c.stats.Methods))
+	for method, counts := range c.stats.Methods {
+		stats.Methods[method] = counts
+	}
+	return stats
+}
+
+// cachePolicy resolves how the response to a request for method with params
+// is cached for the caller identified by scope. It reports false when the
+// response is not cached.
+func (u *upstream) cachePolicy(scope, method string, params json.RawMessage) (cacheRequest, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	cfg := u.config.Cache
+	if cfg.Disabled {
+		return cacheRequest{}, false
+	}
+	var p struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+		URI       string          `json:"uri"`
+		Cursor    string          `json:"cursor"`
+	}
+	if len(params) > 0 && json.Unmarshal(params, &p) != nil {
+		return cacheRequest{}, false
+	}
+
+	req := cacheRequest{method: method}
+	var arg string
+	switch method {
+	case "tools/list", "resources/list", "resources/templates/list", "prompts/list":
+		req.ttl = cfg.ListTTL.Duration
+		if req.ttl == 0 {
+			req.ttl = defaultCacheListTTL
+		}
+		arg = p.Cursor
+	case "resources/read":
+		req.ttl, req.uri, arg = cfg.ResourceTTL.Duration, p.URI, p.URI
+	case "tools/call":
+		if readOnly, idempotent := u.toolHints(p.Name); !readOnly && !idempotent {
+			return cacheRequest{}, false
+		}
+		req.ttl = cfg.ToolTTL.Duration
+		if ttl := u.config.Tools[p.Name].CacheTTL.Duration; ttl > 0 {
+			req.ttl = ttl
+		}
+		arg = p.Name + "\x00" + canonicalJSON(p.Arguments)
+	default:
+		return cacheRequest{}, false
+	}
+	if req.ttl <= 0 {
+		return cacheRequest{}, false
+	}
+	req.key = scope + "\x00" + method + "\x00" + arg
+	return req, true
+}
+
+func (u *upstream) cacheMaxEntries() int {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if n := u.config.Cache.MaxEntries; n > 0 {
+		return n
+	}
+	return defaultCacheMaxEntries
+}
+
+func (u *upstream) cacheScopeHeader() string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.config.Cache.ScopeHeader
+}
+
+// invalidateCache drops the cached responses, and the tool definitions
+// learned, that a notification from the upstream reports as changed.
+func (u *upstream) invalidateCache(msg *rawMessage) {
+	env, ok := peekEnvelope(msg)
+	if !ok || len(env.ID) > 0 {
+		return
+	}
+	if env.Method == "notifications/tools/list_changed" {
+		u.mu.Lock()
+		u.seen = nil
+		u.mu.Unlock()
+	}
+	if methods, ok := listChanged[env.Method]; ok {
+		u.cache.invalidate(func(entry *cacheEntry) bool {
+			for _, method := range methods {
+				if entry.method == method {
+					return true
+				}
+			}
+			return false
+		})
+		return
+	}
+	if env.Method != "notifications/resources/updated" {
+		return
+	}
+	var body struct {
+		Params struct {
+			URI string `json:"uri"`
+		} `json:"params"`
+	}
+	if json.Unmarshal(msg.Data, &body) != nil {
+		return
+	}
+	u.cache.invalidate(func(entry *cacheEntry) bool {
+		return entry.method == "resources/read" && entry.uri == body.Params.URI
+	})
+}
+
+// canonicalJSON re-encodes data with sorted object keys, so that equal
+// arguments produce equal cache keys.
+func canonicalJSON(data json.RawMessage) string {
+	var v interface{}
+	if json.Unmarshal(data, &v) != nil {
+		return string(data)
+	}
+	out, _ := json.Marshal(v)
+	return string(out)
+}
+
+// cacheScope identifies the caller of the session for caching: the agent's
+// protocol version and capabilities and the value of the server's scope
+// header on the agent's request.
+func (s *session) cacheScope(clientConn *Conn) string {
+	initialize, _, _ := s.handshake.snapshot()
+	var params struct {
+		ProtocolVersion string          `json:"protocolVersion"`
+		Capabilities    json.RawMessage `json:"capabilities"`
+	}
+	_ = json.Unmarshal(initialize, &params)
+	h := sha256.New()
+	h.Write([]byte(params.ProtocolVersion + "\x00" + canonicalJSON(params.Capabilities) + "\x00"))
+	if header := s.up.cacheScopeHeader(); header != "" && clientConn.Request() != nil {
+		h.Write([]byte(clientConn.Request().Header.Get(header)))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// answerFromCache answers the agent's request from the cache, reporting
+// whether it did. On a miss the request is remembered so that its response
+// can be cached.
+func (s *session) answerFromCache(clientConn *Conn, msg *rawMessage) bool {
+	env, ok := peekEnvelope(msg)
+	if !ok || env.Method == "" || len(env.ID) == 0 {
+		return false
+	}
+	// A request reusing the id of an unanswered one replaces it.
+	s.callsMu.Lock()
+	delete(s.cacheable, string(env.ID))
+	s.callsMu.Unlock()
+
+	var body struct {
+		Params json.RawMessage `json:"params"`
+	}
+	if json.Unmarshal(msg.Data, &body) != nil {
+		return false
+	}
+	req, ok := s.up.cachePolicy(s.cacheScope(clientConn), env.Method, body.Params)
+	if !ok {
+		return false
+	}
+	if result, ok := s.up.cache.get(req); ok {
+		reply, err := mcp.NewResult(env.ID, result)
+		if err == nil && s.deliverMessage(reply) == nil {
+			return true
+		}
+	}
+
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	if s.cacheable == nil {
+		s.cacheable = make(map[string]cacheRequest)
+	}
+	s.cacheable[string(env.ID)] = req
+	return false
+}
+
+// cacheReply caches the response to a request answerFromCache missed,
+// unless it is an error.
+func (s *session) cacheReply(msg *rawMessage) {
+	env, ok := peekEnvelope(msg)
+	if !ok || env.Method != "" || len(env.ID) == 0 {
+		return
+	}
+	s.callsMu.Lock()
+	req, ok := s.cacheable[string(env.ID)]
+	delete(s.cacheable, string(env.ID))
+	s.callsMu.Unlock()
+	if !ok {
+		return
+	}
+	var reply mcp.Message
+	if json.Unmarshal(msg.Data, &reply) != nil || reply.Error != nil || len(reply.Result) == 0 {
+		return
+	}
+	if req.method == "tools/call" {
+		var result mcp.CallToolResult
+		if json.Unmarshal(reply.Result, &result) != nil || result.IsError {
+			return
+		}
+	}
+	s.up.cache.put(req, reply.Result, s.up.cacheMaxEntries())
+}
@@ -0,0 +1,259 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/mcp"
+)
+
+// catalogKeys maps the methods concerning catalog items to the field that
+// identifies the item: in the list results for list methods, in the params
+// otherwise.
+var catalogKeys = map[string]string{
+	"tools/list":               "name",
+	"prompts/list":             "name",
+	"resources/list":           "uri",
+	"resources/templates/list": "uriTemplate",
+	"tools/call":               "name",
+	"prompts/get":              "name",
+	"resources/read":           "uri",
+	"resources/subscribe":      "uri",
+	"resources/unsubscribe":    "uri",
+}
+
+// catalog is what a server exposes to agents: its expose filters and the
+// renames and overrides of its tools.
+type catalog struct {
+	expose config.ExposeConfig
+	tools  map[string]config.ToolConfig
+}
+
+func (u *upstream) catalog() catalog {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return catalog{expose: u.config.Expose, tools: u.config.Tools}
+}
+
+// rewrites reports whether the catalog changes what agents see of the
+// server.
+func (c catalog) rewrites() bool {
+	if !reflect.DeepEqual(c.expose, config.ExposeConfig{}) {
+		return true
+	}
+	for _, tool := range c.tools {
+		if tool.Rename != "" || tool.Description != "" || len(tool.InputSchema) > 0 || len(tool.Arguments) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the expose filter for the items method concerns. Tools
+// are resolved with toolName, which also accounts for renames.
+func (c catalog) filter(method string) config.FilterConfig {
+	switch method {
+	case "tools/list", "tools/call":
+		return c.expose.Tools
+	case "prompts/list", "prompts/get":
+		return c.expose.Prompts
+	}
+	return c.expose.Resources
+}
+
+// toolName resolves the name an agent calls a tool by to the server's name
+// for it, reporting false for a tool the catalog hides. A renamed tool is
+// hidden under its own name.
+func (c catalog) toolName(exposed string) (string, bool) {
+	for name, tool := range c.tools {
+		if tool.Rename == exposed {
+			return name, c.expose.Tools.Allows(name)
+		}
+	}
+	if c.tools[exposed].Rename != "" {
+		return "", false
+	}
+	return exposed, c.expose.Tools.Allows(exposed)
+}
+
+// list applies the catalog to the items of a result of the list method:
+// hidden items are removed and tools renamed and overridden.
+func (c catalog) list(method string, items json.RawMessage) json.RawMessage {
+	var entries []map[string]json.RawMessage
+	if json.Unmarshal(items, &entries) != nil {
+		return items
+	}
+	filter, key := c.filter(method), catalogKeys[method]
+	kept := make([]map[string]json.RawMessage, 0, len(entries))
+	for _, entry := range entries {
+		var name string
+		_ = json.Unmarshal(entry[key], &name)
+		if !filter.Allows(name) {
+			continue
+		}
+		if tool, ok := c.tools[name]; ok && method == "tools/list" {
+			overrideTool(entry, tool)
+		}
+		kept = append(kept, entry)
+	}
+	out, err := json.Marshal(kept)
+	if err != nil {
+		return items
+	}
+	return out
+}
+
+// overrideTool applies a tool's rename, description, input schema and
+// argument settings to its definition.
+func overrideTool(tool map[string]json.RawMessage, cfg config.ToolConfig) {
+	if cfg.Rename != "" {
+		tool["name"] = quote(cfg.Rename)
+	}
+	if cfg.Description != "" {
+		tool["description"] = quote(cfg.Description)
+	}
+	if len(cfg.InputSchema) > 0 {
+		if patch, err := json.Marshal(cfg.InputSchema); err == nil {
+			tool["inputSchema"] = mergePatch(tool["inputSchema"], patch)
+		}
+	}
+	if len(cfg.Arguments) > 0 && len(tool["inputSchema"]) > 0 {
+		tool["inputSchema"] = argumentSchema(tool["inputSchema"], cfg.Arguments)
+	}
+}
+
+// mergePatch applies the JSON merge patch patch to target (RFC 7386).
+func mergePatch(target, patch json.RawMessage) json.RawMessage {
+	var changes map[string]json.RawMessage
+	if json.Unmarshal(patch, &changes) != nil || changes == nil {
+		return patch
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(target, &fields) != nil || fields == nil {
+		fields = make(map[string]json.RawMessage)
+	}
+	for key, value := range changes {
+		if bytes.Equal(bytes.TrimSpace(value), []byte("null")) {
+			delete(fields, key)
+			continue
+		}
+		fields[key] = mergePatch(fields[key], value)
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return target
+	}
+	return out
+}
+
+// screenCatalog applies the server's catalog to a request of the agent,
+// reporting whether it was answered. Requests for tools, prompts and
+// resources the catalog hides are refused, the names of renamed tools are
+// replaced by the server's and list requests are remembered, so that
+// their results can be filtered.
+func (s *session) screenCatalog(msg *rawMessage) bool {
+	env, ok := peekEnvelope(msg)
+	if !ok || env.Method == "" || len(env.ID) == 0 {
+		return false
+	}
+	key, ok := catalogKeys[env.Method]
+	if !ok {
+		return false
+	}
+	c := s.up.catalog()
+	if _, isList := listKinds[env.Method]; isList {
+		// Tool lists are also recorded for validating calls.
+		if c.rewrites() || env.Method == "tools/list" {
+			s.callsMu.Lock()
+			if s.listed == nil {
+				s.listed = make(map[string]string)
+			}
+			s.listed[string(env.ID)] = env.Method
+			s.callsMu.Unlock()
+		}
+		return false
+	}
+	if !c.rewrites() {
+		return false
+	}
+
+	var body struct {
+		Params map[string]json.RawMessage `json:"params"`
+	}
+	if json.Unmarshal(msg.Data, &body) != nil {
+		return false
+	}
+	var name string
+	_ = json.Unmarshal(body.Params[key], &name)
+	allowed := c.filter(env.Method).Allows(name)
+	if env.Method == "tools/call" {
+		var upstreamName string
+		if upstreamName, allowed = c.toolName(name); allowed && upstreamName != name {
+			rewriteParams(msg, func(params json.RawMessage) json.RawMessage {
+				return setParam(params, "name", quote(upstreamName))
+			})
+		}
+	}
+	if allowed {
+		return false
+	}
+	_ = s.deliverMessage(mcp.NewError(env.ID, mcp.CodeInvalidParams, fmt.Sprintf("unknown %s %q", catalogItem(env.Method), name)))
+	return true
+}
+
+// filterCatalog applies the server's catalog to the result of a list
+// request screenCatalog remembered, checking the tools of tool lists
+// against their pins and learning them. The tools of an aggregated server
+// are pinned and learned by its members, under their own names.
+func (s *session) filterCatalog(msg rawMessage) rawMessage {
+	s.callsMu.Lock()
+	pending := len(s.listed) > 0
+	s.callsMu.Unlock()
+	if !pending {
+		return msg
+	}
+	env, ok := peekEnvelope(&msg)
+	if !ok || env.Method != "" || len(env.ID) == 0 {
+		return msg
+	}
+	s.callsMu.Lock()
+	method, ok := s.listed[string(env.ID)]
+	delete(s.listed, string(env.ID))
+	s.callsMu.Unlock()
+	if !ok {
+		return msg
+	}
+	var reply map[string]json.RawMessage
+	var result map[string]json.RawMessage
+	if json.Unmarshal(msg.Data, &reply) != nil || json.Unmarshal(reply["result"], &result) != nil || result == nil {
+		return msg
+	}
+	field := listKinds[method].field
+	if method == "tools/list" && s.agg == nil {
+		result[field] = s.app.pinTools(s.up, result[field])
+		s.up.learnTools(result[field])
+	}
+	if c := s.up.catalog(); c.rewrites() {
+		result[field] = c.list(method, result[field])
+	}
+	reply["result"], _ = json.Marshal(result)
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return msg
+	}
+	return rawMessage{Data: data, Type: msg.Type}
+}
+
+// catalogItem names the kind of item a request for method concerns.
+func catalogItem(method string) string {
+	switch method {
+	case "tools/call":
+		return "tool"
+	case "prompts/get":
+		return "prompt"
+	}
+	return "resource"
+}
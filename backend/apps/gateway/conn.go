@@ -0,0 +1,232 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultMaxMessageSize bounds a single message read from an agent or an
+// upstream server unless configured otherwise. A peer sending a larger
+// message is disconnected with close code 1009.
+const defaultMaxMessageSize = 32 << 20
+
+// closeBadGateway is the close code sent to the agent when its session
+// ends because the upstream server became unreachable.
+const closeBadGateway = 1014
+
+// closeTimeout bounds writing a close frame.
+const closeTimeout = time.Second
+
+var errUpstreamLost = errors.New("upstream connection lost")
+
+// rawMessage captures both the payload bytes and the message type so that we
+// can faithfully forward text and binary messages.
+type rawMessage struct {
+	Data []byte
+	Type int
+}
+
+// upgrader accepts agent connections. Agents are not browsers, so the
+// Origin header is not checked, matching the upstream servers' view of the
+// gateway as a client.
+var upgrader = websocket.Upgrader{
+	EnableCompression: true,
+	WriteBufferPool:   writeBuffers,
+	CheckOrigin:       func(*http.Request) bool { return true },
+}
+
+// Conn is a WebSocket connection between the gateway and an agent or an
+// upstream server. Messages may be sent from several goroutines at once,
+// but only one goroutine reads.
+type Conn struct {
+	ws  *websocket.Conn
+	req *http.Request
+
+	wmu      sync.Mutex
+	lastPong atomic.Int64
+}
+
+func newConn(ws *websocket.Conn, req *http.Request, readLimit int) *Conn {
+	c := &Conn{ws: ws, req: req}
+	ws.SetReadLimit(int64(readLimit))
+	c.lastPong.Store(time.Now().UnixNano())
+	ws.SetPongHandler(func(string) error {
+		c.lastPong.Store(time.Now().UnixNano())
+		return nil
+	})
+	return c
+}
+
+// Upgrade upgrades the agent's HTTP request to a WebSocket connection,
+// adding header to the handshake response. The subprotocol is the one named
+// by the Sec-WebSocket-Protocol response header, if any. On failure the
+// agent has been sent an HTTP error.
+func (a *App) Upgrade(w http.ResponseWriter, req *http.Request, header http.Header) (*Conn, error) {
+	if a.stopping.Load() {
+		http.Error(w, ErrShuttingDown.Error(), http.StatusServiceUnavailable)
+		return nil, ErrShuttingDown
+	}
+	ws, err := upgrader.Upgrade(w, req, header)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(ws, req, a.messageSettings().MaxAgentSize), nil
+}
+
+// dial opens a connection to an upstream server, which may send messages
+// of up to readLimit bytes.
+func dial(ctx context.Context, address, origin, subproto string, timeout time.Duration, readLimit int) (*Conn, error) {
+	dialer := websocket.Dialer{
+		HandshakeTimeout:  timeout,
+		Subprotocols:      []string{subproto},
+		EnableCompression: true,
+		WriteBufferPool:   writeBuffers,
+	}
+	ws, resp, err := dialer.DialContext(ctx, address, http.Header{"Origin": {origin}})
+	if resp != nil && resp.Body != nil {
+		_ = resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newConn(ws, nil, readLimit), nil
+}
+
+// Request returns the HTTP request an agent connection was accepted for,
+// or nil for an upstream connection.
+func (c *Conn) Request() *http.Request {
+	return c.req
+}
+
+// Subprotocol returns the negotiated subprotocol.
+func (c *Conn) Subprotocol() string {
+	return c.ws.Subprotocol()
+}
+
+// receive reads the next message. Fragmented messages are reassembled and
+// control frames are handled while reading.
+func (c *Conn) receive() (rawMessage, error) {
+	msgType, r, err := c.ws.NextReader()
+	if err != nil {
+		return rawMessage{}, err
+	}
+	buf := readBuffers.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledBuffer {
+			buf.Reset()
+			readBuffers.Put(buf)
+		}
+	}()
+	if _, err := buf.ReadFrom(r); err != nil {
+		return rawMessage{}, err
+	}
+	return rawMessage{Data: bytes.Clone(buf.Bytes()), Type: msgType}, nil
+}
+
+func (c *Conn) send(msg rawMessage) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.ws.WriteMessage(msg.Type, msg.Data)
+}
+
+// sendWithin sends msg, failing when it cannot be written within timeout.
+func (c *Conn) sendWithin(msg rawMessage, timeout time.Duration) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	_ = c.ws.SetWriteDeadline(deadline)
+	return c.ws.WriteMessage(msg.Type, msg.Data)
+}
+
+// ping sends a ping, which the peer must answer within timeout.
+func (c *Conn) ping(timeout time.Duration) error {
+	return c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout))
+}
+
+// sincePong returns the time since the peer last answered a ping, or since
+// the connection was established.
+func (c *Conn) sincePong() time.Duration {
+	return time.Since(time.Unix(0, c.lastPong.Load()))
+}
+
+func (c *Conn) setReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+// setDeadline sets the read and write deadlines.
+func (c *Conn) setDeadline(t time.Time) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_ = c.ws.SetWriteDeadline(t)
+	return c.ws.SetReadDeadline(t)
+}
+
+// Close closes the connection with a normal closure.
+func (c *Conn) Close() error {
+	return c.closeWith(websocket.CloseNormalClosure, "")
+}
+
+// closeWith sends a close frame with code and reason, then closes the
+// connection. A reason longer than a close frame allows is cut at the last
+// character that fits.
+func (c *Conn) closeWith(code int, reason string) error {
+	if len(reason) > 123 {
+		n := 123
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	_ = c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(closeTimeout))
+	return c.ws.Close()
+}
+
+// closeStatus returns the close code and reason sent when a connection is
+// closed because of cause. A close code received from one side of a session
+// is forwarded to the other.
+func closeStatus(cause error) (int, string) {
+	var closeErr *websocket.CloseError
+	switch {
+	case errors.As(cause, &closeErr) && sendableCloseCode(closeErr.Code):
+		return closeErr.Code, closeErr.Text
+	case errors.Is(cause, websocket.ErrReadLimit):
+		return websocket.CloseMessageTooBig, "message too big"
+	case errors.Is(cause, errSessionLifetime):
+		return websocket.CloseNormalClosure, errSessionLifetime.Error()
+	case errors.Is(cause, errAgentIdle):
+		return websocket.CloseNormalClosure, errAgentIdle.Error()
+	case errors.Is(cause, ErrShuttingDown):
+		return websocket.CloseGoingAway, "gateway shutting down"
+	case errors.Is(cause, errUpstreamLost):
+		return closeBadGateway, errUpstreamLost.Error()
+	case errors.Is(cause, ErrServerNotFound):
+		return websocket.ClosePolicyViolation, cause.Error()
+	case errors.Is(cause, ErrServerDisabled), errors.Is(cause, ErrNoUpstream):
+		return websocket.CloseTryAgainLater, cause.Error()
+	case cause == nil, closeErr != nil, errors.Is(cause, io.EOF), errors.Is(cause, context.Canceled):
+		return websocket.CloseNormalClosure, ""
+	}
+	return websocket.CloseInternalServerErr, ""
+}
+
+// sendableCloseCode reports whether code may be sent in a close frame;
+// some codes only describe how a connection ended.
+func sendableCloseCode(code int) bool {
+	switch code {
+	case websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+		return false
+	}
+	return code >= 1000 && code < 5000
+}
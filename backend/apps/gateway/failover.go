@@ -0,0 +1,377 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/mcp"
+)
+
+const (
+	defaultFailoverAttempts = 2
+	// maxLastGood bounds the results remembered per upstream for
+	// FailoverConfig.CachedResult.
+	maxLastGood = 1000
+)
+
+// toolCall is a tools/call request the session watches so it can fail it
+// over when the upstream does not answer it successfully.
+type toolCall struct {
+	id         json.RawMessage
+	params     mcp.CallToolParams
+	policy     config.FailoverConfig
+	readOnly   bool
+	idempotent bool
+	timeout    time.Duration
+}
+
+// failoverTarget is where a failed call is tried next: another replica of
+// the same server or a fallback server.
+type failoverTarget struct {
+	up   *upstream
+	ep   *endpoint
+	tool string
+}
+
+// failoverPolicy resolves the failover settings for tool, merging the
+// server's settings with the tool's. It reports false when failover is off.
+func (u *upstream) failoverPolicy(tool string) (*toolCall, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	policy := u.config.Failover
+	toolCfg := u.config.Tools[tool]
+	override := toolCfg.Failover
+	policy.Disabled = policy.Disabled || override.Disabled
+	if len(override.On) > 0 {
+		policy.On = override.On
+	}
+	if override.MaxAttempts > 0 {
+		policy.MaxAttempts = override.MaxAttempts
+	}
+	if len(override.Fallbacks) > 0 {
+		policy.Fallbacks = override.Fallbacks
+	}
+	policy.Replicas = policy.Replicas || override.Replicas
+	policy.CachedResult = policy.CachedResult || override.CachedResult
+	policy.RetryNonIdempotent = policy.RetryNonIdempotent || override.RetryNonIdempotent
+	if policy.Disabled || !policy.Replicas && len(policy.Fallbacks) == 0 && !policy.CachedResult {
+		return nil, false
+	}
+	if len(policy.On) == 0 {
+		policy.On = []string{config.FailoverOnUnavailable}
+	}
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = defaultFailoverAttempts
+	}
+
+	call := &toolCall{policy: policy}
+	call.readOnly, call.idempotent = u.toolHints(tool)
+	return call, true
+}
+
+// toolHints reports whether tool is read-only and whether it is idempotent,
+// as declared in its settings or advertised by the server. Read-only tools
+// are idempotent. The caller holds u.mu.
+func (u *upstream) toolHints(tool string) (readOnly, idempotent bool) {
+	toolCfg := u.config.Tools[tool]
+	readOnly, idempotent = toolCfg.ReadOnly, toolCfg.Idempotent
+	for _, t := range u.tools {
+		if t.Name != tool || t.Annotations == nil {
+			continue
+		}
+		hints := t.Annotations
+		readOnly = readOnly || hints.ReadOnlyHint != nil && *hints.ReadOnlyHint
+		idempotent = idempotent || hints.IdempotentHint != nil && *hints.IdempotentHint
+	}
+	return readOnly, idempotent || readOnly
+}
+
+// triggers reports whether reply is a failure that calls for failover.
+func (c *toolCall) triggers(reply *mcp.Message) bool {
+	switch {
+	case reply.Error != nil && reply.Error.Code == CodeRequestTimeout:
+		return false
+	case reply.Error != nil && reply.Error.Code == CodeUpstreamUnavailable:
+		return slices.Contains(c.policy.On, config.FailoverOnUnavailable)
+	case reply.Error != nil:
+		return slices.Contains(c.policy.On, config.FailoverOnError)
+	}
+	var result mcp.CallToolResult
+	if json.Unmarshal(reply.Result, &result) == nil && result.IsError {
+		return slices.Contains(c.policy.On, config.FailoverOnToolError)
+	}
+	return false
+}
+
+// cacheKey identifies the call's tool and arguments.
+func (c *toolCall) cacheKey() string {
+	var args bytes.Buffer
+	if json.Compact(&args, c.params.Arguments) != nil {
+		args.Reset()
+	}
+	return c.params.Name + "\x00" + args.String()
+}
+
+// rememberResult keeps the result of a successful call of a read-only tool
+// for FailoverConfig.CachedResult.
+func (u *upstream) rememberResult(call *toolCall, result json.RawMessage) {
+	if !call.policy.CachedResult || !call.readOnly {
+		return
+	}
+	u.lastGoodMu.Lock()
+	defer u.lastGoodMu.Unlock()
+	if u.lastGood == nil {
+		u.lastGood = make(map[string]json.RawMessage)
+	}
+	key := call.cacheKey()
+	if _, ok := u.lastGood[key]; !ok && len(u.lastGood) >= maxLastGood {
+		for evict := range u.lastGood {
+			delete(u.lastGood, evict)
+			break
+		}
+	}
+	u.lastGood[key] = result
+}
+
+func (u *upstream) lastGoodResult(call *toolCall) (json.RawMessage, bool) {
+	u.lastGoodMu.Lock()
+	defer u.lastGoodMu.Unlock()
+	result, ok := u.lastGood[call.cacheKey()]
+	return result, ok
+}
+
+// watchToolCall starts watching msg if it is a tools/call request of a
+// tool with failover enabled.
+func (s *session) watchToolCall(msg *rawMessage) {
+	env, ok := peekEnvelope(msg)
+	if !ok || env.Method != "tools/call" || len(env.ID) == 0 {
+		return
+	}
+	var body struct {
+		Params mcp.CallToolParams `json:"params"`
+	}
+	if json.Unmarshal(msg.Data, &body) != nil {
+		return
+	}
+	call, ok := s.up.failoverPolicy(body.Params.Name)
+	if !ok {
+		return
+	}
+	call.id = env.ID
+	call.params = body.Params
+	call.timeout = s.up.requestTimeout("tools/call", call.params.Name)
+
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	if s.calls == nil {
+		s.calls = make(map[string]*toolCall)
+	}
+	s.calls[string(env.ID)] = call
+}
+
+// interceptRaw is interceptReply for a message read from the upstream.
+func (s *session) interceptRaw(msg *rawMessage) bool {
+	env, ok := peekEnvelope(msg)
+	if !ok || env.Method != "" || len(env.ID) == 0 {
+		return false
+	}
+	s.callsMu.Lock()
+	_, watched := s.calls[string(env.ID)]
+	s.callsMu.Unlock()
+	if !watched {
+		return false
+	}
+	var reply mcp.Message
+	if json.Unmarshal(msg.Data, &reply) != nil {
+		return false
+	}
+	return s.interceptReply(&reply)
+}
+
+// interceptReply inspects the response to a watched tool call. When the
+// response is a failure that triggers failover it is held back and the
+// call is failed over; interceptReply then reports true and the caller
+// must not deliver the response.
+func (s *session) interceptReply(reply *mcp.Message) bool {
+	s.callsMu.Lock()
+	call := s.calls[string(reply.ID)]
+	delete(s.calls, string(reply.ID))
+	s.callsMu.Unlock()
+	if call == nil {
+		return false
+	}
+	if !call.triggers(reply) {
+		if reply.Error == nil {
+			s.up.rememberResult(call, reply.Result)
+		}
+		return false
+	}
+	ctx, done := s.failoverContext(call.id, call.timeout)
+	go func() {
+		defer done()
+		s.failover(ctx, call, reply)
+	}()
+	return true
+}
+
+// failover retries a failed call on the failover targets until one
+// succeeds or the attempts run out, then falls back to the last good
+// result. The agent receives the first success, the cached result or the
+// last failure, or a timeout error when ctx expires first. Nothing is sent
+// when the failover is aborted.
+func (s *session) failover(ctx context.Context, call *toolCall, reply *mcp.Message) {
+	respond := func(reply *mcp.Message) {
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			reply = requestTimedOut()
+		case ctx.Err() != nil:
+			return
+		}
+		reply.ID = call.id
+		s.respond(reply)
+	}
+
+	attempts := 1
+	if call.idempotent || call.policy.RetryNonIdempotent {
+		initialize, _, _ := s.handshake.snapshot()
+		for _, target := range s.failoverTargets(call) {
+			if attempts >= call.policy.MaxAttempts || ctx.Err() != nil {
+				break
+			}
+			attempts++
+			s.app.logger.Printf("warning: tools/call %s on upstream %s failed, retrying on %s (%s)", call.params.Name, s.up.id, target.up.id, target.ep.url)
+			params, release, refusal := s.prepareAttempt(ctx, target, call.params)
+			if refusal != nil {
+				s.app.logger.Printf("warning: failover of tools/call %s to upstream %s refused: %s", call.params.Name, target.up.id, refusal.Error.Message)
+				continue
+			}
+			next, err := s.app.callTool(ctx, target, params, initialize)
+			release()
+			if err != nil {
+				s.app.logger.Printf("warning: failover of tools/call %s to upstream %s failed: %v", call.params.Name, target.up.id, err)
+				continue
+			}
+			if !call.triggers(next) {
+				if next.Error == nil {
+					s.up.rememberResult(call, next.Result)
+				}
+				respond(next)
+				return
+			}
+			reply = next
+		}
+	}
+	if call.policy.CachedResult && call.readOnly {
+		if result, ok := s.up.lastGoodResult(call); ok {
+			s.app.logger.Printf("answering tools/call %s on upstream %s with its last good result", call.params.Name, s.up.id)
+			cached, _ := mcp.NewResult(call.id, result)
+			respond(cached)
+			return
+		}
+	}
+	respond(reply)
+}
+
+// failoverTargets lists the other replicas of the session's server, when
+// enabled, followed by the fallback servers.
+func (s *session) failoverTargets(call *toolCall) []failoverTarget {
+	var targets []failoverTarget
+	if call.policy.Replicas && s.up.balancer != nil {
+		for _, ep := range s.up.balancer.others(s.endpoint) {
+			targets = append(targets, failoverTarget{up: s.up, ep: ep, tool: call.params.Name})
+		}
+	}
+	for _, fallback := range call.policy.Fallbacks {
+		up, err := s.app.route(fallback.Server)
+		if err != nil || up.balancer == nil {
+			continue
+		}
+		tool := fallback.Tool
+		if tool == "" {
+			tool = call.params.Name
+		}
+		targets = append(targets, failoverTarget{up: up, ep: up.balancer.pick(""), tool: tool})
+	}
+	return targets
+}
+
+// prepareAttempt returns the params of the call's attempt on target, or
+// the error refusing the attempt. A fallback server applies its
+// own rules to the call as it does to its agents' calls: its catalog
+// resolves the tool, and its blocked tools, argument settings, input
+// schemas, approval rules and limits apply. release ends the attempt's
+// share of the fallback server's limits.
+func (s *session) prepareAttempt(ctx context.Context, target failoverTarget, params mcp.CallToolParams) (mcp.CallToolParams, func(), *mcp.Message) {
+	release := func() {}
+	params.Name = target.tool
+	if target.up == s.up {
+		return params, release, nil
+	}
+	up := target.up
+	name, ok := up.catalog().toolName(target.tool)
+	if !ok {
+		return params, release, mcp.NewError(nil, mcp.CodeInvalidParams, fmt.Sprintf("unknown tool %q", target.tool))
+	}
+	params.Name = name
+	if refusal := s.app.blockedCall(up, name); refusal != nil {
+		return params, release, refusal
+	}
+	if settings := up.toolArguments(name); len(settings) > 0 {
+		var transformed struct {
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		data, err := json.Marshal(params)
+		if err == nil {
+			data, err = s.transformArguments(settings, data)
+		}
+		if err != nil {
+			return params, release, mcp.NewError(nil, mcp.CodeInternalError, fmt.Sprintf("cannot call tool %q: %v", name, err))
+		}
+		_ = json.Unmarshal(data, &transformed)
+		params.Arguments = transformed.Arguments
+	}
+	if refusal := s.invalidArguments(up, name, params.Arguments); refusal != nil {
+		return params, release, refusal
+	}
+	if cfg, ok := s.approvalFor(up, name, params.Arguments); ok {
+		if refusal := s.awaitApproval(ctx, up, cfg, name, params.Arguments); refusal != nil {
+			return params, release, refusal
+		}
+	}
+	if ok, reason := up.limiter.acquire(); !ok {
+		return params, release, mcp.NewError(nil, CodeLimitExceeded, reason)
+	}
+	return params, func() { up.limiter.release(1) }, nil
+}
+
+// callTool makes a single tools/call on a fresh connection to target,
+// initialized with the agent's initialize parameters.
+func (a *App) callTool(ctx context.Context, target failoverTarget, params mcp.CallToolParams, initialize json.RawMessage) (*mcp.Message, error) {
+	conn, err := a.dialUpstream(ctx, target.up, target.ep, "mcp")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	if _, err := a.initializeUpstream(conn, initialize); err != nil {
+		return nil, err
+	}
+	id := json.RawMessage(`"mcpgo-failover"`)
+	req, err := mcp.NewRequest(id, "tools/call", params)
+	if err != nil {
+		return nil, err
+	}
+	if err := send(conn, req); err != nil {
+		return nil, err
+	}
+	return awaitResponse(conn, id)
+}
@@ -0,0 +1,97 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"mcpgo/backend/services/config"
+)
+
+// Defaults for the agent connection settings in config.AgentWSConfig.
+const (
+	DefaultHandshakeTimeout = 10 * time.Second
+	defaultWriteTimeout     = 10 * time.Second
+	defaultPingInterval     = 30 * time.Second
+)
+
+var (
+	errSessionLifetime = errors.New("session reached its maximum lifetime")
+	errAgentIdle       = errors.New("agent connection idle")
+)
+
+func withAgentDefaults(cfg config.AgentWSConfig) config.AgentWSConfig {
+	if cfg.HandshakeTimeout.Duration == 0 {
+		cfg.HandshakeTimeout.Duration = DefaultHandshakeTimeout
+	}
+	if cfg.WriteTimeout.Duration == 0 {
+		cfg.WriteTimeout.Duration = defaultWriteTimeout
+	}
+	if cfg.PingInterval.Duration == 0 {
+		cfg.PingInterval.Duration = defaultPingInterval
+	}
+	return cfg
+}
+
+func (a *App) agentSettings() config.AgentWSConfig {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.agent
+}
+
+// keepAlive pings the agent on clientConn every interval until stop is
+// closed or the connection is replaced. The connection is closed when a
+// ping cannot be written in time or the agent stops answering them.
+func (s *session) keepAlive(clientConn *Conn, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		current, timeout := s.client == clientConn, s.writeTimeout
+		s.mu.Unlock()
+		if !current {
+			return
+		}
+		if clientConn.sincePong() > 2*interval+timeout {
+			s.app.logger.Printf("warning: agent of a session on upstream %s stopped answering pings", s.up.id)
+			_ = clientConn.Close()
+			return
+		}
+		if err := clientConn.ping(timeout); err != nil {
+			_ = clientConn.Close()
+			return
+		}
+	}
+}
+
+// receiveClient reads the agent's next message. The first message of a
+// new session must arrive within the handshake timeout, and later ones
+// within the idle timeout when it is set.
+func (s *session) receiveClient(clientConn *Conn, settings config.AgentWSConfig, first bool) (rawMessage, error) {
+	var deadline time.Time
+	timeout := settings.IdleTimeout.Duration
+	if first {
+		timeout = settings.HandshakeTimeout.Duration
+	}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	_ = clientConn.setReadDeadline(deadline)
+
+	msg, err := clientConn.receive()
+	var netErr net.Error
+	switch {
+	case err == nil:
+	case errors.As(err, &netErr) && netErr.Timeout() && first:
+		err = fmt.Errorf("%w: nothing sent within the handshake timeout of %s: %w", errAgentIdle, timeout, err)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		err = fmt.Errorf("%w for %s: %w", errAgentIdle, timeout, err)
+	}
+	return msg, err
+}
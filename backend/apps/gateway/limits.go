@@ -0,0 +1,291 @@
+package gateway
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/mcp"
+)
+
+// CodeLimitExceeded is the JSON-RPC error code returned to clients whose
+// request was refused by the gateway's rate or concurrency limits.
+const CodeLimitExceeded = -32001
+
+// maxExpired bounds the expired requests a session remembers.
+const maxExpired = 1024
+
+// limiter enforces the gateway-wide request limits. Its settings can be
+// changed while sessions are running; the token bucket keeps its current
+// level across updates.
+type limiter struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	max      int
+	inFlight int
+}
+
+func newLimiter() *limiter {
+	return &limiter{}
+}
+
+// update applies new limits in place.
+func (l *limiter) update(limits config.LimitsConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = limits.Rate.RequestsPerSecond
+	l.burst = float64(limits.Rate.Burst)
+	if l.burst < 1 && l.rate > 0 {
+		l.burst = 1
+	}
+	if l.last.IsZero() || l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.max = limits.Concurrency.MaxConcurrentRequests
+}
+
+// acquire reserves capacity for one request, returning a reason when the
+// request must be refused.
+func (l *limiter) acquire() (bool, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 && l.inFlight >= l.max {
+		return false, "too many concurrent requests"
+	}
+	if l.rate > 0 {
+		now := time.Now()
+		if !l.last.IsZero() {
+			l.tokens += now.Sub(l.last).Seconds() * l.rate
+			if l.tokens > l.burst {
+				l.tokens = l.burst
+			}
+		}
+		l.last = now
+		if l.tokens < 1 {
+			return false, "rate limit exceeded"
+		}
+		l.tokens--
+	}
+	l.inFlight++
+	return true, ""
+}
+
+func (l *limiter) release(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight -= n
+	if l.inFlight < 0 {
+		l.inFlight = 0
+	}
+}
+
+// sessionGuard applies limiters to the requests of a single session and
+// remembers which requests are still awaiting a response, expiring those
+// that have a deadline.
+type sessionGuard struct {
+	limiters []*limiter
+	reply    func(*mcp.Message) error
+
+	mu        sync.Mutex
+	pending   map[string]struct{}
+	deadlines map[string]*time.Timer
+	// expired holds requests that timed out or were cancelled; a late
+	// response to them is dropped.
+	expired map[string]struct{}
+}
+
+// newSessionGuard creates a guard that admits a request only when every
+// limiter has capacity for it. reply is used to answer refused requests.
+func newSessionGuard(reply func(*mcp.Message) error, limiters ...*limiter) *sessionGuard {
+	return &sessionGuard{
+		limiters:  limiters,
+		reply:     reply,
+		pending:   make(map[string]struct{}),
+		deadlines: make(map[string]*time.Timer),
+		expired:   make(map[string]struct{}),
+	}
+}
+
+func (g *sessionGuard) acquire() (bool, string) {
+	for i, l := range g.limiters {
+		if ok, reason := l.acquire(); !ok {
+			for _, acquired := range g.limiters[:i] {
+				acquired.release(1)
+			}
+			return false, reason
+		}
+	}
+	return true, ""
+}
+
+func (g *sessionGuard) release(n int) {
+	for _, l := range g.limiters {
+		l.release(n)
+	}
+}
+
+// admit is applied to client messages. Requests over the limit are answered
+// with an error instead of being forwarded.
+func (g *sessionGuard) admit(msg *rawMessage) bool {
+	env, ok := peekEnvelope(msg)
+	if !ok || env.Method == "" || len(env.ID) == 0 {
+		return true
+	}
+	allowed, reason := g.acquire()
+	if !allowed {
+		_ = g.reply(mcp.NewError(env.ID, CodeLimitExceeded, reason))
+		return false
+	}
+	g.mu.Lock()
+	g.pending[string(env.ID)] = struct{}{}
+	delete(g.expired, string(env.ID))
+	g.mu.Unlock()
+	return true
+}
+
+// setDeadline calls expire after d unless the pending request id has been
+// answered by then.
+func (g *sessionGuard) setDeadline(id json.RawMessage, d time.Duration, expire func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.pending[string(id)]; ok {
+		g.deadlines[string(id)] = time.AfterFunc(d, expire)
+	}
+}
+
+// remove forgets a pending request and reports whether it was pending. The
+// caller holds g.mu.
+func (g *sessionGuard) remove(id string) bool {
+	if timer, ok := g.deadlines[id]; ok {
+		timer.Stop()
+		delete(g.deadlines, id)
+	}
+	_, found := g.pending[id]
+	delete(g.pending, id)
+	return found
+}
+
+// complete is applied to upstream messages and frees the capacity held by
+// requests that have been answered. It reports false for late responses to
+// requests that expired, which must not be delivered.
+func (g *sessionGuard) complete(msg *rawMessage) bool {
+	env, ok := peekEnvelope(msg)
+	if !ok || env.Method != "" || len(env.ID) == 0 {
+		return true
+	}
+	g.mu.Lock()
+	found := g.remove(string(env.ID))
+	_, expired := g.expired[string(env.ID)]
+	if !found && expired {
+		delete(g.expired, string(env.ID))
+	}
+	g.mu.Unlock()
+	if found {
+		g.release(1)
+	}
+	return found || !expired
+}
+
+// fail answers a pending request with an error on the upstream's behalf and
+// releases its capacity. It reports whether the request was pending.
+func (g *sessionGuard) fail(id json.RawMessage, reply *mcp.Message) bool {
+	return g.finish(id, reply, false)
+}
+
+// expire is fail for a request that ran out of time; a response that
+// arrives later is dropped.
+func (g *sessionGuard) expire(id json.RawMessage, reply *mcp.Message) bool {
+	return g.finish(id, reply, true)
+}
+
+// cancel forgets a request the agent cancelled. No response is sent for it
+// and a late one is dropped.
+func (g *sessionGuard) cancel(id json.RawMessage) {
+	g.finish(id, nil, true)
+}
+
+func (g *sessionGuard) finish(id json.RawMessage, reply *mcp.Message, expired bool) bool {
+	g.mu.Lock()
+	found := g.remove(string(id))
+	if found && expired {
+		// Upstreams usually honour the cancellation and never answer, so
+		// the set is bounded rather than waiting for late responses.
+		if len(g.expired) >= maxExpired {
+			g.expired = make(map[string]struct{})
+		}
+		g.expired[string(id)] = struct{}{}
+	}
+	g.mu.Unlock()
+	if !found {
+		return false
+	}
+	g.release(1)
+	if reply != nil {
+		reply.ID = id
+		_ = g.reply(reply)
+	}
+	return true
+}
+
+// failAll answers every pending request with a copy of reply.
+func (g *sessionGuard) failAll(reply mcp.Message) {
+	g.mu.Lock()
+	ids := make([]json.RawMessage, 0, len(g.pending))
+	for id := range g.pending {
+		ids = append(ids, json.RawMessage(id))
+	}
+	g.mu.Unlock()
+	for _, id := range ids {
+		msg := reply
+		g.fail(id, &msg)
+	}
+}
+
+// inFlight returns the number of requests awaiting a response.
+func (g *sessionGuard) inFlight() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.pending)
+}
+
+// close releases the capacity of requests that will never be answered.
+func (g *sessionGuard) close() {
+	g.mu.Lock()
+	n := len(g.pending)
+	for _, timer := range g.deadlines {
+		timer.Stop()
+	}
+	g.pending = make(map[string]struct{})
+	g.deadlines = make(map[string]*time.Timer)
+	g.expired = make(map[string]struct{})
+	g.mu.Unlock()
+	g.release(n)
+}
+
+// envelope holds the routing fields of a JSON-RPC message.
+type envelope struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+}
+
+// peekEnvelope decodes the routing fields of a single JSON-RPC message.
+// Batches and non-JSON payloads are reported as not ok.
+func peekEnvelope(msg *rawMessage) (envelope, bool) {
+	var env envelope
+	if len(msg.Data) == 0 || msg.Data[0] != '{' {
+		return env, false
+	}
+	if err := json.Unmarshal(msg.Data, &env); err != nil {
+		return env, false
+	}
+	if string(env.ID) == "null" {
+		env.ID = nil
+	}
+	return env, true
+}
@@ -0,0 +1,290 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/mcp"
+	"mcpgo/backend/services/pinning"
+
+	"github.com/gorilla/websocket"
+)
+
+// CodeToolChanged is the JSON-RPC error code returned for calls of a tool
+// whose definition changed since it was approved, when the server's changed
+// tools are blocked.
+const CodeToolChanged = -32005
+
+var (
+	// ErrPinningDisabled is returned when approving a tool while no
+	// lockfile is configured.
+	ErrPinningDisabled = errors.New("tool pinning is not configured")
+	// ErrToolNotChanged is returned when approving a tool that has no
+	// change awaiting approval.
+	ErrToolNotChanged = pinning.ErrNotChanged
+)
+
+// ToolChange describes a tool whose definition changed since it was
+// approved.
+type ToolChange struct {
+	Server string `json:"server"`
+	Tool   string `json:"tool"`
+	// Action is what the gateway does about the change until it is
+	// approved: block, quarantine or flag.
+	Action     string    `json:"action"`
+	ApprovedAt time.Time `json:"approvedAt"`
+	DetectedAt time.Time `json:"detectedAt"`
+	// Diff lists the changed fields, "- path: value" for the approved
+	// definition and "+ path: value" for the changed one.
+	Diff []string `json:"diff"`
+}
+
+func toolChange(entry pinning.Entry, action string) ToolChange {
+	change := ToolChange{
+		Server:     entry.Server,
+		Tool:       entry.Tool,
+		Action:     action,
+		ApprovedAt: entry.Pin.ApprovedAt,
+	}
+	if entry.Pin.Changed != nil {
+		change.DetectedAt = entry.Pin.Changed.DetectedAt
+		change.Diff = pinning.Diff(entry.Pin.Definition, entry.Pin.Changed.Definition)
+	}
+	return change
+}
+
+// pinAction returns the lockfile u's tools are pinned in and what happens
+// to a changed tool, or nil when u's tools are not pinned. The tools of an
+// aggregated server are pinned by its members.
+func (a *App) pinAction(u *upstream) (*pinning.Store, string) {
+	a.mu.RLock()
+	pins, action := a.pins, a.pinOnChange
+	a.mu.RUnlock()
+	u.mu.RLock()
+	settings, aggregated := u.config.Pinning, len(u.config.Aggregate) > 0
+	u.mu.RUnlock()
+	if pins == nil || settings.Disabled || aggregated {
+		return nil, ""
+	}
+	if settings.OnChange != "" {
+		action = settings.OnChange
+	}
+	if action == "" {
+		action = config.PinningBlock
+	}
+	return pins, action
+}
+
+// pinTools compares the tools of a tools/list result u sent with their
+// pins, pinning new tools, and returns the items agents are given: changed
+// tools are removed when they are blocked and listed with their approved
+// definition when they are quarantined.
+func (a *App) pinTools(u *upstream, items json.RawMessage) json.RawMessage {
+	pins, action := a.pinAction(u)
+	if pins == nil {
+		return items
+	}
+	var entries []json.RawMessage
+	if json.Unmarshal(items, &entries) != nil {
+		return items
+	}
+	// Definitions are compared in the form of mcp.Tool, so that tools
+	// listed to agents and probed tools compare alike.
+	names := make([]string, len(entries))
+	definitions := make(map[string]json.RawMessage, len(entries))
+	for i, entry := range entries {
+		var tool mcp.Tool
+		if json.Unmarshal(entry, &tool) != nil || tool.Name == "" {
+			continue
+		}
+		definition, err := json.Marshal(tool)
+		if err != nil {
+			continue
+		}
+		names[i], definitions[tool.Name] = tool.Name, definition
+	}
+	changed, detected, err := pins.Observe(u.id, definitions)
+	if err != nil {
+		a.logger.Printf("warning: cannot pin the tools of upstream %s: %v", u.id, err)
+	}
+	for _, entry := range detected {
+		a.logger.Printf("warning: tool %s on upstream %s changed since it was approved (%s until approved again):\n\t%s",
+			entry.Tool, entry.Server, action, strings.Join(toolChange(entry, action).Diff, "\n\t"))
+	}
+	if len(changed) == 0 || action == config.PinningFlag {
+		return items
+	}
+	kept := make([]json.RawMessage, 0, len(entries))
+	for i, entry := range entries {
+		pin, ok := changed[names[i]]
+		switch {
+		case !ok:
+			kept = append(kept, entry)
+		case action == config.PinningQuarantine:
+			kept = append(kept, pin.Definition)
+		}
+	}
+	out, err := json.Marshal(kept)
+	if err != nil {
+		return items
+	}
+	return out
+}
+
+// changedToolAction returns what happens to a call of u's tool name: ""
+// when the tool is not pinned or matches its pin, the pinning action
+// otherwise.
+func (a *App) changedToolAction(u *upstream, name string) string {
+	pins, action := a.pinAction(u)
+	if pins == nil {
+		return ""
+	}
+	_, changed, err := pins.Changed(u.id, name)
+	if err != nil {
+		a.logger.Printf("warning: cannot read the pins of upstream %s: %v", u.id, err)
+		return ""
+	}
+	if !changed {
+		return ""
+	}
+	return action
+}
+
+// blockedCall returns the error answering a call of u's tool name when the
+// tool changed since it was approved and u's changed tools are blocked.
+func (a *App) blockedCall(u *upstream, name string) *mcp.Message {
+	if a.changedToolAction(u, name) != config.PinningBlock {
+		return nil
+	}
+	return mcp.NewError(nil, CodeToolChanged, fmt.Sprintf("tool %q changed since it was approved and is blocked until an operator approves it again", name))
+}
+
+// refuseChangedTool answers the agent's tools/call of a blocked tool,
+// reporting whether it did.
+func (s *session) refuseChangedTool(msg *rawMessage) bool {
+	env, ok := peekEnvelope(msg)
+	if !ok || env.Method != "tools/call" || len(env.ID) == 0 {
+		return false
+	}
+	var body struct {
+		Params struct {
+			Name string `json:"name"`
+		} `json:"params"`
+	}
+	if json.Unmarshal(msg.Data, &body) != nil {
+		return false
+	}
+	refusal := s.app.blockedCall(s.up, body.Params.Name)
+	if refusal == nil {
+		return false
+	}
+	refusal.ID = env.ID
+	_ = s.deliverMessage(refusal)
+	return true
+}
+
+// approvalFor returns the approval settings of up when a call of its tool
+// name needs approval: when its approval rules select the call, or when
+// the tool changed since it was pinned and is quarantined.
+func (s *session) approvalFor(up *upstream, name string, arguments json.RawMessage) (config.ApprovalConfig, bool) {
+	if cfg, ok := up.approvalRequired(name, arguments); ok {
+		return cfg, true
+	}
+	if s.app.changedToolAction(up, name) != config.PinningQuarantine {
+		return config.ApprovalConfig{}, false
+	}
+	up.mu.RLock()
+	defer up.mu.RUnlock()
+	return up.config.Approval, true
+}
+
+// ToolChanges returns the tools whose definitions changed since they were
+// approved.
+func (a *App) ToolChanges() ([]ToolChange, error) {
+	a.mu.RLock()
+	pins := a.pins
+	a.mu.RUnlock()
+	if pins == nil {
+		return []ToolChange{}, nil
+	}
+	entries, err := pins.Changes()
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]ToolChange, 0, len(entries))
+	for _, entry := range entries {
+		changes = append(changes, toolChange(entry, a.serverPinAction(entry.Server)))
+	}
+	return changes, nil
+}
+
+// ApproveTool makes the changed definition of a server's tool the approved
+// one and tells the server's agents to list its tools again.
+func (a *App) ApproveTool(server, tool string) (ToolChange, error) {
+	a.mu.RLock()
+	pins := a.pins
+	a.mu.RUnlock()
+	if pins == nil {
+		return ToolChange{}, ErrPinningDisabled
+	}
+	previous, ok, err := pins.Changed(server, tool)
+	if err != nil {
+		return ToolChange{}, err
+	}
+	if !ok {
+		return ToolChange{}, fmt.Errorf("%w: %s/%s", ErrToolNotChanged, server, tool)
+	}
+	if _, err := pins.Approve(server, tool); err != nil {
+		return ToolChange{}, err
+	}
+	a.logger.Printf("changed definition of tool %s on upstream %s approved", tool, server)
+	a.notifyToolsChanged(server)
+	return toolChange(pinning.Entry{Server: server, Tool: tool, Pin: previous}, a.serverPinAction(server)), nil
+}
+
+// serverPinAction returns what happens to the changed tools of the server
+// id, which may no longer be configured.
+func (a *App) serverPinAction(id string) string {
+	a.mu.RLock()
+	up, ok := a.servers[id]
+	action := a.pinOnChange
+	a.mu.RUnlock()
+	if ok {
+		if _, upAction := a.pinAction(up); upAction != "" {
+			return upAction
+		}
+	}
+	if action == "" {
+		action = config.PinningBlock
+	}
+	return action
+}
+
+// notifyToolsChanged sends notifications/tools/list_changed to the agents
+// of the server id and of the aggregated servers it is a member of, without
+// waiting for slow agents.
+func (a *App) notifyToolsChanged(id string) {
+	notification, err := mcp.NewNotification("notifications/tools/list_changed", nil)
+	if err != nil {
+		return
+	}
+	data, err := encodeMessage(notification)
+	if err != nil {
+		return
+	}
+	for _, s := range a.liveSessions() {
+		concerned := s.up.id == id
+		if s.agg != nil {
+			for _, m := range s.agg.members {
+				concerned = concerned || m.id == id
+			}
+		}
+		if concerned {
+			s.deliverShared(rawMessage{Data: data, Type: websocket.TextMessage})
+		}
+	}
+}
@@ -0,0 +1,566 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"mcpgo/backend/services/mcp"
+)
+
+const (
+	defaultPoolSize        = 4
+	defaultPoolIdleTimeout = 5 * time.Minute
+)
+
+var errPoolClosed = errors.New("connection pool closed")
+
+// pool multiplexes the sessions of a stateless upstream over a bounded set
+// of connections that the gateway initializes itself. Request ids and
+// progress tokens are rewritten so they are unique on a connection, and
+// responses are mapped back to the session and id they belong to. Agents'
+// initialize requests are answered from the pool's own handshake, and their
+// resource subscriptions are shared: each resource is subscribed to once.
+type pool struct {
+	app *App
+	up  *upstream
+
+	mu       sync.Mutex
+	conns    []*pooledConn
+	dialing  int
+	nextID   int64
+	init     *mcp.InitializeResult
+	sessions map[*session]bool
+	requests map[poolKey]*poolRequest
+	closed   bool
+
+	// subs are the resource subscriptions by URI and listChanged the time
+	// each list change was last delivered.
+	subs        map[string]*subscription
+	listChanged map[string]time.Time
+}
+
+// pooledConn is one initialized upstream connection of a pool.
+type pooledConn struct {
+	conn     *Conn
+	endpoint *endpoint
+	pending  map[string]*poolRequest
+	progress map[string]*poolRequest
+	lastUsed time.Time
+}
+
+// poolKey identifies a request by the session and id the agent used.
+type poolKey struct {
+	session *session
+	id      string
+}
+
+// poolRequest is a request forwarded on a pooled connection. Requests the
+// gateway makes itself to subscribe to a resource have no session.
+type poolRequest struct {
+	session       *session
+	id            json.RawMessage
+	upstreamID    string
+	progressToken json.RawMessage
+	gatewayToken  string
+	conn          *pooledConn
+	subscription  *subscription
+}
+
+// connectionPool returns the pool of a stateless upstream, creating it on
+// first use.
+func (a *App) connectionPool(up *upstream) *pool {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.pool == nil {
+		up.pool = &pool{
+			app:         a,
+			up:          up,
+			sessions:    make(map[*session]bool),
+			requests:    make(map[poolKey]*poolRequest),
+			subs:        make(map[string]*subscription),
+			listChanged: make(map[string]time.Time),
+		}
+		context.AfterFunc(up.ctx, up.pool.close)
+		go up.pool.evictIdle()
+	}
+	return up.pool
+}
+
+func (p *pool) settings() (int, time.Duration) {
+	p.up.mu.RLock()
+	cfg := p.up.config.Pool
+	p.up.mu.RUnlock()
+	size, idle := cfg.MaxConnections, cfg.IdleTimeout.Duration
+	if size <= 0 {
+		size = defaultPoolSize
+	}
+	if idle <= 0 {
+		idle = defaultPoolIdleTimeout
+	}
+	return size, idle
+}
+
+// size returns the number of open connections.
+func (p *pool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// acquire returns the least loaded connection, opening a new one while the
+// pool is below its size limit and every connection is busy.
+func (p *pool) acquire(ctx context.Context) (*pooledConn, error) {
+	size, _ := p.settings()
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errPoolClosed
+		}
+		var best *pooledConn
+		for _, pc := range p.conns {
+			if best == nil || len(pc.pending) < len(best.pending) {
+				best = pc
+			}
+		}
+		full := len(p.conns)+p.dialing >= size
+		if best != nil && (len(best.pending) == 0 || full) {
+			best.lastUsed = time.Now()
+			p.mu.Unlock()
+			return best, nil
+		}
+		if !full {
+			p.dialing++
+			p.mu.Unlock()
+			return p.open(ctx)
+		}
+		// Every slot is taken by a connection that is still being opened.
+		p.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// open dials and initializes a new connection for the pool. The caller has
+// reserved the slot by incrementing p.dialing.
+func (p *pool) open(ctx context.Context) (*pooledConn, error) {
+	ep := p.up.balancer.pick("")
+	conn, init, err := p.dial(ctx, ep)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	if err != nil {
+		return nil, err
+	}
+	if p.closed {
+		_ = conn.Close()
+		return nil, errPoolClosed
+	}
+	ep.active.Add(1)
+	pc := &pooledConn{
+		conn:     conn,
+		endpoint: ep,
+		pending:  make(map[string]*poolRequest),
+		progress: make(map[string]*poolRequest),
+		lastUsed: time.Now(),
+	}
+	p.conns = append(p.conns, pc)
+	if p.init == nil {
+		p.init = init
+	}
+	go p.read(pc)
+	return pc, nil
+}
+
+// dial opens a connection to ep and performs the MCP handshake as the
+// gateway. The connection declares the client capabilities whose requests
+// the gateway can pass to agents; an agent that lacks one is refused per
+// request.
+func (p *pool) dial(ctx context.Context, ep *endpoint) (*Conn, *mcp.InitializeResult, error) {
+	conn, err := p.app.dialUpstream(ctx, p.up, ep, "mcp")
+	if err != nil {
+		return nil, nil, err
+	}
+	params, _ := json.Marshal(mcp.InitializeParams{
+		ProtocolVersion: mcp.LatestProtocolVersion,
+		Capabilities:    json.RawMessage(`{"elicitation":{},"roots":{},"sampling":{}}`),
+		ClientInfo:      mcp.ClientInfo,
+	})
+	init, err := p.app.initializeUpstream(conn, params)
+	if err != nil {
+		_ = conn.Close()
+		p.up.recordFailure(err)
+		return nil, nil, fmt.Errorf("failed to initialize pooled connection to %s: %w", p.up.id, err)
+	}
+	return conn, init, nil
+}
+
+func (p *pool) addSession(s *session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sessions[s] = true
+}
+
+// removeSession forgets a closed session, cancels its requests that are
+// still in flight upstream and the subscriptions only it held.
+func (p *pool) removeSession(s *session) {
+	p.mu.Lock()
+	delete(p.sessions, s)
+	unused := p.dropSubscriptions(s)
+	var abandoned []*poolRequest
+	for key, req := range p.requests {
+		if key.session == s {
+			abandoned = append(abandoned, req)
+			p.forget(req)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, req := range abandoned {
+		cancelled, _ := mcp.NewNotification("notifications/cancelled", map[string]interface{}{
+			"requestId": json.RawMessage(req.upstreamID),
+			"reason":    "session closed",
+		})
+		_ = send(req.conn.conn, cancelled)
+	}
+	for uri, pc := range unused {
+		p.sendUnsubscribe(pc, uri)
+	}
+}
+
+// forget removes every mapping of req. The caller holds p.mu.
+func (p *pool) forget(req *poolRequest) {
+	delete(req.conn.pending, req.upstreamID)
+	if req.gatewayToken != "" {
+		delete(req.conn.progress, req.gatewayToken)
+	}
+	delete(p.requests, poolKey{req.session, string(req.id)})
+}
+
+// forward handles a message an agent sent on a pooled session.
+func (p *pool) forward(s *session, msg rawMessage) {
+	var m mcp.Message
+	if err := json.Unmarshal(msg.Data, &m); err != nil {
+		return
+	}
+	switch {
+	case m.IsRequest() && m.Method == "initialize":
+		p.initialize(s, &m)
+	case m.IsRequest() && m.Method == "ping":
+		reply, _ := mcp.NewResult(m.ID, struct{}{})
+		s.respond(reply)
+	case m.IsRequest() && m.Method == "resources/subscribe":
+		p.subscribe(s, &m)
+	case m.IsRequest() && m.Method == "resources/unsubscribe":
+		p.unsubscribe(s, &m)
+	case m.IsRequest():
+		p.request(s, &m)
+	case m.IsNotification() && m.Method == "notifications/cancelled":
+		p.cancel(s, &m)
+	}
+	// Other notifications and responses concern per-session state, which a
+	// stateless server does not keep.
+}
+
+// initialize answers an agent's initialize request with the result of the
+// pool's own handshake.
+func (p *pool) initialize(s *session, m *mcp.Message) {
+	if _, err := p.acquire(s.ctx); err != nil {
+		s.guard.fail(m.ID, upstreamUnavailable())
+		return
+	}
+	p.mu.Lock()
+	init := *p.init
+	p.mu.Unlock()
+	reply, _ := mcp.NewResult(m.ID, init)
+	s.respond(reply)
+}
+
+func (p *pool) request(s *session, m *mcp.Message) {
+	pc, err := p.acquire(s.ctx)
+	if err != nil {
+		s.guard.fail(m.ID, upstreamUnavailable())
+		return
+	}
+
+	p.mu.Lock()
+	p.nextID++
+	req := &poolRequest{
+		session:    s,
+		id:         m.ID,
+		upstreamID: strconv.FormatInt(p.nextID, 10),
+		conn:       pc,
+	}
+	m.ID = json.RawMessage(req.upstreamID)
+	if token := progressToken(m.Params); token != nil {
+		req.progressToken = token
+		req.gatewayToken = fmt.Sprintf(`"mcpgo-progress-%d"`, p.nextID)
+		m.Params = withProgressToken(m.Params, json.RawMessage(req.gatewayToken))
+	}
+	pc.pending[req.upstreamID] = req
+	if req.gatewayToken != "" {
+		pc.progress[req.gatewayToken] = req
+	}
+	p.requests[poolKey{s, string(req.id)}] = req
+	p.mu.Unlock()
+
+	// A failed write means the connection is broken; its read loop fails
+	// the pending requests.
+	_ = send(pc.conn, m)
+}
+
+// cancel forwards an agent's cancellation with the request id rewritten.
+func (p *pool) cancel(s *session, m *mcp.Message) {
+	var params struct {
+		RequestID json.RawMessage `json:"requestId"`
+		Reason    string          `json:"reason"`
+	}
+	if json.Unmarshal(m.Params, &params) != nil {
+		return
+	}
+	p.cancelRequest(s, params.RequestID, params.Reason)
+}
+
+// cancelRequest sends notifications/cancelled for the session's request id
+// on the connection carrying it and forgets the request.
+func (p *pool) cancelRequest(s *session, id json.RawMessage, reason string) {
+	p.mu.Lock()
+	req := p.requests[poolKey{s, string(id)}]
+	if req != nil {
+		p.forget(req)
+	}
+	p.mu.Unlock()
+	if req == nil {
+		return
+	}
+	params := map[string]interface{}{"requestId": json.RawMessage(req.upstreamID)}
+	if reason != "" {
+		params["reason"] = reason
+	}
+	cancelled, _ := mcp.NewNotification("notifications/cancelled", params)
+	_ = send(req.conn.conn, cancelled)
+}
+
+// read dispatches the messages of a pooled connection until it fails.
+func (p *pool) read(pc *pooledConn) {
+	for {
+		msg, err := pc.conn.receive()
+		if err != nil {
+			p.drop(pc, err)
+			return
+		}
+		parts, _ := splitBatch(msg)
+		for _, part := range parts {
+			p.dispatch(pc, part)
+		}
+	}
+}
+
+// dispatch routes a message the upstream sent on pc.
+func (p *pool) dispatch(pc *pooledConn, msg rawMessage) {
+	var m mcp.Message
+	if json.Unmarshal(msg.Data, &m) != nil {
+		return
+	}
+	switch {
+	case m.IsResponse():
+		p.mu.Lock()
+		req := pc.pending[string(m.ID)]
+		if req != nil {
+			p.forget(req)
+		}
+		pc.lastUsed = time.Now()
+		p.mu.Unlock()
+		switch {
+		case req != nil && req.subscription != nil:
+			p.subscribed(req.subscription, pc, &m)
+		case req != nil:
+			m.ID = req.id
+			req.session.respond(&m)
+		}
+	case m.IsNotification() && m.Method == "notifications/progress":
+		p.mu.Lock()
+		req := pc.progress[string(progressTokenOf(m.Params))]
+		p.mu.Unlock()
+		if req != nil {
+			m.Params = setParam(m.Params, "progressToken", req.progressToken)
+			_ = req.session.deliverMessage(&m)
+		}
+	case m.IsNotification():
+		p.up.invalidateCache(&msg)
+		p.notify(msg, &m)
+	case m.IsRequest():
+		p.serverRequest(pc, &m)
+	}
+}
+
+// serverRequest passes a request the upstream sent on pc to the session it
+// concerns. Requests carry no reference to the request they were sent for,
+// so the session is only known when it is the one session with requests in
+// flight on pc; otherwise the request is refused rather than risk sending
+// it to another agent.
+func (p *pool) serverRequest(pc *pooledConn, m *mcp.Message) {
+	reply := func(answer *mcp.Message) {
+		_ = send(pc.conn, answer)
+	}
+	if m.Method == "ping" {
+		pong, _ := mcp.NewResult(m.ID, struct{}{})
+		reply(pong)
+		return
+	}
+	p.mu.Lock()
+	var origin *session
+	ambiguous := false
+	for _, req := range pc.pending {
+		switch {
+		case req.session == nil || req.session == origin:
+		case origin == nil:
+			origin = req.session
+		default:
+			ambiguous = true
+		}
+	}
+	p.mu.Unlock()
+	if origin == nil || ambiguous {
+		reply(mcp.NewError(m.ID, mcp.CodeInternalError, fmt.Sprintf("cannot route %s: no single agent has requests in flight on this connection", m.Method)))
+		return
+	}
+	origin.serverRequest(p.up, m, reply)
+}
+
+// drop removes a failed connection and fails its requests with a retryable
+// error.
+func (p *pool) drop(pc *pooledConn, cause error) {
+	p.mu.Lock()
+	for i, conn := range p.conns {
+		if conn == pc {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			break
+		}
+	}
+	lost := make([]*poolRequest, 0, len(pc.pending))
+	for _, req := range pc.pending {
+		lost = append(lost, req)
+		p.forget(req)
+	}
+	moved := p.moveSubscriptions(pc)
+	closed := p.closed
+	p.mu.Unlock()
+
+	_ = pc.conn.Close()
+	pc.endpoint.active.Add(-1)
+	if !closed && len(lost) > 0 {
+		p.app.logger.Printf("warning: pooled connection to upstream %s lost with %d request(s) in flight: %v", p.up.id, len(lost), cause)
+	}
+	for _, req := range lost {
+		if req.subscription != nil {
+			p.subscribed(req.subscription, nil, upstreamUnavailable())
+			continue
+		}
+		req.session.guard.fail(req.id, upstreamUnavailable())
+	}
+	if closed {
+		return
+	}
+	for _, sub := range moved {
+		go p.sendSubscribe(sub)
+	}
+}
+
+// evictIdle closes connections that carried no request for the idle
+// timeout, until the pool is closed.
+func (p *pool) evictIdle() {
+	_, idle := p.settings()
+	interval := idle / 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.up.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		var idleConns []*pooledConn
+		for _, pc := range p.conns {
+			if len(pc.pending) == 0 && time.Since(pc.lastUsed) >= idle && !p.holdsSubscriptions(pc) {
+				idleConns = append(idleConns, pc)
+			}
+		}
+		p.mu.Unlock()
+		for _, pc := range idleConns {
+			// The read loop removes the connection from the pool.
+			_ = pc.conn.Close()
+		}
+	}
+}
+
+// close closes every connection once the upstream has been retired.
+func (p *pool) close() {
+	p.mu.Lock()
+	p.closed = true
+	conns := append([]*pooledConn(nil), p.conns...)
+	p.mu.Unlock()
+	for _, pc := range conns {
+		_ = pc.conn.Close()
+	}
+}
+
+// progressToken returns params._meta.progressToken, if present.
+func progressToken(params json.RawMessage) json.RawMessage {
+	var p struct {
+		Meta struct {
+			ProgressToken json.RawMessage `json:"progressToken"`
+		} `json:"_meta"`
+	}
+	if json.Unmarshal(params, &p) != nil || len(p.Meta.ProgressToken) == 0 || string(p.Meta.ProgressToken) == "null" {
+		return nil
+	}
+	return p.Meta.ProgressToken
+}
+
+// withProgressToken replaces params._meta.progressToken.
+func withProgressToken(params json.RawMessage, token json.RawMessage) json.RawMessage {
+	var meta json.RawMessage
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(params, &fields) == nil {
+		meta = fields["_meta"]
+	}
+	return setParam(params, "_meta", setParam(meta, "progressToken", token))
+}
+
+// progressTokenOf returns the progressToken of a progress notification.
+func progressTokenOf(params json.RawMessage) json.RawMessage {
+	var p struct {
+		ProgressToken json.RawMessage `json:"progressToken"`
+	}
+	_ = json.Unmarshal(params, &p)
+	return p.ProgressToken
+}
+
+// setParam sets a field of a JSON object, creating the object if needed.
+func setParam(object json.RawMessage, key string, value json.RawMessage) json.RawMessage {
+	fields := make(map[string]json.RawMessage)
+	_ = json.Unmarshal(object, &fields)
+	if fields == nil {
+		fields = make(map[string]json.RawMessage)
+	}
+	fields[key] = value
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return object
+	}
+	return out
+}
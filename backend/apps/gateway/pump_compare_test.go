@@ -0,0 +1,156 @@
+//go:build pumpbench
+
+package gateway_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gorilla "github.com/gorilla/websocket"
+	"golang.org/x/net/websocket"
+)
+
+// BenchmarkPump compares the message pump the gateway had on top of
+// golang.org/x/net/websocket with the one it has on gorilla/websocket. Each
+// pump relays an agent's connection to an echo server as the gateway does,
+// copying every frame in both directions, so a round trip crosses the pump
+// twice. Run it with
+//
+//	go test -tags pumpbench -bench Pump -run '^$' ./backend/apps/gateway
+//
+// BenchmarkGatewayRoundTrip measures the whole message path of the gateway.
+func BenchmarkPump(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10} {
+		payload := []byte(`{"jsonrpc":"2.0","method":"notifications/message","params":{"data":"` + strings.Repeat("x", size) + `"}}`)
+		b.Run(fmt.Sprintf("x-net/%dKiB", size>>10), func(b *testing.B) {
+			benchmarkPump(b, newXNetRelay(b), payload, false)
+		})
+		for _, compress := range []bool{false, true} {
+			name := fmt.Sprintf("gorilla/%dKiB", size>>10)
+			if compress {
+				name = fmt.Sprintf("gorilla-deflate/%dKiB", size>>10)
+			}
+			b.Run(name, func(b *testing.B) {
+				benchmarkPump(b, newGorillaRelay(b, compress), payload, compress)
+			})
+		}
+	}
+}
+
+// frame is a WebSocket message relayed as it is, the way the x/net pump
+// forwarded them.
+type frame struct {
+	data        []byte
+	payloadType byte
+}
+
+var frameCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		f := v.(frame)
+		return f.data, f.payloadType, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		f := v.(*frame)
+		f.payloadType = payloadType
+		f.data = append(f.data[:0], data...)
+		return nil
+	},
+}
+
+// newXNetRelay starts an x/net echo server and a relay to it, returning the
+// relay's URL. The relay is a websocket.Server rather than a Handler so that
+// it accepts the agent's gorilla handshake, which sends no Origin.
+func newXNetRelay(b *testing.B) string {
+	echo := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		for {
+			var msg frame
+			if frameCodec.Receive(conn, &msg) != nil || frameCodec.Send(conn, msg) != nil {
+				return
+			}
+		}
+	}))
+	b.Cleanup(echo.Close)
+	relay := httptest.NewServer(websocket.Server{Handler: func(agent *websocket.Conn) {
+		defer agent.Close()
+		upstream, err := websocket.Dial("ws"+strings.TrimPrefix(echo.URL, "http"), "", "http://localhost")
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		copyFrames := func(dst, src *websocket.Conn) {
+			for {
+				var msg frame
+				if frameCodec.Receive(src, &msg) != nil || frameCodec.Send(dst, msg) != nil {
+					return
+				}
+			}
+		}
+		go copyFrames(agent, upstream)
+		copyFrames(upstream, agent)
+	}})
+	b.Cleanup(relay.Close)
+	return "ws" + strings.TrimPrefix(relay.URL, "http")
+}
+
+// newGorillaRelay starts a gorilla echo server and a relay to it, returning
+// the relay's URL.
+func newGorillaRelay(b *testing.B, compress bool) string {
+	echo := newGorillaEcho(compress)
+	b.Cleanup(echo.Close)
+	upgrader := gorilla.Upgrader{EnableCompression: compress}
+	dialer := gorilla.Dialer{EnableCompression: compress}
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agent, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer agent.Close()
+		upstream, _, err := dialer.Dial("ws"+strings.TrimPrefix(echo.URL, "http"), nil)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		copyMessages := func(dst, src *gorilla.Conn) {
+			for {
+				msgType, data, err := src.ReadMessage()
+				if err != nil || dst.WriteMessage(msgType, data) != nil {
+					return
+				}
+			}
+		}
+		go copyMessages(agent, upstream)
+		copyMessages(upstream, agent)
+	}))
+	b.Cleanup(relay.Close)
+	return "ws" + strings.TrimPrefix(relay.URL, "http")
+}
+
+// benchmarkPump sends payload through the relay at url and waits for it to
+// come back. The agent's side uses gorilla for both pumps, so that only the
+// relay differs. It sends each message in a single frame, because the x/net
+// codec does not reassemble fragmented messages.
+func benchmarkPump(b *testing.B, url string, payload []byte, compress bool) {
+	dialer := gorilla.Dialer{EnableCompression: compress, WriteBufferSize: len(payload)}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		b.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := conn.WriteMessage(gorilla.TextMessage, payload); err != nil {
+			b.Fatalf("send: %v", err)
+		}
+		_, reply, err := conn.ReadMessage()
+		if err != nil || !bytes.Equal(reply, payload) {
+			b.Fatalf("receive: %v", err)
+		}
+	}
+}
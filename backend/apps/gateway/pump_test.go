@@ -0,0 +1,80 @@
+package gateway_test
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gateway_app "mcpgo/backend/apps/gateway"
+
+	gorilla "github.com/gorilla/websocket"
+)
+
+func newGorillaEcho(compress bool) *httptest.Server {
+	upgrader := gorilla.Upgrader{EnableCompression: compress}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(msgType, data); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+// BenchmarkGatewayRoundTrip measures a message going through the gateway's
+// message pump, from the agent to an echo server and back, with and without
+// permessage-deflate on both connections.
+func BenchmarkGatewayRoundTrip(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10} {
+		payload := []byte(`{"jsonrpc":"2.0","method":"notifications/message","params":{"data":"` + strings.Repeat("x", size) + `"}}`)
+		for _, compress := range []bool{false, true} {
+			name := fmt.Sprintf("%dKiB", size>>10)
+			if compress {
+				name += "-deflate"
+			}
+			b.Run(name, func(b *testing.B) {
+				benchmarkGatewayRoundTrip(b, payload, compress)
+			})
+		}
+	}
+}
+
+func benchmarkGatewayRoundTrip(b *testing.B, payload []byte, compress bool) {
+	upstream := newGorillaEcho(compress)
+	defer upstream.Close()
+	app, err := gateway_app.NewApp("ws"+strings.TrimPrefix(upstream.URL, "http"), log.New(io.Discard, "", 0))
+	if err != nil {
+		b.Fatalf("failed to create app: %v", err)
+	}
+	dialer := gorilla.Dialer{EnableCompression: compress}
+	conn, _, err := dialer.Dial(newGateway(b, app)+"/mcp", nil)
+	if err != nil {
+		b.Fatalf("failed to dial gateway: %v", err)
+	}
+	defer conn.Close()
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := conn.WriteMessage(gorilla.TextMessage, payload); err != nil {
+			b.Fatalf("send: %v", err)
+		}
+		if _, _, err := conn.ReadMessage(); err != nil {
+			b.Fatalf("receive: %v", err)
+		}
+	}
+}
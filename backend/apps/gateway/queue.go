@@ -0,0 +1,209 @@
+package gateway
+
+import (
+	"bytes"
+	"slices"
+	"sync"
+
+	"mcpgo/backend/services/config"
+)
+
+const defaultQueueSize = 256
+
+// maxPooledBuffer bounds the read buffers kept for reuse, so that a single
+// large message does not pin its buffer.
+const maxPooledBuffer = 1 << 20
+
+// readBuffers are reused to read messages; every message is then copied
+// out at its exact size.
+var readBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// writeBuffers are shared by every connection for assembling frames.
+var writeBuffers = &sync.Pool{}
+
+func withMessageDefaults(cfg config.MessagesConfig) config.MessagesConfig {
+	if cfg.MaxAgentSize == 0 {
+		cfg.MaxAgentSize = defaultMaxMessageSize
+	}
+	if cfg.MaxUpstreamSize == 0 {
+		cfg.MaxUpstreamSize = defaultMaxMessageSize
+	}
+	if cfg.QueueSize == 0 {
+		cfg.QueueSize = defaultQueueSize
+	}
+	if cfg.QueuePolicy == "" {
+		cfg.QueuePolicy = config.QueuePolicyBlock
+	}
+	return cfg
+}
+
+func (a *App) messageSettings() config.MessagesConfig {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.messages
+}
+
+// pushResult is the outcome of sendQueue.push.
+type pushResult int
+
+const (
+	pushed pushResult = iota
+	// pushedOverLimit means the queue was full under the disconnect
+	// policy, or under the block policy for a pusher that cannot wait; the
+	// message was queued and the agent must be disconnected. It is reported
+	// once until the queue is below its limit again.
+	pushedOverLimit
+	// droppedNotification means a notification was discarded to make room,
+	// and startedDropping that this was the first since the queue was last
+	// below its limit.
+	droppedNotification
+	startedDropping
+	queueClosed
+)
+
+// sendQueue holds the messages waiting to be written to an agent. Any
+// number of goroutines push; a single goroutine pops.
+type sendQueue struct {
+	limit  int
+	policy string
+
+	mu          sync.Mutex
+	msgs        []rawMessage
+	closed      bool
+	dropping    bool
+	overflowing bool
+
+	// ready and space signal a pushed and a popped message; done is closed
+	// with the queue.
+	ready chan struct{}
+	space chan struct{}
+	done  chan struct{}
+}
+
+func newSendQueue(cfg config.MessagesConfig) *sendQueue {
+	return &sendQueue{
+		limit:  cfg.QueueSize,
+		policy: cfg.QueuePolicy,
+		ready:  make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push queues msg. When the queue is full the block policy waits for room,
+// drop_notifications discards the oldest queued notification, or msg when
+// it is one and none is queued, and disconnect queues msg regardless and
+// reports pushedOverLimit. A pusher that serves other agents too sets wait
+// to false; the block policy then acts as disconnect, since waiting for one
+// slow agent would hold up the others.
+func (q *sendQueue) push(msg rawMessage, wait bool) pushResult {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return queueClosed
+		}
+		if len(q.msgs) < q.limit {
+			q.dropping, q.overflowing = false, false
+			return q.append(msg, pushed)
+		}
+		policy := q.policy
+		if policy == config.QueuePolicyBlock && !wait {
+			policy = config.QueuePolicyDisconnect
+		}
+		switch policy {
+		case config.QueuePolicyDisconnect:
+			result := pushed
+			if !q.overflowing {
+				q.overflowing, result = true, pushedOverLimit
+			}
+			return q.append(msg, result)
+		case config.QueuePolicyDropNotifications:
+			drop := slices.IndexFunc(q.msgs, func(queued rawMessage) bool {
+				return isNotification(&queued)
+			})
+			if drop < 0 && !isNotification(&msg) {
+				break
+			}
+			result := droppedNotification
+			if !q.dropping {
+				q.dropping, result = true, startedDropping
+			}
+			if drop < 0 {
+				q.mu.Unlock()
+				return result
+			}
+			q.msgs = slices.Delete(q.msgs, drop, drop+1)
+			return q.append(msg, result)
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.space:
+		case <-q.done:
+		}
+	}
+}
+
+// append adds msg to the queue and wakes the popping goroutine, and another
+// pushing goroutine while there is room. The caller holds q.mu, which is
+// released.
+func (q *sendQueue) append(msg rawMessage, result pushResult) pushResult {
+	q.msgs = append(q.msgs, msg)
+	room := len(q.msgs) < q.limit
+	q.mu.Unlock()
+	signal(q.ready)
+	if room {
+		signal(q.space)
+	}
+	return result
+}
+
+// pop returns the next message, waiting for one. After the queue is closed
+// it returns the remaining messages, then false.
+func (q *sendQueue) pop() (rawMessage, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.msgs) > 0 {
+			msg := q.msgs[0]
+			q.msgs[0] = rawMessage{}
+			q.msgs = q.msgs[1:]
+			q.mu.Unlock()
+			signal(q.space)
+			return msg, true
+		}
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			return rawMessage{}, false
+		}
+		select {
+		case <-q.ready:
+		case <-q.done:
+		}
+	}
+}
+
+// close stops accepting messages and wakes blocked pushers.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+}
+
+func isNotification(msg *rawMessage) bool {
+	env, ok := peekEnvelope(msg)
+	return ok && env.Method != "" && len(env.ID) == 0
+}
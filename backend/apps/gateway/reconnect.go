@@ -0,0 +1,230 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/mcp"
+
+	"github.com/gorilla/websocket"
+)
+
+// CodeUpstreamUnavailable is the JSON-RPC error code returned for requests
+// that were lost because the upstream connection dropped. The error data
+// carries "retryable": true; the request can be sent again.
+const CodeUpstreamUnavailable = -32003
+
+const (
+	defaultReconnectAttempts = 10
+	defaultInitialBackoff    = 100 * time.Millisecond
+	defaultMaxBackoff        = 5 * time.Second
+)
+
+func withReconnectDefaults(cfg config.ReconnectConfig) config.ReconnectConfig {
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = defaultReconnectAttempts
+	}
+	if cfg.InitialBackoff.Duration == 0 {
+		cfg.InitialBackoff.Duration = defaultInitialBackoff
+	}
+	if cfg.MaxBackoff.Duration == 0 {
+		cfg.MaxBackoff.Duration = defaultMaxBackoff
+	}
+	if cfg.MaxBackoff.Duration < cfg.InitialBackoff.Duration {
+		cfg.MaxBackoff = cfg.InitialBackoff
+	}
+	return cfg
+}
+
+func upstreamUnavailable() *mcp.Message {
+	msg := mcp.NewError(nil, CodeUpstreamUnavailable, "upstream connection lost; retry the request")
+	msg.Error.Data = json.RawMessage(`{"retryable":true}`)
+	return msg
+}
+
+// handshake records the parts of a session's conversation that a new
+// upstream connection needs to see before it can serve the session: the
+// agent's initialize request, whether it completed the handshake and the
+// resources it subscribed to.
+type handshake struct {
+	mu            sync.Mutex
+	initialize    json.RawMessage
+	initialized   bool
+	subscriptions map[string]bool
+}
+
+// record inspects a message the agent sent upstream.
+func (h *handshake) record(msg *rawMessage) {
+	env, ok := peekEnvelope(msg)
+	if !ok {
+		return
+	}
+	switch env.Method {
+	case "initialize", "notifications/initialized", "resources/subscribe", "resources/unsubscribe":
+	default:
+		return
+	}
+	var body struct {
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.Unmarshal(msg.Data, &body); err != nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch env.Method {
+	case "initialize":
+		h.initialize = body.Params
+	case "notifications/initialized":
+		h.initialized = true
+	case "resources/subscribe", "resources/unsubscribe":
+		var params struct {
+			URI string `json:"uri"`
+		}
+		if json.Unmarshal(body.Params, &params) != nil || params.URI == "" {
+			return
+		}
+		if h.subscriptions == nil {
+			h.subscriptions = make(map[string]bool)
+		}
+		if env.Method == "resources/subscribe" {
+			h.subscriptions[params.URI] = true
+		} else {
+			delete(h.subscriptions, params.URI)
+		}
+	}
+}
+
+func (h *handshake) snapshot() (json.RawMessage, bool, []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subscriptions := make([]string, 0, len(h.subscriptions))
+	for uri := range h.subscriptions {
+		subscriptions = append(subscriptions, uri)
+	}
+	return h.initialize, h.initialized, subscriptions
+}
+
+// reconnect replaces a dropped upstream connection without disconnecting
+// the agent. Requests that were in flight fail with a retryable error, then
+// the upstream is redialled with exponential backoff and the recorded
+// handshake and subscriptions are replayed. It reports whether the session
+// can continue.
+func (s *session) reconnect(cause error) bool {
+	s.app.mu.RLock()
+	settings := s.app.reconnect
+	s.app.mu.RUnlock()
+	if settings.Disabled {
+		return false
+	}
+
+	s.upMu.Lock()
+	s.reconnecting = true
+	_ = s.upstream.Close()
+	s.upMu.Unlock()
+	s.guard.failAll(*upstreamUnavailable())
+	s.app.logger.Printf("warning: upstream %s connection lost, reconnecting: %v", s.up.id, cause)
+
+	backoff := settings.InitialBackoff.Duration
+	for attempt := 1; attempt <= settings.MaxAttempts; attempt++ {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+
+		conn, err := s.app.dialUpstream(s.ctx, s.up, s.endpoint, s.subproto)
+		if err == nil {
+			if err = s.replay(conn); err != nil {
+				_ = conn.Close()
+			}
+		}
+		if err == nil {
+			s.upMu.Lock()
+			s.upstream = conn
+			s.reconnecting = false
+			s.upMu.Unlock()
+			s.app.logger.Printf("upstream %s reconnected after %d attempt(s)", s.up.id, attempt)
+			return true
+		}
+		s.app.logger.Printf("warning: reconnect attempt %d/%d to upstream %s failed: %v", attempt, settings.MaxAttempts, s.up.id, err)
+
+		backoff *= 2
+		if backoff > settings.MaxBackoff.Duration {
+			backoff = settings.MaxBackoff.Duration
+		}
+	}
+	return false
+}
+
+// replay repeats the agent's handshake and subscriptions on a new upstream
+// connection. Their responses are consumed by the gateway; anything else the
+// upstream sends meanwhile is delivered to the agent.
+func (s *session) replay(conn *Conn) error {
+	initialize, initialized, subscriptions := s.handshake.snapshot()
+	if initialize == nil {
+		return nil
+	}
+	_ = conn.setDeadline(time.Now().Add(s.app.dialTimeout))
+	defer conn.setDeadline(time.Time{})
+
+	seq := 0
+	call := func(method string, params interface{}) error {
+		seq++
+		id := json.RawMessage(fmt.Sprintf(`"mcpgo-replay-%d"`, seq))
+		req, err := mcp.NewRequest(id, method, params)
+		if err != nil {
+			return err
+		}
+		if err := send(conn, req); err != nil {
+			return fmt.Errorf("replay %s: %w", method, err)
+		}
+		for {
+			msg, err := conn.receive()
+			if err != nil {
+				return fmt.Errorf("replay %s: %w", method, err)
+			}
+			var reply mcp.Message
+			if json.Unmarshal(msg.Data, &reply) == nil && reply.IsResponse() && string(reply.ID) == string(id) {
+				if reply.Error != nil {
+					return fmt.Errorf("replay %s: %w", method, reply.Error)
+				}
+				return nil
+			}
+			if !s.interceptRaw(&msg) && s.guard.complete(&msg) {
+				s.deliver(msg)
+			}
+		}
+	}
+
+	if err := call("initialize", initialize); err != nil {
+		return err
+	}
+	if initialized {
+		notification, _ := mcp.NewNotification("notifications/initialized", nil)
+		if err := send(conn, notification); err != nil {
+			return fmt.Errorf("replay notifications/initialized: %w", err)
+		}
+	}
+	for _, uri := range subscriptions {
+		if err := call("resources/subscribe", map[string]string{"uri": uri}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send writes a JSON-RPC message generated by the gateway to conn.
+func send(conn *Conn, msg *mcp.Message) error {
+	data, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	return conn.send(rawMessage{Data: data, Type: websocket.TextMessage})
+}
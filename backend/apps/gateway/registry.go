@@ -0,0 +1,433 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/mcp"
+)
+
+var (
+	// ErrServerNotFound is returned when no upstream server has the requested ID.
+	ErrServerNotFound = errors.New("upstream server not found")
+	// ErrServerExists is returned when adding a server whose ID is already taken.
+	ErrServerExists = errors.New("upstream server already exists")
+	// ErrServerDisabled is returned when a client is routed to a disabled server.
+	ErrServerDisabled = errors.New("upstream server is disabled")
+	// ErrNoUpstream is returned when no enabled upstream server is available.
+	ErrNoUpstream = errors.New("no upstream servers configured")
+	// ErrPolicyNotFound is returned when a server references an unknown policy.
+	ErrPolicyNotFound = errors.New("policy not found")
+)
+
+// ServerStatus describes the last observed state of an upstream server.
+type ServerStatus string
+
+// Possible upstream server states.
+const (
+	StatusUnknown  ServerStatus = "unknown"
+	StatusOnline   ServerStatus = "online"
+	StatusOffline  ServerStatus = "offline"
+	StatusDisabled ServerStatus = "disabled"
+)
+
+// ServerInfo is a point-in-time snapshot of an upstream server, combining its
+// configuration with what the gateway has learned about it.
+type ServerInfo struct {
+	ID              string              `json:"id"`
+	Name            string              `json:"name"`
+	Address         string              `json:"address"`
+	Protocol        string              `json:"protocol"`
+	Disabled        bool                `json:"disabled"`
+	Status          ServerStatus        `json:"status"`
+	ActiveSessions  int64               `json:"activeSessions"`
+	Stateless       bool                `json:"stateless,omitempty"`
+	Aggregate       []string            `json:"aggregate,omitempty"`
+	Endpoints       []EndpointInfo      `json:"endpoints,omitempty"`
+	PooledConns     int                 `json:"pooledConnections,omitempty"`
+	ProtocolVersion string              `json:"protocolVersion,omitempty"`
+	ServerInfo      *mcp.Implementation `json:"serverInfo,omitempty"`
+	Capabilities    json.RawMessage     `json:"capabilities,omitempty" swaggertype:"object"`
+	Tools           []mcp.Tool          `json:"tools,omitempty"`
+	LastError       string              `json:"lastError,omitempty"`
+	CheckedAt       *time.Time          `json:"checkedAt,omitempty"`
+	Cache           *CacheStats         `json:"cache,omitempty"`
+}
+
+// upstream tracks a configured upstream server and its observed state.
+type upstream struct {
+	// id is config.ID, which never changes for an upstream; unlike config
+	// it can be read without holding mu.
+	id     string
+	config config.ServerConfig
+	// balancer is nil for an aggregated server, which has no replicas of
+	// its own.
+	balancer *balancer
+	sessions atomic.Int64
+	limiter  *limiter
+
+	// ctx is cancelled once the upstream has been retired and drained.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	mu     sync.RWMutex
+	status ServerStatus
+	init   *mcp.InitializeResult
+	tools  []mcp.Tool
+	// seen holds the tool definitions of the tools/list results passed to
+	// agents, by name.
+	seen      map[string]mcp.Tool
+	lastError string
+	checkedAt time.Time
+
+	// pool multiplexes the sessions of a stateless server; it is created
+	// by the first session.
+	pool *pool
+
+	// cache holds the upstream's cached responses.
+	cache *responseCache
+
+	// lastGood holds the last successful results of read-only tools for
+	// failover.
+	lastGoodMu sync.Mutex
+	lastGood   map[string]json.RawMessage
+}
+
+func newUpstream(cfg config.ServerConfig) (*upstream, error) {
+	if cfg.ID == "" {
+		return nil, errors.New("server id is required")
+	}
+	if cfg.Address != "" && len(cfg.Endpoints) > 0 {
+		return nil, errors.New("address and endpoints cannot be combined")
+	}
+	var balancer *balancer
+	if len(cfg.Aggregate) > 0 {
+		if cfg.Address != "" || len(cfg.Endpoints) > 0 || cfg.Stateless {
+			return nil, errors.New("an aggregated server cannot have an address, endpoints or be stateless")
+		}
+	} else {
+		var err error
+		if balancer, err = newBalancer(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &upstream{
+		id:       cfg.ID,
+		config:   cfg,
+		balancer: balancer,
+		limiter:  newLimiter(),
+		cache:    newResponseCache(),
+		ctx:      ctx,
+		cancel:   cancel,
+		status:   StatusUnknown,
+	}, nil
+}
+
+func (u *upstream) info(withTools bool) ServerInfo {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	info := ServerInfo{
+		ID:             u.id,
+		Name:           u.config.Name,
+		Address:        u.config.Address,
+		Protocol:       u.config.Protocol,
+		Disabled:       u.config.Disabled,
+		Status:         u.status,
+		ActiveSessions: u.sessions.Load(),
+		Stateless:      u.config.Stateless,
+		Aggregate:      u.config.Aggregate,
+		LastError:      u.lastError,
+	}
+	if len(u.config.Endpoints) > 0 {
+		info.Endpoints = u.balancer.info()
+	}
+	if u.pool != nil {
+		info.PooledConns = u.pool.size()
+	}
+	if u.config.Disabled {
+		info.Status = StatusDisabled
+	}
+	if u.init != nil {
+		info.ProtocolVersion = u.init.ProtocolVersion
+		serverInfo := u.init.ServerInfo
+		info.ServerInfo = &serverInfo
+		info.Capabilities = u.init.Capabilities
+	}
+	if withTools {
+		info.Tools = append([]mcp.Tool(nil), u.tools...)
+	}
+	if !u.checkedAt.IsZero() {
+		checkedAt := u.checkedAt
+		info.CheckedAt = &checkedAt
+	}
+	if !u.config.Cache.Disabled {
+		stats := u.cache.snapshot()
+		info.Cache = &stats
+	}
+	return info
+}
+
+func (u *upstream) recordFailure(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.status = StatusOffline
+	u.lastError = err.Error()
+	u.checkedAt = time.Now()
+}
+
+// probe connects to the upstream, performs the MCP handshake and fetches the
+// tool catalog, recording the outcome. An aggregated server has no
+// connection of its own; its members are probed individually.
+func (u *upstream) probe(ctx context.Context, timeout time.Duration) error {
+	if u.balancer == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client, err := mcp.Dial(ctx, u.balancer.pick("").url.String(), timeout)
+	if err != nil {
+		u.recordFailure(err)
+		return err
+	}
+	defer client.Close()
+
+	init, err := client.Initialize(ctx)
+	if err != nil {
+		u.recordFailure(err)
+		return err
+	}
+	var tools []mcp.Tool
+	if hasCapability(init.Capabilities, "tools") {
+		if tools, err = client.ListTools(ctx); err != nil {
+			u.recordFailure(err)
+			return err
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.status = StatusOnline
+	u.init = init
+	u.tools = tools
+	u.lastError = ""
+	u.checkedAt = time.Now()
+	return nil
+}
+
+func hasCapability(capabilities json.RawMessage, name string) bool {
+	var caps map[string]json.RawMessage
+	if err := json.Unmarshal(capabilities, &caps); err != nil {
+		return false
+	}
+	_, ok := caps[name]
+	return ok
+}
+
+// route resolves the upstream a client should be proxied to.
+func (a *App) route(serverID string) (*upstream, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if serverID == "" {
+		for _, id := range a.order {
+			if up := a.servers[id]; !up.config.Disabled {
+				return up, nil
+			}
+		}
+		return nil, ErrNoUpstream
+	}
+	up, ok := a.servers[serverID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrServerNotFound, serverID)
+	}
+	if up.config.Disabled {
+		return nil, fmt.Errorf("%w: %s", ErrServerDisabled, serverID)
+	}
+	return up, nil
+}
+
+// Routable reports why a new session for serverID cannot be started, or nil
+// when it can. An empty serverID selects the default server.
+func (a *App) Routable(serverID string) error {
+	_, err := a.route(serverID)
+	return err
+}
+
+// Servers returns a snapshot of every registered upstream server in
+// configuration order.
+func (a *App) Servers() []ServerInfo {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	infos := make([]ServerInfo, 0, len(a.order))
+	for _, id := range a.order {
+		infos = append(infos, a.servers[id].info(false))
+	}
+	return infos
+}
+
+// Server returns a snapshot of a single upstream server including its tool
+// catalog.
+func (a *App) Server(id string) (ServerInfo, error) {
+	a.mu.RLock()
+	up, ok := a.servers[id]
+	a.mu.RUnlock()
+	if !ok {
+		return ServerInfo{}, fmt.Errorf("%w: %s", ErrServerNotFound, id)
+	}
+	return up.info(true), nil
+}
+
+// ServerConfigs returns the configuration of every registered server in
+// order, suitable for persisting.
+func (a *App) ServerConfigs() []config.ServerConfig {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	configs := make([]config.ServerConfig, 0, len(a.order))
+	for _, id := range a.order {
+		configs = append(configs, a.servers[id].config)
+	}
+	return configs
+}
+
+// ValidateServers checks servers the way loading a configuration file
+// listing them would, including their references to each other.
+func (a *App) ValidateServers(servers []config.ServerConfig) error {
+	a.mu.RLock()
+	cfg := config.Config{Servers: servers, Policies: a.policies}
+	a.mu.RUnlock()
+	return cfg.Validate()
+}
+
+// AddServer registers a new upstream server.
+func (a *App) AddServer(cfg config.ServerConfig) error {
+	up, err := newUpstream(cfg)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, exists := a.servers[cfg.ID]; exists {
+		return fmt.Errorf("%w: %s", ErrServerExists, cfg.ID)
+	}
+	if err := a.applyPolicy(up); err != nil {
+		return err
+	}
+	a.servers[cfg.ID] = up
+	a.order = append(a.order, cfg.ID)
+	return nil
+}
+
+// UpdateServer replaces the configuration of an existing upstream server.
+// New sessions use the updated configuration while sessions that are already
+// connected drain on the previous one.
+func (a *App) UpdateServer(id string, cfg config.ServerConfig) error {
+	if cfg.ID == "" {
+		cfg.ID = id
+	}
+	if cfg.ID != id {
+		return fmt.Errorf("server id %q cannot be changed to %q", id, cfg.ID)
+	}
+	up, err := newUpstream(cfg)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	previous, exists := a.servers[id]
+	if !exists {
+		a.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrServerNotFound, id)
+	}
+	if err := a.applyPolicy(up); err != nil {
+		a.mu.Unlock()
+		return err
+	}
+	a.servers[id] = up
+	a.mu.Unlock()
+
+	a.retire(previous)
+	return nil
+}
+
+// applyPolicy configures the per-server limits of up from its policy. The
+// caller must hold a.mu.
+func (a *App) applyPolicy(up *upstream) error {
+	name := up.config.Policy
+	policy, ok := a.policies[name]
+	if name != "" && !ok {
+		return fmt.Errorf("%w: %s", ErrPolicyNotFound, name)
+	}
+	up.limiter.update(policy.Limits)
+	return nil
+}
+
+// SetServerDisabled enables or disables an upstream server. Disabled servers
+// stop accepting new sessions.
+func (a *App) SetServerDisabled(id string, disabled bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	up, exists := a.servers[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrServerNotFound, id)
+	}
+	up.mu.Lock()
+	up.config.Disabled = disabled
+	up.mu.Unlock()
+	return nil
+}
+
+// RemoveServer unregisters an upstream server. Sessions that are already
+// connected drain until they finish or the drain timeout expires.
+func (a *App) RemoveServer(id string) error {
+	a.mu.Lock()
+	up, exists := a.servers[id]
+	if !exists {
+		a.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrServerNotFound, id)
+	}
+	delete(a.servers, id)
+	for i, existing := range a.order {
+		if existing == id {
+			a.order = append(a.order[:i:i], a.order[i+1:]...)
+			break
+		}
+	}
+	a.mu.Unlock()
+
+	a.retire(up)
+	return nil
+}
+
+// RefreshServer probes an upstream server for its status, capabilities and
+// tool catalog and returns the updated snapshot. A failed probe is not an
+// error; it is reflected in the returned status.
+func (a *App) RefreshServer(ctx context.Context, id string) (ServerInfo, error) {
+	a.mu.RLock()
+	up, ok := a.servers[id]
+	a.mu.RUnlock()
+	if !ok {
+		return ServerInfo{}, fmt.Errorf("%w: %s", ErrServerNotFound, id)
+	}
+	if err := up.probe(ctx, a.dialTimeout); err != nil {
+		a.logger.Printf("warning: probe of upstream %s failed: %v", id, err)
+	} else {
+		up.mu.RLock()
+		tools, _ := json.Marshal(up.tools)
+		up.mu.RUnlock()
+		a.pinTools(up, tools)
+	}
+	return up.info(true), nil
+}
@@ -0,0 +1,203 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/pinning"
+)
+
+// errServerRetired is the cause attached to sessions that are closed because
+// their upstream server was removed or replaced and the drain timeout passed.
+var errServerRetired = errors.New("upstream server was removed from the configuration")
+
+// Apply reconciles the running gateway with cfg. New servers become
+// available immediately, changed servers are replaced for new sessions and
+// servers that are no longer configured stop accepting sessions and drain.
+// Limits are updated in place. Either the whole change is applied or, when
+// any server definition is invalid, nothing is.
+func (a *App) Apply(cfg *config.Config) error {
+	next := make(map[string]*upstream, len(cfg.Servers))
+	order := make([]string, 0, len(cfg.Servers))
+	// Servers whose changes can be made in place keep their upstream so
+	// connected sessions are not drained.
+	inPlace := make(map[string]config.ServerConfig)
+
+	a.mu.RLock()
+	for _, serverCfg := range cfg.Servers {
+		if _, dup := next[serverCfg.ID]; dup {
+			a.mu.RUnlock()
+			return fmt.Errorf("%w: %s", ErrServerExists, serverCfg.ID)
+		}
+		if serverCfg.Policy != "" {
+			if _, ok := cfg.Policies[serverCfg.Policy]; !ok {
+				a.mu.RUnlock()
+				return fmt.Errorf("server %q: %w: %s", serverCfg.ID, ErrPolicyNotFound, serverCfg.Policy)
+			}
+		}
+		if current, ok := a.servers[serverCfg.ID]; ok && sameEndpoint(current.config, serverCfg) {
+			next[serverCfg.ID] = current
+			inPlace[serverCfg.ID] = serverCfg
+		} else {
+			up, err := newUpstream(serverCfg)
+			if err != nil {
+				a.mu.RUnlock()
+				return fmt.Errorf("server %q: %w", serverCfg.ID, err)
+			}
+			next[serverCfg.ID] = up
+		}
+		order = append(order, serverCfg.ID)
+	}
+	pins := a.pins
+	a.mu.RUnlock()
+	if cfg.Pinning.Lockfile == "" {
+		pins = nil
+	} else if pins == nil || pins.Path() != cfg.Pinning.Lockfile {
+		var err error
+		if pins, err = pinning.Open(cfg.Pinning.Lockfile); err != nil {
+			return fmt.Errorf("pinning: %w", err)
+		}
+	}
+
+	a.mu.Lock()
+	var added, updated, removed []string
+	var retired []*upstream
+	for _, id := range order {
+		current, existed := a.servers[id]
+		switch {
+		case !existed:
+			added = append(added, id)
+		case current != next[id]:
+			updated = append(updated, id)
+			retired = append(retired, current)
+		}
+	}
+	for _, id := range a.order {
+		if _, kept := next[id]; !kept {
+			removed = append(removed, id)
+			retired = append(retired, a.servers[id])
+		}
+	}
+	for id, serverCfg := range inPlace {
+		up := next[id]
+		if !reflect.DeepEqual(up.config, serverCfg) {
+			up.mu.Lock()
+			up.config = serverCfg
+			up.mu.Unlock()
+			updated = append(updated, id)
+		}
+	}
+	a.servers = next
+	a.order = order
+	a.policies = cfg.Policies
+	a.pins, a.pinOnChange = pins, cfg.Pinning.OnChange
+	a.drainTimeout = cfg.Reload.DrainTimeout.Duration
+	a.shutdownTimeout = cfg.Shutdown.DrainTimeout.Duration
+	if a.shutdownTimeout == 0 {
+		a.shutdownTimeout = defaultShutdownDrainTimeout
+	}
+	a.resumeGrace = cfg.Sessions.ResumeGrace.Duration
+	a.resumeBuffer = cfg.Sessions.ResumeBuffer
+	if a.resumeBuffer == 0 {
+		a.resumeBuffer = defaultResumeBuffer
+	}
+	a.reconnect = withReconnectDefaults(cfg.Sessions.Reconnect)
+	a.agent = withAgentDefaults(cfg.Agent.WS)
+	a.messages = withMessageDefaults(cfg.Sessions.Messages)
+	a.cursorKey = a.randomCursorKey
+	if secret := cfg.Routing.CursorSecret; secret != "" {
+		a.cursorKey = []byte(secret)
+	}
+	for _, up := range next {
+		up.limiter.update(a.policies[up.config.Policy].Limits)
+	}
+	a.mu.Unlock()
+
+	a.limiter.update(cfg.Limits)
+	for _, up := range retired {
+		a.retire(up)
+	}
+	if len(added)+len(updated)+len(removed) > 0 {
+		a.logger.Printf("applied server changes: added %v, updated %v, removed %v", added, updated, removed)
+	}
+	return nil
+}
+
+// sameEndpoint reports whether two server definitions differ at most in
+// settings that can be changed without reconnecting: whether the server is
+// disabled, which policy it uses, its request timeout and its failover,
+// tool, expose, validation, pinning, approval, cache and server request
+// settings.
+func sameEndpoint(a, b config.ServerConfig) bool {
+	a.Disabled, b.Disabled = false, false
+	a.Policy, b.Policy = "", ""
+	a.RequestTimeout, b.RequestTimeout = config.Duration{}, config.Duration{}
+	a.Failover, b.Failover = config.FailoverConfig{}, config.FailoverConfig{}
+	a.Tools, b.Tools = nil, nil
+	a.Expose, b.Expose = config.ExposeConfig{}, config.ExposeConfig{}
+	a.Validation, b.Validation = config.ValidationConfig{}, config.ValidationConfig{}
+	a.Pinning, b.Pinning = config.ServerPinningConfig{}, config.ServerPinningConfig{}
+	a.Approval, b.Approval = config.ApprovalConfig{}, config.ApprovalConfig{}
+	a.Cache, b.Cache = config.CacheConfig{}, config.CacheConfig{}
+	a.ServerRequests, b.ServerRequests = config.ServerRequestsConfig{}, config.ServerRequestsConfig{}
+	return reflect.DeepEqual(a, b)
+}
+
+// retire drains an upstream that is no longer registered. Its sessions keep
+// running until they end on their own or the drain timeout expires, at which
+// point they are closed.
+func (a *App) retire(up *upstream) {
+	a.mu.RLock()
+	timeout := a.drainTimeout
+	a.mu.RUnlock()
+
+	if up.sessions.Load() == 0 {
+		up.cancel(errServerRetired)
+		return
+	}
+	a.logger.Printf("draining %d session(s) on upstream %s", up.sessions.Load(), up.id)
+
+	go func() {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		var deadline <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		for {
+			select {
+			case <-ticker.C:
+				if up.sessions.Load() == 0 {
+					up.cancel(errServerRetired)
+					a.logger.Printf("upstream %s drained", up.id)
+					return
+				}
+			case <-deadline:
+				a.logger.Printf("warning: drain timeout for upstream %s expired, closing %d session(s)", up.id, up.sessions.Load())
+				up.cancel(errServerRetired)
+				return
+			case <-up.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// sessionContext derives the context of a session on up, which is cancelled
+// when either the client goes away or the upstream is retired.
+func (up *upstream) sessionContext(parent context.Context) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	stop := context.AfterFunc(up.ctx, func() {
+		cancel(context.Cause(up.ctx))
+	})
+	return ctx, func(cause error) {
+		stop()
+		cancel(cause)
+	}
+}
@@ -0,0 +1,182 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"mcpgo/backend/services/mcp"
+)
+
+// clientCapabilities maps the requests a server can send to an agent to
+// the client capability the agent must have declared for them.
+var clientCapabilities = map[string]string{
+	"sampling/createMessage": "sampling",
+	"elicitation/create":     "elicitation",
+	"roots/list":             "roots",
+}
+
+// serverRequest is a request an upstream sent to the agent; reply passes
+// the agent's response, with the upstream's id restored, back to it.
+type serverRequest struct {
+	method string
+	reply  func(*mcp.Message)
+}
+
+// restrictServerRequest applies u's server request settings to a request u
+// sent to an agent: a blocked method is answered with an error, returned,
+// and the maxTokens of sampling requests is capped.
+func (u *upstream) restrictServerRequest(m *mcp.Message) *mcp.Message {
+	u.mu.RLock()
+	cfg := u.config.ServerRequests
+	u.mu.RUnlock()
+	if slices.Contains(cfg.Block, m.Method) {
+		return mcp.NewError(m.ID, mcp.CodeInvalidRequest, fmt.Sprintf("%s is blocked by the gateway for server %s", m.Method, u.id))
+	}
+	if m.Method != "sampling/createMessage" || cfg.MaxTokens <= 0 {
+		return nil
+	}
+	var params struct {
+		MaxTokens int `json:"maxTokens"`
+	}
+	if json.Unmarshal(m.Params, &params) == nil && (params.MaxTokens <= 0 || params.MaxTokens > cfg.MaxTokens) {
+		m.Params = setParam(m.Params, "maxTokens", json.RawMessage(strconv.Itoa(cfg.MaxTokens)))
+	}
+	return nil
+}
+
+// screenServerRequest applies the policies of origin and, for an
+// aggregated server, of the session's own server to a request origin sent
+// to the agent. It returns the answer to a refused request or an error for
+// a capability the agent did not declare. Elicitation is declined for
+// agents on revisions that predate it.
+func (s *session) screenServerRequest(origin *upstream, m *mcp.Message) *mcp.Message {
+	policies := []*upstream{origin}
+	if origin != s.up {
+		policies = append(policies, s.up)
+	}
+	for _, up := range policies {
+		if refusal := up.restrictServerRequest(m); refusal != nil {
+			return refusal
+		}
+	}
+	if m.Method == "elicitation/create" && s.agentRevision() < revisionStructured {
+		decline, _ := mcp.NewResult(m.ID, map[string]string{"action": "decline"})
+		return decline
+	}
+	if capability, ok := clientCapabilities[m.Method]; ok && !s.agentHas(capability) {
+		return mcp.NewError(m.ID, mcp.CodeMethodNotFound, fmt.Sprintf("the agent does not support %s", capability))
+	}
+	return nil
+}
+
+// serverRequest passes a request that origin sent to the session's agent
+// on a connection it shares, under an id of the gateway's so that requests
+// of several upstream connections cannot collide. A refused request is
+// answered through reply without reaching the agent.
+func (s *session) serverRequest(origin *upstream, m *mcp.Message, reply func(*mcp.Message)) {
+	if m.Method == "ping" {
+		pong, _ := mcp.NewResult(m.ID, struct{}{})
+		reply(pong)
+		return
+	}
+	if refusal := s.screenServerRequest(origin, m); refusal != nil {
+		reply(refusal)
+		return
+	}
+
+	upstreamID := m.ID
+	id := s.registerServerRequest(serverRequest{
+		method: m.Method,
+		reply: func(answer *mcp.Message) {
+			answer.ID = upstreamID
+			reply(answer)
+		},
+	})
+	m.ID = json.RawMessage(id)
+	_ = s.deliverMessage(m)
+}
+
+// registerServerRequest records req, sent to the agent under the id of the
+// gateway's it returns, until the agent answers it.
+func (s *session) registerServerRequest(req serverRequest) string {
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	if s.serverRequests == nil {
+		s.serverRequests = make(map[string]serverRequest)
+	}
+	s.nextServerRequest++
+	id := strconv.Quote("mcpgo-" + strconv.FormatInt(s.nextServerRequest, 10))
+	s.serverRequests[id] = req
+	return id
+}
+
+// agentHas reports whether the agent declared capability when it
+// initialized the session.
+func (s *session) agentHas(capability string) bool {
+	initialize, _, _ := s.handshake.snapshot()
+	var params struct {
+		Capabilities json.RawMessage `json:"capabilities"`
+	}
+	return json.Unmarshal(initialize, &params) == nil && hasCapability(params.Capabilities, capability)
+}
+
+// answerServerRequest passes the agent's response to a request an upstream
+// sent it back to that upstream, reporting whether msg was such a response.
+func (s *session) answerServerRequest(msg *rawMessage) bool {
+	env, ok := peekEnvelope(msg)
+	if !ok || env.Method != "" || len(env.ID) == 0 {
+		return false
+	}
+	s.callsMu.Lock()
+	req, ok := s.serverRequests[string(env.ID)]
+	delete(s.serverRequests, string(env.ID))
+	s.callsMu.Unlock()
+	if !ok {
+		return false
+	}
+	var answer mcp.Message
+	if json.Unmarshal(msg.Data, &answer) != nil {
+		answer = *mcp.NewError(nil, mcp.CodeInternalError, fmt.Sprintf("invalid response to %s from the agent", req.method))
+	}
+	req.reply(&answer)
+	return true
+}
+
+// abandonServerRequests answers the requests the agent left unanswered
+// when the session closes, so that the upstreams do not wait for them.
+func (s *session) abandonServerRequests() {
+	s.callsMu.Lock()
+	pending := s.serverRequests
+	s.serverRequests = nil
+	s.callsMu.Unlock()
+	for _, req := range pending {
+		req.reply(mcp.NewError(nil, mcp.CodeInternalError, "the agent's session closed"))
+	}
+}
+
+// screenRaw applies the server request policies to a message read from
+// the session's own upstream connection conn, reporting whether it was
+// handled. The connection serves only this agent, so requests keep their
+// ids and the agent's responses are forwarded as they are; a refused
+// request is answered on conn and a rewritten one delivered re-encoded.
+func (s *session) screenRaw(conn *Conn, msg *rawMessage) bool {
+	env, ok := peekEnvelope(msg)
+	if !ok || len(env.ID) == 0 {
+		return false
+	}
+	if _, ok := clientCapabilities[env.Method]; !ok {
+		return false
+	}
+	var m mcp.Message
+	if json.Unmarshal(msg.Data, &m) != nil {
+		return false
+	}
+	if refusal := s.screenServerRequest(s.up, &m); refusal != nil {
+		_ = send(conn, refusal)
+		return true
+	}
+	_ = s.deliverMessage(&m)
+	return true
+}
@@ -0,0 +1,610 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/mcp"
+
+	"github.com/gorilla/websocket"
+)
+
+// ResumeTokenHeader carries the resume token the gateway issues when an
+// agent connects; an agent presents it on a new connection to resume its
+// session.
+const ResumeTokenHeader = "Mcp-Resume-Token"
+
+// defaultResumeBuffer bounds the messages kept for a disconnected agent when
+// the configuration does not say otherwise.
+const defaultResumeBuffer = 1000
+
+var (
+	// ErrSessionNotFound is returned when a resume token does not belong to
+	// a session that can still be resumed.
+	ErrSessionNotFound = errors.New("session not found or expired")
+
+	errResumeExpired = errors.New("agent did not resume the session in time")
+)
+
+// session is an MCP session between an agent and an upstream server. When
+// resumption is enabled it outlives the agent's connection: the upstream
+// connection is kept for the resume grace period and upstream messages that
+// could not be delivered are buffered until the agent reattaches.
+type session struct {
+	app       *App
+	up        *upstream
+	endpoint  *endpoint
+	id        string
+	startedAt time.Time
+	token     string
+	subproto  string
+	guard     *sessionGuard
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+
+	// upMu guards the upstream connection, which is replaced when the
+	// session reconnects.
+	upMu         sync.Mutex
+	upstream     *Conn
+	reconnecting bool
+
+	// handshake records what is replayed to a new upstream connection.
+	handshake handshake
+
+	// versions are the protocol revisions negotiated with each side.
+	versions negotiation
+
+	// caller is the request of the agent's latest connection, which
+	// argument templates draw on.
+	caller atomic.Pointer[http.Request]
+
+	// pool is set for sessions of a stateless server, which have no
+	// upstream connection of their own, and agg for sessions of an
+	// aggregated server, which have one per member.
+	pool *pool
+	agg  *aggregate
+
+	// calls are the tools/call requests watched for failover, by id,
+	// failovers cancel the failovers in progress, cacheable are the
+	// requests whose responses are to be cached, listed the list requests
+	// whose results the catalog filters, outputs the calls whose results
+	// are validated, held the calls awaiting approval and serverRequests
+	// the requests awaiting the agent's response, by the id the agent
+	// sees.
+	callsMu           sync.Mutex
+	calls             map[string]*toolCall
+	failovers         map[string]context.CancelFunc
+	cacheable         map[string]cacheRequest
+	listed            map[string]string
+	outputs           map[string]toolOutput
+	held              map[string]context.CancelFunc
+	serverRequests    map[string]serverRequest
+	nextServerRequest int64
+
+	// lifetime ends the session when it reaches the maximum lifetime.
+	lifetime *time.Timer
+
+	// queue holds the messages for the agent until writeClient sends them;
+	// written is closed when it returns.
+	queue   *sendQueue
+	written chan struct{}
+
+	mu           sync.Mutex
+	client       *Conn
+	writeTimeout time.Duration
+	detached     chan struct{}
+	backlog      []rawMessage
+	dropped      int
+	expiry       *time.Timer
+	closed       bool
+}
+
+// newSession wraps an upstream connection established to the replica ep,
+// the member connections of an aggregated server in agg, or joins the
+// upstream's connection pool when neither is given. The session stays on
+// its replica when it reconnects. token is empty when resumption is
+// disabled.
+func (a *App) newSession(ctx context.Context, up *upstream, ep *endpoint, upstreamConn *Conn, subproto, token string, agg *aggregate) *session {
+	s := &session{
+		app:       a,
+		up:        up,
+		endpoint:  ep,
+		id:        strconv.FormatInt(a.sessionIDs.Add(1), 10),
+		startedAt: time.Now(),
+		token:     token,
+		subproto:  subproto,
+		upstream:  upstreamConn,
+	}
+	s.ctx, s.cancel = up.sessionContext(ctx)
+	s.guard = newSessionGuard(s.replyToAgent, a.limiter, up.limiter)
+	s.queue = newSendQueue(a.messageSettings())
+	s.written = make(chan struct{})
+	go s.writeClient()
+	up.sessions.Add(1)
+	if ep != nil {
+		ep.active.Add(1)
+	}
+
+	// A session started while Shutdown begins is closed right away.
+	a.sessionsMu.Lock()
+	a.live[s] = struct{}{}
+	if token != "" {
+		a.sessions[token] = s
+	}
+	stopping := a.stopping.Load()
+	a.sessionsMu.Unlock()
+	switch {
+	case agg != nil:
+		s.agg = agg
+		agg.start(s)
+	case upstreamConn == nil:
+		s.pool = a.connectionPool(up)
+		s.pool.addSession(s)
+	}
+	if maxLifetime := a.agentSettings().MaxLifetime.Duration; maxLifetime > 0 {
+		s.lifetime = time.AfterFunc(maxLifetime, func() {
+			s.cancel(errSessionLifetime)
+		})
+	}
+	context.AfterFunc(s.ctx, func() {
+		s.close(context.Cause(s.ctx))
+	})
+	if stopping {
+		s.cancel(ErrShuttingDown)
+	}
+	if s.pool == nil && s.agg == nil {
+		go s.readUpstream()
+	}
+	return s
+}
+
+// NewResumeToken returns a fresh resume token for a session that is about to
+// start, or an empty string when session resumption is disabled.
+func (a *App) NewResumeToken() string {
+	a.mu.RLock()
+	grace := a.resumeGrace
+	a.mu.RUnlock()
+	if grace <= 0 {
+		return ""
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// CanResume reports whether token identifies a session that is waiting to
+// be resumed.
+func (a *App) CanResume(token string) bool {
+	a.sessionsMu.Lock()
+	defer a.sessionsMu.Unlock()
+	_, ok := a.sessions[token]
+	return ok
+}
+
+// ResumeSession reattaches clientConn to the session identified by token,
+// replays the upstream messages the agent missed and proxies traffic until
+// the agent disconnects again.
+func (a *App) ResumeSession(ctx context.Context, token string, clientConn *Conn) error {
+	if clientConn == nil {
+		return errors.New("client connection is nil")
+	}
+	if a.stopping.Load() {
+		_ = clientConn.closeWith(closeStatus(ErrShuttingDown))
+		return ErrShuttingDown
+	}
+	a.sessionsMu.Lock()
+	s, ok := a.sessions[token]
+	a.sessionsMu.Unlock()
+	if !ok {
+		_ = clientConn.Close()
+		return ErrSessionNotFound
+	}
+	a.logger.Printf("Resuming session on upstream %s", s.up.id)
+	return s.serve(clientConn)
+}
+
+// serve attaches clientConn and forwards its messages upstream until it
+// disconnects or the session ends. The deadlines the HTTP server set on the
+// connection are replaced by the agent connection settings, and the agent
+// is pinged to keep the connection alive.
+func (s *session) serve(clientConn *Conn) error {
+	settings := s.app.agentSettings()
+	_ = clientConn.setDeadline(time.Time{})
+	detached, err := s.attach(clientConn, settings.WriteTimeout.Duration)
+	if err != nil {
+		_ = clientConn.Close()
+		return err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if settings.PingInterval.Duration > 0 {
+		go s.keepAlive(clientConn, settings.PingInterval.Duration, stop)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.readClient(clientConn, settings)
+	}()
+
+	select {
+	case <-s.ctx.Done():
+		_ = clientConn.closeWith(closeStatus(context.Cause(s.ctx)))
+		if err := context.Cause(s.ctx); !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) {
+			return err
+		}
+		return nil
+	case <-detached:
+		// Another connection resumed the session.
+		return nil
+	case err := <-errCh:
+		s.detach(clientConn, err)
+		if s.token == "" {
+			s.cancel(err)
+		}
+		if errors.Is(err, io.EOF) || s.token != "" {
+			return nil
+		}
+		return err
+	}
+}
+
+// attach makes clientConn the session's agent connection, replacing any
+// previous one, and replays the buffered messages. Every write to the agent
+// must complete within writeTimeout.
+func (s *session) attach(clientConn *Conn, writeTimeout time.Duration) (<-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrSessionNotFound
+	}
+	if s.client != nil {
+		_ = s.client.Close()
+		close(s.detached)
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	s.client = clientConn
+	s.caller.Store(clientConn.Request())
+	s.writeTimeout = writeTimeout
+	s.detached = make(chan struct{})
+
+	if s.dropped > 0 {
+		s.app.logger.Printf("warning: %d buffered message(s) for a resumed session on upstream %s were dropped", s.dropped, s.up.id)
+		s.dropped = 0
+	}
+	for i, msg := range s.backlog {
+		if err := s.sendClient(msg); err != nil {
+			s.backlog = s.backlog[i:]
+			return s.detached, nil
+		}
+	}
+	s.backlog = nil
+	return s.detached, nil
+}
+
+// detach forgets clientConn after reading from it failed with cause and,
+// when resumption is enabled, starts the grace period after which the
+// session is closed.
+func (s *session) detach(clientConn *Conn, cause error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != clientConn {
+		return
+	}
+	_ = clientConn.closeWith(closeStatus(cause))
+	s.client = nil
+	if s.closed || s.token == "" {
+		return
+	}
+
+	s.app.mu.RLock()
+	grace := s.app.resumeGrace
+	s.app.mu.RUnlock()
+	s.expiry = time.AfterFunc(grace, func() {
+		s.cancel(errResumeExpired)
+	})
+}
+
+// readClient forwards the agent's messages upstream until its connection
+// fails or stays idle for too long.
+func (s *session) readClient(clientConn *Conn, settings config.AgentWSConfig) error {
+	initialize, _, _ := s.handshake.snapshot()
+	first := initialize == nil
+	for {
+		msg, err := s.receiveClient(clientConn, settings, first)
+		if err != nil {
+			return fmt.Errorf("client->upstream receive: %w", err)
+		}
+		first = false
+		for _, part := range s.splitAgentBatch(msg) {
+			s.handleClient(clientConn, part)
+		}
+	}
+}
+
+// handleClient answers a message from the agent in the gateway or forwards
+// it upstream.
+func (s *session) handleClient(clientConn *Conn, msg rawMessage) {
+	if s.answerServerRequest(&msg) {
+		return
+	}
+	s.negotiateRequest(&msg)
+	if s.screenCatalog(&msg) || s.refuseChangedTool(&msg) || s.applyArguments(&msg) || s.validateCall(&msg) || s.holdForApproval(clientConn, &msg) {
+		return
+	}
+	s.forwardClient(clientConn, msg)
+}
+
+// forwardClient forwards a message from the agent upstream unless the
+// gateway answers it from the cache or refuses it.
+func (s *session) forwardClient(clientConn *Conn, msg rawMessage) {
+	if s.refuseWhileStopping(&msg) || s.answerFromCache(clientConn, &msg) || !s.guard.admit(&msg) {
+		return
+	}
+	s.handshake.record(&msg)
+	s.watchToolCall(&msg)
+	s.startDeadline(&msg)
+	s.agentCancelled(&msg)
+	s.sendUpstream(msg)
+}
+
+// sendUpstream forwards msg on the current upstream connection. Requests
+// sent while the session is reconnecting fail with a retryable error. A
+// failed write is left to readUpstream, which notices the broken connection.
+// upMu is not held while writing, so that a blocked write cannot keep
+// readUpstream from draining the upstream.
+func (s *session) sendUpstream(msg rawMessage) {
+	switch {
+	case s.pool != nil:
+		s.pool.forward(s, msg)
+		return
+	case s.agg != nil:
+		s.agg.forward(msg)
+		return
+	}
+	conn, ok := s.writableUpstream()
+	if !ok {
+		if env, ok := peekEnvelope(&msg); ok && env.Method != "" && len(env.ID) > 0 {
+			s.guard.fail(env.ID, upstreamUnavailable())
+		}
+		return
+	}
+	_ = conn.send(msg)
+}
+
+// writableUpstream returns the upstream connection unless the session is
+// reconnecting.
+func (s *session) writableUpstream() (*Conn, bool) {
+	s.upMu.Lock()
+	defer s.upMu.Unlock()
+	return s.upstream, !s.reconnecting
+}
+
+func (s *session) currentUpstream() *Conn {
+	s.upMu.Lock()
+	defer s.upMu.Unlock()
+	return s.upstream
+}
+
+// readUpstream forwards upstream messages to the agent for the lifetime of
+// the session, reconnecting when the upstream connection drops.
+func (s *session) readUpstream() {
+	for {
+		conn := s.currentUpstream()
+		msg, err := conn.receive()
+		if err != nil {
+			err = fmt.Errorf("upstream->client receive: %w: %w", errUpstreamLost, err)
+			if s.ctx.Err() != nil || !s.reconnect(err) {
+				s.cancel(err)
+				return
+			}
+			continue
+		}
+		// Servers on revisions before 2025-06-18 may send batches.
+		parts, _ := splitBatch(msg)
+		for _, part := range parts {
+			s.handleUpstream(conn, part)
+		}
+	}
+}
+
+// handleUpstream passes a message from the upstream connection conn on to
+// the agent.
+func (s *session) handleUpstream(conn *Conn, msg rawMessage) {
+	s.up.invalidateCache(&msg)
+	if s.screenRaw(conn, &msg) || s.interceptRaw(&msg) {
+		return
+	}
+	if s.guard.complete(&msg) {
+		s.cacheReply(&msg)
+		s.deliver(msg)
+	}
+}
+
+// replyToAgent delivers an error the gateway produced for a request, unless
+// the request is a tool call that fails over instead.
+func (s *session) replyToAgent(msg *mcp.Message) error {
+	if s.interceptReply(msg) {
+		return nil
+	}
+	return s.deliverMessage(msg)
+}
+
+func (s *session) deliverMessage(msg *mcp.Message) error {
+	data, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	s.deliver(rawMessage{Data: data, Type: websocket.TextMessage})
+	return nil
+}
+
+// respond delivers a response produced on the agent's behalf, releasing the
+// capacity its request held.
+func (s *session) respond(reply *mcp.Message) {
+	if s.interceptReply(reply) {
+		return
+	}
+	data, err := encodeMessage(reply)
+	if err != nil {
+		return
+	}
+	msg := rawMessage{Data: data, Type: websocket.TextMessage}
+	if s.guard.complete(&msg) {
+		s.cacheReply(&msg)
+		s.deliver(msg)
+	}
+}
+
+// deliver queues msg for the agent, validated, filtered by the server's
+// catalog and translated to the agent's protocol revision, applying the
+// queue policy when the agent does not keep up. Responses to the agent's
+// batches are queued once the batch is answered. Sessions of a stateless
+// server share their upstream connection's reader, so their messages are
+// delivered as by deliverShared.
+func (s *session) deliver(msg rawMessage) {
+	s.enqueue(msg, s.pool == nil)
+}
+
+// deliverShared is deliver for goroutines that serve other sessions too:
+// it never waits for the agent to make room, disconnecting it instead.
+func (s *session) deliverShared(msg rawMessage) {
+	s.enqueue(msg, false)
+}
+
+func (s *session) enqueue(msg rawMessage, wait bool) {
+	msg, ok := s.collectBatch(s.translate(s.filterCatalog(s.validateResult(msg))))
+	if !ok {
+		return
+	}
+	switch s.queue.push(msg, wait) {
+	case pushedOverLimit:
+		s.mu.Lock()
+		client := s.client
+		s.mu.Unlock()
+		if client != nil {
+			s.app.logger.Printf("warning: disconnecting the agent of a session on upstream %s: it is not reading its messages", s.up.id)
+			// Sending the close frame waits for the agent as well.
+			go func() { _ = client.closeWith(websocket.ClosePolicyViolation, "send queue full") }()
+		}
+	case startedDropping:
+		s.app.logger.Printf("warning: dropping notifications for a slow agent on upstream %s", s.up.id)
+	}
+}
+
+// writeClient sends the queued messages to the agent until the session is
+// closed, buffering them while no agent is attached.
+func (s *session) writeClient() {
+	defer close(s.written)
+	for {
+		msg, ok := s.queue.pop()
+		if !ok {
+			return
+		}
+		s.mu.Lock()
+		s.write(msg)
+		s.mu.Unlock()
+	}
+}
+
+// write sends msg to the attached agent, or buffers it for a resumed
+// connection. The caller holds s.mu.
+func (s *session) write(msg rawMessage) {
+	if s.client != nil {
+		if err := s.sendClient(msg); err == nil {
+			return
+		}
+		// The agent's connection is gone; closing it makes its read loop
+		// detach it.
+		_ = s.client.Close()
+	}
+	if s.token == "" || s.closed {
+		return
+	}
+	s.backlog = append(s.backlog, msg)
+
+	s.app.mu.RLock()
+	limit := s.app.resumeBuffer
+	s.app.mu.RUnlock()
+	if over := len(s.backlog) - limit; over > 0 {
+		s.backlog = append(s.backlog[:0], s.backlog[over:]...)
+		s.dropped += over
+	}
+}
+
+// sendClient writes msg to the attached agent connection within the write
+// timeout. The caller holds s.mu.
+func (s *session) sendClient(msg rawMessage) error {
+	return s.client.sendWithin(msg, s.writeTimeout)
+}
+
+// close ends the session, closing both connections and releasing the
+// capacity held by unanswered requests. A close code one side sent is
+// forwarded to the other.
+func (s *session) close(cause error) {
+	// Messages already queued, such as the last responses of an upstream
+	// that closed its connection, are still sent.
+	s.queue.close()
+	<-s.written
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	if s.client != nil {
+		_ = s.client.closeWith(closeStatus(cause))
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	if s.lifetime != nil {
+		s.lifetime.Stop()
+	}
+	s.backlog = nil
+	s.mu.Unlock()
+
+	if s.token != "" {
+		s.app.sessionsMu.Lock()
+		delete(s.app.sessions, s.token)
+		s.app.sessionsMu.Unlock()
+	}
+	if errors.Is(cause, errResumeExpired) || errors.Is(cause, errSessionLifetime) {
+		s.app.logger.Printf("session on upstream %s closed: %v", s.up.id, cause)
+	}
+	s.cancel(cause)
+	s.abandonServerRequests()
+	switch {
+	case s.pool != nil:
+		s.pool.removeSession(s)
+	case s.agg != nil:
+		s.agg.close(cause)
+	default:
+		_ = s.currentUpstream().closeWith(closeStatus(cause))
+	}
+	s.guard.close()
+	s.up.sessions.Add(-1)
+	if s.endpoint != nil {
+		s.endpoint.active.Add(-1)
+	}
+
+	s.app.sessionsMu.Lock()
+	delete(s.app.live, s)
+	s.app.sessionsMu.Unlock()
+}
@@ -0,0 +1,120 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"mcpgo/backend/services/mcp"
+)
+
+// defaultShutdownDrainTimeout bounds how long Shutdown waits for requests
+// in flight unless configured otherwise.
+const defaultShutdownDrainTimeout = 30 * time.Second
+
+// ErrShuttingDown is returned for sessions started after Shutdown was
+// called. It is also the cause of the sessions Shutdown closes, which the
+// agent sees as close code 1001.
+var ErrShuttingDown = errors.New("gateway is shutting down")
+
+// Shutdown stops the gateway. New sessions and new requests on existing
+// sessions are refused, sessions are closed as soon as they have no request
+// in flight, and those still busy when the shutdown drain timeout expires
+// or ctx is done are closed regardless. The upstream connections are closed
+// last, and the channels of WatchApprovals with them. Shutdown returns
+// ctx.Err() when ctx ended the drain early.
+func (a *App) Shutdown(ctx context.Context) error {
+	a.sessionsMu.Lock()
+	a.stopping.Store(true)
+	a.sessionsMu.Unlock()
+
+	a.mu.RLock()
+	timeout := a.shutdownTimeout
+	a.mu.RUnlock()
+	drainCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	logged := false
+	for {
+		busy := 0
+		for _, s := range a.liveSessions() {
+			if s.busy() {
+				busy++
+			} else {
+				s.cancel(ErrShuttingDown)
+			}
+		}
+		if busy == 0 {
+			break
+		}
+		if !logged {
+			a.logger.Printf("shutting down: waiting for requests in flight on %d session(s)", busy)
+			logged = true
+		}
+		select {
+		case <-ticker.C:
+			continue
+		case <-drainCtx.Done():
+			a.logger.Printf("warning: shutdown drain ended, closing %d session(s) with requests in flight", busy)
+			for _, s := range a.liveSessions() {
+				s.cancel(ErrShuttingDown)
+			}
+		}
+		break
+	}
+
+	a.mu.RLock()
+	for _, up := range a.servers {
+		up.cancel(ErrShuttingDown)
+	}
+	a.mu.RUnlock()
+	a.approvals.stop()
+
+	// Closing a session writes the messages still queued for its agent, so
+	// wait for the sessions to finish closing.
+	for len(a.liveSessions()) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return ctx.Err()
+}
+
+func (a *App) liveSessions() []*session {
+	a.sessionsMu.Lock()
+	defer a.sessionsMu.Unlock()
+	sessions := make([]*session, 0, len(a.live))
+	for s := range a.live {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// busy reports whether the session is waiting for responses its agent can
+// still receive. A detached session cannot be resumed during a shutdown, so
+// its requests are not waited for.
+func (s *session) busy() bool {
+	s.mu.Lock()
+	attached := s.client != nil
+	s.mu.Unlock()
+	return attached && s.guard.inFlight() > 0
+}
+
+// refuseWhileStopping answers the agent's requests with a retryable error
+// once the gateway is shutting down, so that the agent can send them to
+// another instance. It reports whether msg was refused.
+func (s *session) refuseWhileStopping(msg *rawMessage) bool {
+	if !s.app.stopping.Load() {
+		return false
+	}
+	env, ok := peekEnvelope(msg)
+	if !ok || env.Method == "" || len(env.ID) == 0 {
+		return false
+	}
+	_ = s.deliverMessage(mcp.NewError(env.ID, CodeUpstreamUnavailable, ErrShuttingDown.Error()))
+	return true
+}
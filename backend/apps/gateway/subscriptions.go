@@ -0,0 +1,241 @@
+package gateway
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"mcpgo/backend/services/mcp"
+)
+
+// listChangedWindow is how long a list change reported by one pooled
+// connection suppresses the same report from the others.
+const listChangedWindow = time.Second
+
+// subscription is a resource subscription that a pool holds upstream on
+// behalf of every session subscribed to the resource.
+type subscription struct {
+	uri      string
+	sessions map[*session]bool
+	// conn is the connection the upstream accepted the subscription on; it
+	// is nil while the subscription is being made.
+	conn *pooledConn
+	// waiting are the agents' subscribe requests answered once the
+	// upstream has.
+	waiting []poolKey
+}
+
+// subscribe handles an agent's resources/subscribe. The first subscription
+// to a resource is made upstream and the agents subscribing meanwhile get
+// the upstream's answer; later ones share it and are answered right away.
+func (p *pool) subscribe(s *session, m *mcp.Message) {
+	uri, ok := resourceURI(m.Params)
+	if !ok {
+		p.request(s, m)
+		return
+	}
+	p.mu.Lock()
+	sub := p.subs[uri]
+	switch {
+	case sub != nil && sub.conn != nil:
+		sub.sessions[s] = true
+		p.mu.Unlock()
+		reply, _ := mcp.NewResult(m.ID, struct{}{})
+		s.respond(reply)
+		return
+	case sub != nil:
+		sub.sessions[s] = true
+		sub.waiting = append(sub.waiting, poolKey{s, string(m.ID)})
+		p.mu.Unlock()
+		return
+	}
+	sub = &subscription{
+		uri:      uri,
+		sessions: map[*session]bool{s: true},
+		waiting:  []poolKey{{s, string(m.ID)}},
+	}
+	p.subs[uri] = sub
+	p.mu.Unlock()
+	p.sendSubscribe(sub)
+}
+
+// unsubscribe handles an agent's resources/unsubscribe. The subscription
+// is only cancelled upstream when no session is left subscribed.
+func (p *pool) unsubscribe(s *session, m *mcp.Message) {
+	uri, ok := resourceURI(m.Params)
+	if !ok {
+		p.request(s, m)
+		return
+	}
+	p.mu.Lock()
+	last := p.leave(s, uri)
+	p.mu.Unlock()
+	if last != nil {
+		p.sendUnsubscribe(last, uri)
+	}
+	reply, _ := mcp.NewResult(m.ID, struct{}{})
+	s.respond(reply)
+}
+
+// leave removes s from the subscription to uri and returns the connection
+// to unsubscribe on when it was the last session subscribed. The caller
+// holds p.mu.
+func (p *pool) leave(s *session, uri string) *pooledConn {
+	sub := p.subs[uri]
+	if sub == nil || !sub.sessions[s] {
+		return nil
+	}
+	delete(sub.sessions, s)
+	if len(sub.sessions) > 0 || sub.conn == nil {
+		return nil
+	}
+	delete(p.subs, uri)
+	return sub.conn
+}
+
+// sendSubscribe subscribes to sub's resource upstream on the gateway's
+// behalf.
+func (p *pool) sendSubscribe(sub *subscription) {
+	pc, err := p.acquire(p.up.ctx)
+	if err != nil {
+		p.subscribed(sub, nil, upstreamUnavailable())
+		return
+	}
+	p.mu.Lock()
+	p.nextID++
+	req := &poolRequest{
+		upstreamID:   strconv.FormatInt(p.nextID, 10),
+		conn:         pc,
+		subscription: sub,
+	}
+	pc.pending[req.upstreamID] = req
+	p.mu.Unlock()
+
+	msg, _ := mcp.NewRequest(json.RawMessage(req.upstreamID), "resources/subscribe", map[string]string{"uri": sub.uri})
+	_ = send(pc.conn, msg)
+}
+
+// sendUnsubscribe cancels the subscription to uri made on pc. The response
+// is not waited for.
+func (p *pool) sendUnsubscribe(pc *pooledConn, uri string) {
+	p.mu.Lock()
+	p.nextID++
+	id := strconv.FormatInt(p.nextID, 10)
+	p.mu.Unlock()
+	msg, _ := mcp.NewRequest(json.RawMessage(id), "resources/unsubscribe", map[string]string{"uri": uri})
+	_ = send(pc.conn, msg)
+}
+
+// subscribed records the upstream's reply to the subscription sub made on
+// pc and passes it on to the agents waiting for it. A refused subscription
+// is forgotten, and one no session wants any more is cancelled.
+func (p *pool) subscribed(sub *subscription, pc *pooledConn, reply *mcp.Message) {
+	p.mu.Lock()
+	waiting := sub.waiting
+	sub.waiting = nil
+	unused := false
+	if reply.Error == nil {
+		sub.conn = pc
+		unused = len(sub.sessions) == 0
+	}
+	if (reply.Error != nil || unused) && p.subs[sub.uri] == sub {
+		delete(p.subs, sub.uri)
+	}
+	p.mu.Unlock()
+
+	if unused {
+		p.sendUnsubscribe(pc, sub.uri)
+	}
+	if reply.Error != nil && len(waiting) == 0 {
+		p.app.logger.Printf("warning: could not restore the subscription to %s on upstream %s: %s", sub.uri, p.up.id, reply.Error.Message)
+	}
+	for _, key := range waiting {
+		answer := *reply
+		answer.ID = json.RawMessage(key.id)
+		key.session.respond(&answer)
+	}
+}
+
+// dropSubscriptions removes s from every subscription when it closes. The
+// caller holds p.mu; the returned subscriptions must be cancelled on their
+// connections.
+func (p *pool) dropSubscriptions(s *session) map[string]*pooledConn {
+	unused := make(map[string]*pooledConn)
+	for uri, sub := range p.subs {
+		for i := 0; i < len(sub.waiting); i++ {
+			if sub.waiting[i].session == s {
+				sub.waiting = append(sub.waiting[:i], sub.waiting[i+1:]...)
+				i--
+			}
+		}
+		if last := p.leave(s, uri); last != nil {
+			unused[uri] = last
+		}
+	}
+	return unused
+}
+
+// moveSubscriptions takes the subscriptions held on a lost connection
+// off it; they must be made again on another. The caller holds p.mu.
+func (p *pool) moveSubscriptions(pc *pooledConn) []*subscription {
+	var moved []*subscription
+	for _, sub := range p.subs {
+		if sub.conn == pc {
+			sub.conn = nil
+			moved = append(moved, sub)
+		}
+	}
+	return moved
+}
+
+// holdsSubscriptions reports whether pc carries a subscription, which
+// keeps it from being closed while idle. The caller holds p.mu.
+func (p *pool) holdsSubscriptions(pc *pooledConn) bool {
+	for _, sub := range p.subs {
+		if sub.conn == pc {
+			return true
+		}
+	}
+	return false
+}
+
+// notify delivers a notification from the upstream: resource updates to
+// the sessions subscribed to the resource and everything else, such as list
+// changes, to every session. A list change that several connections report
+// at once is delivered once.
+func (p *pool) notify(msg rawMessage, m *mcp.Message) {
+	p.mu.Lock()
+	var sessions []*session
+	_, isListChange := listChanged[m.Method]
+	switch {
+	case m.Method == "notifications/resources/updated":
+		uri, _ := resourceURI(m.Params)
+		if sub := p.subs[uri]; sub != nil {
+			for s := range sub.sessions {
+				sessions = append(sessions, s)
+			}
+		}
+	case isListChange && time.Since(p.listChanged[m.Method]) < listChangedWindow:
+	default:
+		if isListChange {
+			p.listChanged[m.Method] = time.Now()
+		}
+		for s := range p.sessions {
+			sessions = append(sessions, s)
+		}
+	}
+	p.mu.Unlock()
+	for _, s := range sessions {
+		s.deliver(msg)
+	}
+}
+
+func resourceURI(params json.RawMessage) (string, bool) {
+	var body struct {
+		URI string `json:"uri"`
+	}
+	if json.Unmarshal(params, &body) != nil || body.URI == "" {
+		return "", false
+	}
+	return body.URI, true
+}
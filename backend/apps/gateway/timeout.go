@@ -0,0 +1,143 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"mcpgo/backend/services/mcp"
+)
+
+// CodeRequestTimeout is the JSON-RPC error code returned for requests the
+// upstream did not answer within the configured timeout. The request is
+// cancelled upstream.
+const CodeRequestTimeout = -32002
+
+func requestTimedOut() *mcp.Message {
+	return mcp.NewError(nil, CodeRequestTimeout, "request timed out")
+}
+
+// requestTimeout returns the timeout for a request: the tool's timeout for
+// tools/call when one is configured, otherwise the server's.
+func (u *upstream) requestTimeout(method, tool string) time.Duration {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if method == "tools/call" {
+		if timeout := u.config.Tools[tool].Timeout.Duration; timeout > 0 {
+			return timeout
+		}
+	}
+	return u.config.RequestTimeout.Duration
+}
+
+// startDeadline arms the timeout of a request the agent sent.
+func (s *session) startDeadline(msg *rawMessage) {
+	env, ok := peekEnvelope(msg)
+	if !ok || env.Method == "" || len(env.ID) == 0 {
+		return
+	}
+	var tool string
+	if env.Method == "tools/call" {
+		var body struct {
+			Params struct {
+				Name string `json:"name"`
+			} `json:"params"`
+		}
+		_ = json.Unmarshal(msg.Data, &body)
+		tool = body.Params.Name
+	}
+	timeout := s.up.requestTimeout(env.Method, tool)
+	if timeout <= 0 {
+		return
+	}
+	id := env.ID
+	s.guard.setDeadline(id, timeout, func() {
+		s.expire(id)
+	})
+}
+
+// expire answers a request that ran out of time with a timeout error and
+// cancels it upstream, abandoning a failover in progress.
+func (s *session) expire(id json.RawMessage) {
+	s.abortFailover(id)
+	if !s.guard.expire(id, requestTimedOut()) {
+		return
+	}
+	s.cancelUpstream(id, "request timed out")
+}
+
+// cancelUpstream sends notifications/cancelled for the agent's request id
+// to the upstream handling it.
+func (s *session) cancelUpstream(id json.RawMessage, reason string) {
+	switch {
+	case s.pool != nil:
+		s.pool.cancelRequest(s, id, reason)
+		return
+	case s.agg != nil:
+		s.agg.cancel(id)
+		return
+	}
+	cancelled, _ := mcp.NewNotification("notifications/cancelled", map[string]interface{}{
+		"requestId": id,
+		"reason":    reason,
+	})
+	if conn, ok := s.writableUpstream(); ok {
+		_ = send(conn, cancelled)
+	}
+}
+
+// agentCancelled handles notifications/cancelled from the agent: the
+// request no longer holds capacity, a failover in progress for it stops,
+// and a response that still arrives is dropped. The notification itself
+// is forwarded upstream by the caller.
+func (s *session) agentCancelled(msg *rawMessage) {
+	env, ok := peekEnvelope(msg)
+	if !ok || env.Method != "notifications/cancelled" {
+		return
+	}
+	var body struct {
+		Params struct {
+			RequestID json.RawMessage `json:"requestId"`
+		} `json:"params"`
+	}
+	if json.Unmarshal(msg.Data, &body) != nil || len(body.Params.RequestID) == 0 {
+		return
+	}
+	s.abortFailover(body.Params.RequestID)
+	s.guard.cancel(body.Params.RequestID)
+}
+
+// failoverContext returns the context of a failover for the request id,
+// bounded by timeout when it is positive.
+func (s *session) failoverContext(id json.RawMessage, timeout time.Duration) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(s.ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(s.ctx)
+	}
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	if s.failovers == nil {
+		s.failovers = make(map[string]context.CancelFunc)
+	}
+	s.failovers[string(id)] = cancel
+	return ctx, func() {
+		s.callsMu.Lock()
+		delete(s.failovers, string(id))
+		s.callsMu.Unlock()
+		cancel()
+	}
+}
+
+// abortFailover stops the failover of the request id, if any.
+func (s *session) abortFailover(id json.RawMessage) {
+	s.callsMu.Lock()
+	cancel := s.failovers[string(id)]
+	delete(s.failovers, string(id))
+	s.callsMu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
@@ -0,0 +1,175 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/jsonschema"
+	"mcpgo/backend/services/mcp"
+)
+
+// learnTools records the tool definitions of a tools/list result the server
+// sent, so that calls can be validated against the schemas agents were
+// given. They are forgotten when the server reports its tools changed.
+func (u *upstream) learnTools(items json.RawMessage) {
+	var tools []mcp.Tool
+	if json.Unmarshal(items, &tools) != nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.seen == nil {
+		u.seen = make(map[string]mcp.Tool)
+	}
+	for _, tool := range tools {
+		u.seen[tool.Name] = tool
+	}
+}
+
+// toolSchemas returns the input schema of the server's tool name, with
+// the tool's input schema override applied, and its output schema. The
+// definitions listed to agents take precedence over the probed catalog.
+func (u *upstream) toolSchemas(name string) (input, output json.RawMessage, validation config.ValidationConfig) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	validation = u.config.Validation
+	tool, ok := u.seen[name]
+	if !ok {
+		for _, t := range u.tools {
+			if t.Name == name {
+				tool, ok = t, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil, nil, validation
+	}
+	input = tool.InputSchema
+	if patch := u.config.Tools[name].InputSchema; len(patch) > 0 && len(input) > 0 {
+		if data, err := json.Marshal(patch); err == nil {
+			input = mergePatch(input, data)
+		}
+	}
+	return input, tool.OutputSchema, validation
+}
+
+// validateCall checks the arguments of the agent's tools/call against the
+// tool's input schema, reporting whether the call was refused as invalid.
+// Calls whose results are checked against the tool's output schema are
+// remembered. Calls of tools without a known schema are forwarded as they
+// are.
+func (s *session) validateCall(msg *rawMessage) bool {
+	env, ok := peekEnvelope(msg)
+	if !ok || env.Method != "tools/call" || len(env.ID) == 0 {
+		return false
+	}
+	var body struct {
+		Params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		} `json:"params"`
+	}
+	if json.Unmarshal(msg.Data, &body) != nil {
+		return false
+	}
+	name := body.Params.Name
+	if refusal := s.invalidArguments(s.up, name, body.Params.Arguments); refusal != nil {
+		refusal.ID = env.ID
+		_ = s.deliverMessage(refusal)
+		return true
+	}
+	_, output, validation := s.up.toolSchemas(name)
+
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	delete(s.outputs, string(env.ID))
+	if validation.Output && len(output) > 0 {
+		if s.outputs == nil {
+			s.outputs = make(map[string]toolOutput)
+		}
+		s.outputs[string(env.ID)] = toolOutput{tool: name, schema: output}
+	}
+	return false
+}
+
+// invalidArguments checks arguments of a call of up's tool name against the
+// tool's input schema, returning the error refusing the call when they do
+// not match it.
+func (s *session) invalidArguments(up *upstream, name string, arguments json.RawMessage) *mcp.Message {
+	input, _, validation := up.toolSchemas(name)
+	if validation.DisableArguments || len(input) == 0 {
+		return nil
+	}
+	if len(arguments) == 0 || string(arguments) == "null" {
+		arguments = json.RawMessage("{}")
+	}
+	err := jsonschema.Validate(input, arguments)
+	var invalid *jsonschema.Error
+	switch {
+	case errors.As(err, &invalid):
+		return mcp.NewError(nil, mcp.CodeInvalidParams, fmt.Sprintf("invalid arguments for tool %q: %v", name, invalid))
+	case err != nil:
+		s.app.logger.Printf("warning: cannot validate the arguments of tool %s on upstream %s: %v", name, up.id, err)
+	}
+	return nil
+}
+
+// toolOutput is a tools/call whose result is validated against the tool's
+// output schema.
+type toolOutput struct {
+	tool   string
+	schema json.RawMessage
+}
+
+// validateResult replaces a tool result whose structuredContent does not
+// match the tool's output schema with an error.
+func (s *session) validateResult(msg rawMessage) rawMessage {
+	s.callsMu.Lock()
+	pending := len(s.outputs) > 0
+	s.callsMu.Unlock()
+	if !pending {
+		return msg
+	}
+	env, ok := peekEnvelope(&msg)
+	if !ok || env.Method != "" || len(env.ID) == 0 {
+		return msg
+	}
+	s.callsMu.Lock()
+	call, ok := s.outputs[string(env.ID)]
+	delete(s.outputs, string(env.ID))
+	s.callsMu.Unlock()
+	if !ok {
+		return msg
+	}
+	var reply struct {
+		Result *struct {
+			StructuredContent json.RawMessage `json:"structuredContent"`
+			IsError           bool            `json:"isError"`
+		} `json:"result"`
+	}
+	if json.Unmarshal(msg.Data, &reply) != nil || reply.Result == nil || reply.Result.IsError {
+		return msg
+	}
+	var problem string
+	if len(reply.Result.StructuredContent) == 0 {
+		problem = fmt.Sprintf("the result of tool %q has no structuredContent", call.tool)
+	} else if err := jsonschema.Validate(call.schema, reply.Result.StructuredContent); err != nil {
+		var invalid *jsonschema.Error
+		if !errors.As(err, &invalid) {
+			s.app.logger.Printf("warning: cannot validate the results of tool %s on upstream %s: %v", call.tool, s.up.id, err)
+			return msg
+		}
+		problem = fmt.Sprintf("invalid structuredContent from tool %q: %v", call.tool, invalid)
+	}
+	if problem == "" {
+		return msg
+	}
+	data, err := encodeMessage(mcp.NewError(env.ID, mcp.CodeInternalError, problem))
+	if err != nil {
+		return msg
+	}
+	return rawMessage{Data: data, Type: msg.Type}
+}
@@ -0,0 +1,430 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"mcpgo/backend/services/mcp"
+)
+
+// MCP revisions that introduced features the gateway translates.
+const (
+	// revisionAnnotations added tool annotations, audio content, the
+	// completions capability and JSON-RPC batches.
+	revisionAnnotations = "2025-03-26"
+	// revisionStructured added structured tool output, resource links,
+	// titles and elicitation, and removed batches.
+	revisionStructured = "2025-06-18"
+)
+
+// translatedMethods are the agent requests whose responses are translated
+// for agents on an older revision than the gateway's.
+var translatedMethods = map[string]bool{
+	"tools/list":               true,
+	"prompts/list":             true,
+	"resources/list":           true,
+	"resources/templates/list": true,
+	"tools/call":               true,
+	"prompts/get":              true,
+}
+
+// SessionInfo is a point-in-time snapshot of an agent session.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	Server    string    `json:"server"`
+	StartedAt time.Time `json:"startedAt"`
+	// Attached is false while a resumable session waits for its agent to
+	// reconnect.
+	Attached bool `json:"attached"`
+	InFlight int  `json:"inFlight"`
+	// AgentProtocolVersion is the revision negotiated with the agent and
+	// UpstreamProtocolVersion the one negotiated with the upstream server.
+	AgentProtocolVersion    string              `json:"agentProtocolVersion,omitempty"`
+	UpstreamProtocolVersion string              `json:"upstreamProtocolVersion,omitempty"`
+	ClientInfo              *mcp.Implementation `json:"clientInfo,omitempty"`
+}
+
+// negotiation tracks the protocol revisions of both sides of a session.
+// The gateway negotiates its own revision with the upstream and answers the
+// agent with the revision the agent asked for, translating between them.
+type negotiation struct {
+	mu sync.Mutex
+	// initID is the id of the agent's initialize request until it is
+	// answered; requested is the revision it asked for.
+	initID    string
+	requested string
+	agent     string
+	upstream  string
+	client    *mcp.Implementation
+	// methods are the agent's requests whose responses are translated, by
+	// id, and batches the unanswered requests of the agent's batches.
+	methods map[string]string
+	batches map[string]*batch
+}
+
+// batch collects the responses to a JSON-RPC batch the agent sent, which
+// the gateway splits into single messages.
+type batch struct {
+	pending int
+	replies []json.RawMessage
+}
+
+// awaiting reports whether responses are awaited per pending, so that
+// messages can be delivered without being decoded when none are.
+func (n *negotiation) awaiting(pending func(*negotiation) bool) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return pending(n)
+}
+
+// Sessions returns a snapshot of every live agent session in the order
+// they started.
+func (a *App) Sessions() []SessionInfo {
+	sessions := a.liveSessions()
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, s.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].StartedAt.Equal(infos[j].StartedAt) {
+			return infos[i].StartedAt.Before(infos[j].StartedAt)
+		}
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+func (s *session) info() SessionInfo {
+	s.mu.Lock()
+	attached := s.client != nil
+	s.mu.Unlock()
+	n := &s.versions
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return SessionInfo{
+		ID:                      s.id,
+		Server:                  s.up.id,
+		StartedAt:               s.startedAt,
+		Attached:                attached,
+		InFlight:                s.guard.inFlight(),
+		AgentProtocolVersion:    n.agent,
+		UpstreamProtocolVersion: n.upstream,
+		ClientInfo:              n.client,
+	}
+}
+
+// splitBatch returns the messages of a JSON-RPC batch and true, or msg
+// itself and false when it is not a batch.
+func splitBatch(msg rawMessage) ([]rawMessage, bool) {
+	data := bytes.TrimLeft(msg.Data, " \t\r\n")
+	if len(data) == 0 || data[0] != '[' {
+		return []rawMessage{msg}, false
+	}
+	var parts []json.RawMessage
+	if json.Unmarshal(data, &parts) != nil || len(parts) == 0 {
+		return []rawMessage{msg}, false
+	}
+	msgs := make([]rawMessage, len(parts))
+	for i, part := range parts {
+		msgs[i] = rawMessage{Data: part, Type: msg.Type}
+	}
+	return msgs, true
+}
+
+// splitAgentBatch splits a batch the agent sent, so that each message goes
+// through the gateway on its own and reaches upstreams that no longer accept
+// batches. The responses are returned to the agent as a batch again.
+func (s *session) splitAgentBatch(msg rawMessage) []rawMessage {
+	msgs, ok := splitBatch(msg)
+	if !ok {
+		return msgs
+	}
+	b := &batch{}
+	n := &s.versions
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i := range msgs {
+		if env, ok := peekEnvelope(&msgs[i]); ok && env.Method != "" && len(env.ID) > 0 {
+			if n.batches == nil {
+				n.batches = make(map[string]*batch)
+			}
+			n.batches[string(env.ID)] = b
+			b.pending++
+		}
+	}
+	return msgs
+}
+
+// collectBatch holds back a response to a request of an agent's batch
+// until the batch is answered, then returns the responses as one message.
+// It reports false while the batch is incomplete.
+func (s *session) collectBatch(msg rawMessage) (rawMessage, bool) {
+	if !s.versions.awaiting(func(n *negotiation) bool { return len(n.batches) > 0 }) {
+		return msg, true
+	}
+	env, ok := peekEnvelope(&msg)
+	if !ok || env.Method != "" || len(env.ID) == 0 {
+		return msg, true
+	}
+	n := &s.versions
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	b := n.batches[string(env.ID)]
+	if b == nil {
+		return msg, true
+	}
+	delete(n.batches, string(env.ID))
+	b.replies = append(b.replies, msg.Data)
+	if b.pending--; b.pending > 0 {
+		return msg, false
+	}
+	data, err := json.Marshal(b.replies)
+	if err != nil {
+		return msg, true
+	}
+	return rawMessage{Data: data, Type: msg.Type}, true
+}
+
+// negotiateRequest inspects a request the agent sends upstream. The
+// agent's initialize request is sent with the gateway's own revision, and
+// requests whose responses need translating for the agent are remembered.
+func (s *session) negotiateRequest(msg *rawMessage) {
+	env, ok := peekEnvelope(msg)
+	if !ok || env.Method == "" || len(env.ID) == 0 {
+		return
+	}
+	n := &s.versions
+	if env.Method == "initialize" {
+		var body struct {
+			Params mcp.InitializeParams `json:"params"`
+		}
+		_ = json.Unmarshal(msg.Data, &body)
+		n.mu.Lock()
+		n.initID = string(env.ID)
+		n.requested = body.Params.ProtocolVersion
+		client := body.Params.ClientInfo
+		n.client = &client
+		n.mu.Unlock()
+		rewriteParams(msg, func(params json.RawMessage) json.RawMessage {
+			return setParam(params, "protocolVersion", quote(mcp.LatestProtocolVersion))
+		})
+		return
+	}
+	n.mu.Lock()
+	agent, upstream := n.agent, n.upstream
+	if translatedMethods[env.Method] && agent != "" && agent < mcp.LatestProtocolVersion {
+		if n.methods == nil {
+			n.methods = make(map[string]string)
+		}
+		n.methods[string(env.ID)] = env.Method
+	}
+	n.mu.Unlock()
+	// The context of completion requests is unknown to older servers.
+	if env.Method == "completion/complete" && upstream != "" && upstream < revisionStructured {
+		rewriteParams(msg, func(params json.RawMessage) json.RawMessage {
+			return withoutFields(params, "context")
+		})
+	}
+}
+
+// translate converts a message for the agent to the agent's revision.
+func (s *session) translate(msg rawMessage) rawMessage {
+	if !s.versions.awaiting(func(n *negotiation) bool { return n.initID != "" || len(n.methods) > 0 }) {
+		return msg
+	}
+	env, ok := peekEnvelope(&msg)
+	if !ok || env.Method != "" || len(env.ID) == 0 {
+		return msg
+	}
+	n := &s.versions
+	n.mu.Lock()
+	initialize := n.initID != "" && n.initID == string(env.ID)
+	if initialize {
+		n.initID = ""
+	}
+	method, translated := n.methods[string(env.ID)]
+	delete(n.methods, string(env.ID))
+	agent := n.agent
+	n.mu.Unlock()
+
+	switch {
+	case initialize:
+		return s.negotiated(msg)
+	case !translated:
+		return msg
+	}
+	var reply map[string]json.RawMessage
+	var result map[string]json.RawMessage
+	if json.Unmarshal(msg.Data, &reply) != nil || json.Unmarshal(reply["result"], &result) != nil {
+		return msg
+	}
+	switch method {
+	case "tools/list":
+		result["tools"] = mapItems(result["tools"], func(tool map[string]json.RawMessage) {
+			if agent < revisionStructured {
+				delete(tool, "title")
+				delete(tool, "outputSchema")
+			}
+			if agent < revisionAnnotations {
+				delete(tool, "annotations")
+			}
+		})
+	case "prompts/list", "resources/list", "resources/templates/list":
+		field := listKinds[method].field
+		result[field] = mapItems(result[field], func(item map[string]json.RawMessage) {
+			delete(item, "title")
+		})
+	case "tools/call":
+		if structured, ok := result["structuredContent"]; ok && agent < revisionStructured {
+			delete(result, "structuredContent")
+			var content []json.RawMessage
+			if json.Unmarshal(result["content"], &content) != nil || len(content) == 0 {
+				text, _ := json.Marshal(map[string]string{"type": "text", "text": string(structured)})
+				result["content"], _ = json.Marshal([]json.RawMessage{text})
+			}
+		}
+		result["content"] = mapItems(result["content"], func(item map[string]json.RawMessage) {
+			downgradeContent(item, agent)
+		})
+	case "prompts/get":
+		result["messages"] = mapItems(result["messages"], func(message map[string]json.RawMessage) {
+			var item map[string]json.RawMessage
+			if json.Unmarshal(message["content"], &item) == nil && item != nil {
+				downgradeContent(item, agent)
+				message["content"], _ = json.Marshal(item)
+			}
+		})
+	}
+	reply["result"], _ = json.Marshal(result)
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return msg
+	}
+	return rawMessage{Data: data, Type: msg.Type}
+}
+
+// negotiated records the revision of the response to the agent's
+// initialize request as the upstream's and answers the agent with the
+// revision it asked for, when the gateway supports it.
+func (s *session) negotiated(msg rawMessage) rawMessage {
+	var reply map[string]json.RawMessage
+	var result map[string]json.RawMessage
+	if json.Unmarshal(msg.Data, &reply) != nil || json.Unmarshal(reply["result"], &result) != nil {
+		return msg
+	}
+	var upstream string
+	_ = json.Unmarshal(result["protocolVersion"], &upstream)
+	n := &s.versions
+	n.mu.Lock()
+	agent := upstream
+	if slices.Contains(mcp.SupportedProtocolVersions, n.requested) {
+		agent = n.requested
+	}
+	n.agent, n.upstream = agent, upstream
+	n.mu.Unlock()
+	s.app.logger.Printf("session %s on upstream %s negotiated protocol %s with the agent and %s with the upstream", s.id, s.up.id, agent, upstream)
+
+	result["protocolVersion"] = quote(agent)
+	if agent < revisionAnnotations {
+		result["capabilities"] = withoutFields(result["capabilities"], "completions")
+	}
+	reply["result"], _ = json.Marshal(result)
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return msg
+	}
+	return rawMessage{Data: data, Type: msg.Type}
+}
+
+// agentRevision returns the revision negotiated with the agent, or the
+// gateway's when the agent has not initialized yet.
+func (s *session) agentRevision() string {
+	n := &s.versions
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.agent == "" {
+		return mcp.LatestProtocolVersion
+	}
+	return n.agent
+}
+
+// downgradeContent replaces a content item the agent's revision does not
+// know with a text item describing it.
+func downgradeContent(item map[string]json.RawMessage, agent string) {
+	var fields struct{ Type, URI, Name, MimeType string }
+	_ = json.Unmarshal(item["type"], &fields.Type)
+	_ = json.Unmarshal(item["uri"], &fields.URI)
+	_ = json.Unmarshal(item["name"], &fields.Name)
+	_ = json.Unmarshal(item["mimeType"], &fields.MimeType)
+	var text string
+	switch {
+	case fields.Type == "resource_link" && agent < revisionStructured:
+		text = fields.URI
+		if fields.Name != "" {
+			text = fields.Name + ": " + fields.URI
+		}
+	case fields.Type == "audio" && agent < revisionAnnotations:
+		text = fmt.Sprintf("[%s audio omitted]", fields.MimeType)
+	default:
+		if agent < revisionStructured {
+			delete(item, "title")
+		}
+		return
+	}
+	for key := range item {
+		delete(item, key)
+	}
+	item["type"] = quote("text")
+	item["text"] = quote(text)
+}
+
+// mapItems applies fn to every object of a JSON array.
+func mapItems(items json.RawMessage, fn func(map[string]json.RawMessage)) json.RawMessage {
+	var entries []map[string]json.RawMessage
+	if json.Unmarshal(items, &entries) != nil {
+		return items
+	}
+	for _, entry := range entries {
+		if entry != nil {
+			fn(entry)
+		}
+	}
+	out, err := json.Marshal(entries)
+	if err != nil {
+		return items
+	}
+	return out
+}
+
+// rewriteParams replaces the params of msg with fn's result.
+func rewriteParams(msg *rawMessage, fn func(json.RawMessage) json.RawMessage) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(msg.Data, &fields) != nil {
+		return
+	}
+	fields["params"] = fn(fields["params"])
+	if data, err := json.Marshal(fields); err == nil {
+		msg.Data = data
+	}
+}
+
+// withoutFields removes keys from a JSON object.
+func withoutFields(object json.RawMessage, keys ...string) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(object, &fields) != nil || fields == nil {
+		return object
+	}
+	for _, key := range keys {
+		delete(fields, key)
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return object
+	}
+	return out
+}
@@ -0,0 +1,154 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/logging"
+)
+
+// Version is the release the binary was built from. It is set at build time
+// with -ldflags "-X mcpgo/backend/cli.Version=v1.2.3".
+var Version = "dev"
+
+const usage = `usage: mcpgo <command> [flags]
+
+Commands:
+  serve                      start the gateway (the default without a command)
+  config validate [file...]  validate configuration files (default: the file the gateway would load)
+  config schema              print the JSON Schema of the configuration format
+  servers list               list the configured upstream servers and their status
+  tools list                 list the tools offered by the upstream servers
+  tools changes              list the tools whose definitions changed since they were pinned
+  tools approve <server> <tool>
+                             approve the changed definition of a tool
+  call <tool> [arguments]    call a tool with JSON arguments and print the result
+  version                    print version information
+
+Flags accepted by every command:
+  -config path               configuration file (default: $MCPGO_CONFIG, then configs/config.yaml)
+  -log-level level           debug, info, warn or error (default: info)
+
+Run "mcpgo <command> -h" for the flags of a command.
+`
+
+// options holds the flags shared by all commands.
+type options struct {
+	configPath string
+	logLevel   string
+	stdout     io.Writer
+	stderr     io.Writer
+}
+
+// Run executes the command line args (without the program name) and returns
+// the process exit code.
+func Run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help" {
+		return serve(args, stdout, stderr)
+	}
+
+	command := args[0]
+	if len(args) >= 2 && (command == "config" || command == "servers" || command == "tools") {
+		command += " " + args[1]
+		args = args[1:]
+	}
+	switch command {
+	case "serve":
+		return serve(args[1:], stdout, stderr)
+	case "config validate":
+		return validateConfig(args[1:], stdout, stderr)
+	case "config schema":
+		return printSchema(args[1:], stdout, stderr)
+	case "servers list":
+		return listServers(args[1:], stdout, stderr)
+	case "tools list":
+		return listTools(args[1:], stdout, stderr)
+	case "tools changes":
+		return listToolChanges(args[1:], stdout, stderr)
+	case "tools approve":
+		return approveTool(args[1:], stdout, stderr)
+	case "call":
+		return callTool(args[1:], stdout, stderr)
+	case "version":
+		return printVersion(args[1:], stdout, stderr)
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	}
+	fmt.Fprint(stderr, usage)
+	return 2
+}
+
+// newFlagSet creates the flag set of a command with the shared flags
+// registered.
+func newFlagSet(name string, stdout, stderr io.Writer) (*flag.FlagSet, *options) {
+	opts := &options{stdout: stdout, stderr: stderr}
+	fs := flag.NewFlagSet("mcpgo "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&opts.configPath, "config", "", "configuration file (default: $MCPGO_CONFIG, then configs/config.yaml)")
+	fs.StringVar(&opts.logLevel, "log-level", "info", "log level: debug, info, warn or error")
+	return fs, opts
+}
+
+// parse parses args, allowing flags to follow positional arguments, and
+// returns the positional arguments. It reports the exit code to use when
+// parsing fails.
+func parse(fs *flag.FlagSet, args []string) ([]string, int, bool) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, 0, false
+			}
+			return nil, 2, false
+		}
+		if fs.NArg() == 0 {
+			return positional, 0, true
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func (o *options) logger() (*log.Logger, error) {
+	level, err := logging.ParseLevel(o.logLevel)
+	if err != nil {
+		return nil, err
+	}
+	return logging.New(o.stderr, level), nil
+}
+
+// loadConfig loads the file named by -config, falling back to the
+// MCPGO_CONFIG environment variable and the default locations.
+func (o *options) loadConfig() (*config.Config, string, error) {
+	if o.configPath != "" {
+		cfg, err := config.Load(o.configPath)
+		return cfg, o.configPath, err
+	}
+	return config.LoadFromEnv()
+}
+
+func printVersion(args []string, stdout, stderr io.Writer) int {
+	fs, _ := newFlagSet("version", stdout, stderr)
+	if _, code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	fmt.Fprintf(stdout, "mcpgo %s\n", Version)
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				fmt.Fprintf(stdout, "commit: %s\n", setting.Value)
+			}
+		}
+	}
+	fmt.Fprintf(stdout, "go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return 0
+}
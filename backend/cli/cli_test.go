@@ -0,0 +1,137 @@
+package cli_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"mcpgo/backend/cli"
+	"mcpgo/backend/services/mcp"
+
+	"golang.org/x/net/websocket"
+)
+
+// newToolServer starts an MCP server offering an "echo" tool that returns its
+// arguments as text.
+func newToolServer(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		for {
+			var msg mcp.Message
+			if err := websocket.JSON.Receive(conn, &msg); err != nil {
+				return
+			}
+			if !msg.IsRequest() {
+				continue
+			}
+			var reply *mcp.Message
+			switch msg.Method {
+			case "initialize":
+				reply, _ = mcp.NewResult(msg.ID, mcp.InitializeResult{
+					ProtocolVersion: mcp.LatestProtocolVersion,
+					Capabilities:    json.RawMessage(`{"tools":{}}`),
+					ServerInfo:      mcp.Implementation{Name: "tools", Version: "1"},
+				})
+			case "tools/list":
+				reply, _ = mcp.NewResult(msg.ID, mcp.ListToolsResult{Tools: []mcp.Tool{{Name: "echo", Description: "Echo the arguments"}}})
+			case "tools/call":
+				var params mcp.CallToolParams
+				json.Unmarshal(msg.Params, &params)
+				text, _ := json.Marshal(string(params.Arguments))
+				reply, _ = mcp.NewResult(msg.ID, mcp.CallToolResult{Content: []json.RawMessage{json.RawMessage(`{"type":"text","text":` + string(text) + `}`)}})
+			default:
+				reply = mcp.NewError(msg.ID, mcp.CodeMethodNotFound, "method not found")
+			}
+			if err := websocket.JSON.Send(conn, reply); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestCommandsUseConfiguredServers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "pinning:\n  lockfile: mcpgo.lock\nservers:\n  - id: \"tools\"\n    address: \"" + newToolServer(t) + "\"\n  - id: \"off\"\n    address: \"ws://127.0.0.1:1/mcp\"\n    disabled: true\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	run := func(args ...string) (int, string, string) {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		code := cli.Run(args, &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	if code, out, errOut := run("config", "validate", "-config", path); code != 0 || out != path+": OK\n" {
+		t.Fatalf("config validate: exit %d, stdout %q, stderr %q", code, out, errOut)
+	}
+
+	code, out, errOut := run("servers", "list", "-config", path)
+	if code != 0 || !regexp.MustCompile(`tools\s+online\s+1`).MatchString(out) || !regexp.MustCompile(`off\s+disabled\s+0`).MatchString(out) {
+		t.Fatalf("servers list: exit %d, stdout %q, stderr %q", code, out, errOut)
+	}
+
+	code, out, errOut = run("tools", "list", "-config", path)
+	if code != 0 || !regexp.MustCompile(`tools\s+echo\s+Echo the arguments`).MatchString(out) {
+		t.Fatalf("tools list: exit %d, stdout %q, stderr %q", code, out, errOut)
+	}
+
+	if code, out, errOut := run("tools", "changes", "-config", path); code != 0 || out != "" {
+		t.Fatalf("tools changes: exit %d, stdout %q, stderr %q", code, out, errOut)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(path), "mcpgo.lock")); err != nil {
+		t.Fatalf("expected the tools to be pinned next to the config: %v", err)
+	}
+	if code, _, errOut := run("tools", "approve", "tools", "echo", "-config", path); code != 1 || !strings.Contains(errOut, "no change awaiting approval") {
+		t.Fatalf("expected approving an unchanged tool to fail, got exit %d, stderr %q", code, errOut)
+	}
+
+	code, out, errOut = run("call", "echo", `{"text":"hi"}`, "-config", path)
+	var result mcp.CallToolResult
+	if code != 0 || json.Unmarshal([]byte(out), &result) != nil || len(result.Content) != 1 || !strings.Contains(string(result.Content[0]), `\"text\":\"hi\"`) {
+		t.Fatalf("call: exit %d, stdout %q, stderr %q", code, out, errOut)
+	}
+
+	if code, _, errOut := run("call", "missing", "-config", path); code != 1 || !strings.Contains(errOut, `"missing"`) {
+		t.Fatalf("expected calling an unknown tool to fail, got exit %d, stderr %q", code, errOut)
+	}
+	if code, _, _ := run("bogus"); code != 2 {
+		t.Fatalf("expected exit 2 for an unknown command, got %d", code)
+	}
+}
+
+func TestServeReportsStartupErrorsAtEveryLevel(t *testing.T) {
+	// serve creates its certificates relative to the working directory.
+	dir := t.TempDir()
+	t.Chdir(dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("servers:\n  - id: \"a\"\n    address: \"http://localhost/mcp\"\n"), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	var stdout, stderr bytes.Buffer
+	if code := cli.Run([]string{"serve", "-config", path, "-log-level", "error"}, &stdout, &stderr); code != 1 || !strings.Contains(stderr.String(), "failed to load config") {
+		t.Fatalf("expected the config error to be reported, got exit %d, stderr %q", code, stderr.String())
+	}
+
+	if err := os.WriteFile(path, []byte("servers: []\n"), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer taken.Close()
+	stderr.Reset()
+	if code := cli.Run([]string{"serve", "-config", path, "-listen", taken.Addr().String(), "-log-level", "error"}, &stdout, &stderr); code != 1 || !strings.Contains(stderr.String(), "could not listen on") {
+		t.Fatalf("expected the listen error to be reported, got exit %d, stderr %q", code, stderr.String())
+	}
+}
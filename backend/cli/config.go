@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+
+	"mcpgo/backend/services/config"
+)
+
+func validateConfig(args []string, stdout, stderr io.Writer) int {
+	fs, opts := newFlagSet("config validate", stdout, stderr)
+	paths, code, ok := parse(fs, args)
+	if !ok {
+		return code
+	}
+
+	if len(paths) == 0 {
+		_, path, err := opts.loadConfig()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "%s: OK\n", path)
+		return 0
+	}
+
+	status := 0
+	for _, path := range paths {
+		if _, err := config.Load(path); err != nil {
+			fmt.Fprintln(stderr, err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: OK\n", path)
+	}
+	return status
+}
+
+func printSchema(args []string, stdout, stderr io.Writer) int {
+	fs, _ := newFlagSet("config schema", stdout, stderr)
+	if _, code, ok := parse(fs, args); !ok {
+		return code
+	}
+	stdout.Write(config.Schema)
+	return 0
+}
@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// listToolChanges probes the upstream servers, so that their current tool
+// definitions are compared with the lockfile, and lists the tools whose
+// definitions changed since they were pinned, with a diff of each.
+func listToolChanges(args []string, stdout, stderr io.Writer) int {
+	fs, flags := newUpstreamFlagSet("tools changes", stdout, stderr)
+	if _, code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	app, err := flags.newApp()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if _, err := flags.probeWith(context.Background(), app); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	changes, err := app.ToolChanges()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if flags.server != "" {
+		selected := changes[:0]
+		for _, change := range changes {
+			if change.Server == flags.server {
+				selected = append(selected, change)
+			}
+		}
+		changes = selected
+	}
+	if flags.json {
+		return writeJSON(stdout, stderr, changes)
+	}
+
+	for _, change := range changes {
+		fmt.Fprintf(stdout, "%s %s: %s since %s\n", change.Server, change.Tool, change.Action, change.DetectedAt.Format(time.RFC3339))
+		for _, line := range change.Diff {
+			fmt.Fprintf(stdout, "  %s\n", line)
+		}
+	}
+	return 0
+}
+
+// approveTool pins the changed definition of a server's tool in the
+// lockfile. A running gateway picks the approval up on its next use of the
+// lockfile.
+func approveTool(args []string, stdout, stderr io.Writer) int {
+	fs, opts := newFlagSet("tools approve", stdout, stderr)
+	positional, code, ok := parse(fs, args)
+	if !ok {
+		return code
+	}
+	if len(positional) != 2 {
+		fmt.Fprintln(stderr, "usage: mcpgo tools approve <server> <tool>")
+		return 2
+	}
+
+	app, err := opts.newApp()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	change, err := app.ApproveTool(positional[0], positional[1])
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "approved the changed definition of %s on %s\n", change.Tool, change.Server)
+	return 0
+}
@@ -0,0 +1,211 @@
+package cli
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	admin_api "mcpgo/backend/api/admin"
+	gateway_api "mcpgo/backend/api/gateway"
+	health_api "mcpgo/backend/api/health"
+	swagger_api "mcpgo/backend/api/swagger"
+	"mcpgo/backend/apps/admin"
+	"mcpgo/backend/apps/gateway"
+	"mcpgo/backend/apps/health"
+	swagger_app "mcpgo/backend/apps/swagger"
+	"mcpgo/backend/services/config"
+	"mcpgo/backend/services/ssl"
+
+	"github.com/gorilla/mux"
+)
+
+// serve runs the gateway until it receives SIGINT or SIGTERM.
+func serve(args []string, stdout, stderr io.Writer) int {
+	fs, opts := newFlagSet("serve", stdout, stderr)
+	listen := fs.String("listen", "", "listen address, overriding agent.http.addr (e.g. :8443)")
+	if _, code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	// 1. Initialize Infrastructure
+	logger, err := opts.logger()
+	if err != nil {
+		io.WriteString(stderr, err.Error()+"\n")
+		return 2
+	}
+
+	cfg, configPath, err := opts.loadConfig()
+	if err != nil {
+		logger.Printf("error: failed to load config: %v", err)
+		return 1
+	}
+	logger.Printf("loaded configuration from %s", configPath)
+
+	if _, err := cfg.DefaultServer(); err != nil {
+		logger.Printf("warning: %v; add one through the admin API", err)
+	}
+
+	gatewayApp, err := gateway.NewAppFromConfig(cfg, logger)
+	if err != nil {
+		logger.Printf("error: failed to create gateway app: %v", err)
+		return 1
+	}
+
+	adminApp, err := admin.NewApp(gatewayApp, configPath, logger)
+	if err != nil {
+		logger.Printf("error: failed to create admin app: %v", err)
+		return 1
+	}
+
+	// 2. Create Router and Server
+	router := mux.NewRouter()
+
+	// Initialize and register apps
+	healthApp := health.NewApp()
+	healthAPI := health_api.NewRouter(healthApp)
+	healthAPI.RegisterRoutes(router)
+
+	swaggerApp := swagger_app.NewApp()
+	swaggerAPI := swagger_api.NewRouter(swaggerApp)
+	swaggerAPI.RegisterRoutes(router)
+
+	gatewayAPI := gateway_api.NewRouter(gatewayApp, logger)
+	gatewayAPI.RegisterRoutes(router)
+
+	adminAPI := admin_api.NewRouter(adminApp, cfg.Admin.Token, logger)
+	adminAPI.RegisterRoutes(router)
+
+	httpAddr := *listen
+	if httpAddr == "" {
+		httpAddr = cfg.Agent.HTTP.Addr
+	}
+	if httpAddr == "" {
+		httpAddr = cfg.Agent.WS.Addr
+	}
+	if httpAddr == "" {
+		httpAddr = ":443"
+	}
+
+	hostPort := httpAddr
+	if strings.HasPrefix(hostPort, ":") {
+		hostPort = "localhost" + hostPort
+	}
+	swagger_app.SwaggerInfo.Host = hostPort
+	httpTimeout := cfg.Agent.HTTP.Timeout.Duration
+	if httpTimeout <= 0 {
+		httpTimeout = 10 * time.Second
+	}
+	handshakeTimeout := cfg.Agent.WS.HandshakeTimeout.Duration
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = gateway.DefaultHandshakeTimeout
+	}
+
+	// WriteTimeout and IdleTimeout only bound plain HTTP requests: the
+	// gateway clears them on WebSocket connections and enforces the agent.ws
+	// settings instead.
+	server := &http.Server{
+		Addr:              httpAddr,
+		Handler:           router,
+		ReadHeaderTimeout: handshakeTimeout,
+		WriteTimeout:      httpTimeout,
+		IdleTimeout:       httpTimeout,
+	}
+
+	// 3. Ensure certificates are available and start server with Graceful Shutdown
+	if err := ssl.EnsureSSL(); err != nil {
+		logger.Printf("error: could not ensure certificates: %v", err)
+		return 1
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		logger.Println("Starting MCP gateway on https://" + hostPort)
+		if err := server.ListenAndServeTLS("backend/services/ssl/cert.pem", "backend/services/ssl/key.pem"); err != nil && err != http.ErrServerClosed {
+			serveErr <- err
+		}
+	}()
+
+	// Reload the configuration when the file changes or on SIGHUP.
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	watcher := config.NewWatcher(configPath, func(next *config.Config) error {
+		if err := gatewayApp.Apply(next); err != nil {
+			return err
+		}
+		adminAPI.SetToken(next.Admin.Token)
+		if *listen == "" && (next.Agent.HTTP.Addr != cfg.Agent.HTTP.Addr || next.Agent.WS.Addr != cfg.Agent.WS.Addr) {
+			logger.Printf("listen address changes take effect after a restart")
+		}
+		return nil
+	}, logger)
+	go func() {
+		if err := watcher.Run(watchCtx); err != nil {
+			logger.Printf("warning: config file watching disabled: %v", err)
+		}
+	}()
+
+	// Wait for interrupt signal to gracefully shut down the server
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(quit)
+wait:
+	for {
+		select {
+		case err := <-serveErr:
+			logger.Printf("error: could not listen on %s: %v", server.Addr, err)
+			return 1
+		case sig := <-quit:
+			if sig != syscall.SIGHUP {
+				break wait
+			}
+			logger.Println("SIGHUP received, reloading configuration")
+			watcher.Trigger()
+		}
+	}
+	logger.Println("Shutting down server...")
+
+	// http.Server.Shutdown does not track the hijacked WebSocket connections,
+	// so the gateway drains its sessions itself. A second signal closes them
+	// without waiting.
+	drainCtx, forceClose := context.WithCancel(context.Background())
+	defer forceClose()
+	go func() {
+		for {
+			select {
+			case sig := <-quit:
+				if sig == syscall.SIGHUP {
+					continue
+				}
+				logger.Println("Closing sessions without waiting")
+				forceClose()
+			case <-drainCtx.Done():
+			}
+			return
+		}
+	}()
+	drained := make(chan error, 1)
+	go func() {
+		drained <- gatewayApp.Shutdown(drainCtx)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	code := 0
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Printf("error: server forced to shutdown: %v", err)
+		code = 1
+	}
+	if err := <-drained; err != nil {
+		logger.Printf("error: sessions closed before they drained: %v", err)
+		code = 1
+	}
+
+	logger.Println("Server exiting")
+	return code
+}
@@ -0,0 +1,261 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"mcpgo/backend/apps/gateway"
+	"mcpgo/backend/services/mcp"
+)
+
+// upstreamFlags are the flags of the commands that talk to upstream servers.
+type upstreamFlags struct {
+	*options
+	server  string
+	timeout time.Duration
+	json    bool
+}
+
+func newUpstreamFlagSet(name string, stdout, stderr io.Writer) (*flag.FlagSet, *upstreamFlags) {
+	fs, opts := newFlagSet(name, stdout, stderr)
+	flags := &upstreamFlags{options: opts}
+	// Probe failures are part of the output; keep the log for real errors.
+	opts.logLevel = "error"
+	fs.Lookup("log-level").DefValue = "error"
+	fs.StringVar(&flags.server, "server", "", "only use the upstream server with this ID")
+	fs.DurationVar(&flags.timeout, "timeout", 10*time.Second, "how long to wait for upstream servers")
+	fs.BoolVar(&flags.json, "json", false, "print JSON instead of a table")
+	return fs, flags
+}
+
+// newApp loads the configuration and creates a gateway app for it, without
+// connecting to the upstream servers.
+func (o *options) newApp() (*gateway.App, error) {
+	logger, err := o.logger()
+	if err != nil {
+		return nil, err
+	}
+	cfg, _, err := o.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return gateway.NewAppFromConfig(cfg, logger)
+}
+
+// probe loads the configuration and probes the selected upstream servers
+// concurrently. Disabled servers are reported without being contacted unless
+// selected explicitly.
+func (f *upstreamFlags) probe(ctx context.Context) ([]gateway.ServerInfo, error) {
+	app, err := f.newApp()
+	if err != nil {
+		return nil, err
+	}
+	return f.probeWith(ctx, app)
+}
+
+// probeWith probes the selected upstream servers of app.
+func (f *upstreamFlags) probeWith(ctx context.Context, app *gateway.App) ([]gateway.ServerInfo, error) {
+	servers := app.Servers()
+	if f.server != "" {
+		info, err := app.Server(f.server)
+		if err != nil {
+			return nil, err
+		}
+		servers = []gateway.ServerInfo{info}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		if server.Disabled && f.server == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			if info, err := app.RefreshServer(ctx, id); err == nil {
+				servers[i] = info
+			}
+		}(i, server.ID)
+	}
+	wg.Wait()
+	return servers, nil
+}
+
+func listServers(args []string, stdout, stderr io.Writer) int {
+	fs, flags := newUpstreamFlagSet("servers list", stdout, stderr)
+	if _, code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	servers, err := flags.probe(context.Background())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if flags.json {
+		return writeJSON(stdout, stderr, servers)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tTOOLS\tADDRESS\tERROR")
+	for _, server := range servers {
+		address := server.Address
+		if len(server.Endpoints) > 0 {
+			address = fmt.Sprintf("%s (+%d)", server.Endpoints[0].Address, len(server.Endpoints)-1)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", server.ID, server.Status, len(server.Tools), address, server.LastError)
+	}
+	w.Flush()
+	return 0
+}
+
+func listTools(args []string, stdout, stderr io.Writer) int {
+	fs, flags := newUpstreamFlagSet("tools list", stdout, stderr)
+	if _, code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	servers, err := flags.probe(context.Background())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	status := 0
+	for _, server := range servers {
+		if server.Status == gateway.StatusOffline {
+			fmt.Fprintf(stderr, "%s: %s\n", server.ID, server.LastError)
+			status = 1
+		}
+	}
+	if flags.json {
+		catalog := make(map[string][]mcp.Tool)
+		for _, server := range servers {
+			if server.Status == gateway.StatusOnline {
+				catalog[server.ID] = append([]mcp.Tool{}, server.Tools...)
+			}
+		}
+		if code := writeJSON(stdout, stderr, catalog); code != 0 {
+			return code
+		}
+		return status
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tTOOL\tDESCRIPTION")
+	for _, server := range servers {
+		for _, tool := range server.Tools {
+			description, _, _ := strings.Cut(tool.Description, "\n")
+			fmt.Fprintf(w, "%s\t%s\t%s\n", server.ID, tool.Name, description)
+		}
+	}
+	w.Flush()
+	return status
+}
+
+// callTool calls a tool on the upstream server that offers it. Arguments are
+// given as a JSON object, either positionally or with -args.
+func callTool(args []string, stdout, stderr io.Writer) int {
+	fs, flags := newUpstreamFlagSet("call", stdout, stderr)
+	arguments := fs.String("args", "", "tool arguments as a JSON object")
+	positional, code, ok := parse(fs, args)
+	if !ok {
+		return code
+	}
+	if len(positional) == 0 || len(positional) > 2 || len(positional) == 2 && *arguments != "" {
+		fmt.Fprintln(stderr, "usage: mcpgo call <tool> [arguments] [-server id] [-args json]")
+		return 2
+	}
+	name := positional[0]
+	if len(positional) == 2 {
+		*arguments = positional[1]
+	}
+	params := mcp.CallToolParams{Name: name}
+	if *arguments != "" {
+		if !json.Valid([]byte(*arguments)) || !strings.HasPrefix(strings.TrimSpace(*arguments), "{") {
+			fmt.Fprintln(stderr, "tool arguments must be a JSON object")
+			return 2
+		}
+		params.Arguments = json.RawMessage(*arguments)
+	}
+
+	servers, err := flags.probe(context.Background())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	server, err := findTool(servers, name)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flags.timeout)
+	defer cancel()
+	address := server.Address
+	if address == "" && len(server.Endpoints) > 0 {
+		address = server.Endpoints[0].Address
+	}
+	client, err := mcp.Dial(ctx, address, flags.timeout)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer client.Close()
+	if _, err := client.Initialize(ctx); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	var result mcp.CallToolResult
+	if err := client.Call(ctx, "tools/call", params, &result); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	if code := writeJSON(stdout, stderr, result); code != 0 {
+		return code
+	}
+	if result.IsError {
+		return 1
+	}
+	return 0
+}
+
+// findTool returns the first online server offering the named tool.
+func findTool(servers []gateway.ServerInfo, name string) (gateway.ServerInfo, error) {
+	var problems []string
+	for _, server := range servers {
+		if server.Status == gateway.StatusOffline {
+			problems = append(problems, fmt.Sprintf("%s: %s", server.ID, server.LastError))
+		}
+		for _, tool := range server.Tools {
+			if tool.Name == name {
+				return server, nil
+			}
+		}
+	}
+	err := fmt.Errorf("no online server offers tool %q", name)
+	if len(problems) > 0 {
+		err = fmt.Errorf("%w (%s)", err, strings.Join(problems, "; "))
+	}
+	return gateway.ServerInfo{}, err
+}
+
+func writeJSON(stdout, stderr io.Writer, v interface{}) int {
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
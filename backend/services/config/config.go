@@ -27,53 +27,611 @@ func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
 	}
 	parsed, err := time.ParseDuration(raw)
 	if err != nil {
-		return err
+		return &yaml.TypeError{Errors: []string{
+			fmt.Sprintf("line %d: invalid duration %q, use a value such as \"10s\" or \"5m\"", value.Line, raw),
+		}}
 	}
 	d.Duration = parsed
 	return nil
 }
 
+// MarshalYAML renders the duration using time.Duration's string form.
+func (d Duration) MarshalYAML() (interface{}, error) {
+	if d.Duration == 0 {
+		return "", nil
+	}
+	return d.Duration.String(), nil
+}
+
 // AgentConfig controls how the agent-facing HTTP/WebSocket endpoints behave.
 type AgentConfig struct {
-	HTTP struct {
-		Addr    string   `yaml:"addr"`
-		Timeout Duration `yaml:"timeout"`
-	} `yaml:"http"`
-	WS struct {
-		Addr string `yaml:"addr"`
-	} `yaml:"ws"`
+	HTTP AgentHTTPConfig `yaml:"http"`
+	WS   AgentWSConfig   `yaml:"ws"`
+}
+
+// AgentHTTPConfig configures the agent-facing HTTP listener.
+type AgentHTTPConfig struct {
+	Addr string `yaml:"addr"`
+	// Timeout bounds plain HTTP requests such as the admin API. WebSocket
+	// sessions are governed by AgentWSConfig instead.
+	Timeout Duration `yaml:"timeout"`
+}
+
+// AgentWSConfig configures the agent-facing WebSocket listener and the
+// lifetime of agent connections. Zero durations select the defaults.
+type AgentWSConfig struct {
+	Addr string `yaml:"addr"`
+	// HandshakeTimeout bounds the WebSocket upgrade and the time until the
+	// agent sends its first message. The default is 10s.
+	HandshakeTimeout Duration `yaml:"handshake_timeout"`
+	// WriteTimeout bounds sending a single message to the agent. The
+	// default is 10s.
+	WriteTimeout Duration `yaml:"write_timeout"`
+	// IdleTimeout closes the agent's connection when it sends nothing for
+	// this long. Zero disables it.
+	IdleTimeout Duration `yaml:"idle_timeout"`
+	// MaxLifetime closes sessions this long after they started. Zero
+	// disables it.
+	MaxLifetime Duration `yaml:"max_lifetime"`
+	// PingInterval is how often the gateway pings the agent to keep the
+	// connection open through proxies. The default is 30s.
+	PingInterval Duration `yaml:"ping_interval"`
+}
+
+// AdminConfig controls the administrative REST API served under /admin.
+type AdminConfig struct {
+	// Token is the bearer token required on every admin request. The admin
+	// API is disabled when it is empty.
+	Token string `yaml:"token"`
 }
 
 // ServerConfig defines an upstream MCP server.
 type ServerConfig struct {
 	ID       string `yaml:"id"`
 	Name     string `yaml:"name"`
-	Address  string `yaml:"address"`
+	Address  string `yaml:"address,omitempty"`
 	Protocol string `yaml:"protocol"`
+	Policy   string `yaml:"policy,omitempty"`
+	Disabled bool   `yaml:"disabled,omitempty"`
+	// Aggregate makes the server a virtual server combining the catalogs
+	// of the listed servers, used instead of Address. Its sessions connect
+	// to every listed server.
+	Aggregate []string `yaml:"aggregate,omitempty"`
+	// Endpoints lists identical replicas of the server, used instead of
+	// Address. Sessions are spread across them according to Balancing.
+	Endpoints []EndpointConfig `yaml:"endpoints,omitempty"`
+	Balancing BalancingConfig  `yaml:"balancing,omitempty"`
+	// Stateless servers keep no per-session state, so the gateway can
+	// multiplex many agent sessions over a shared pool of connections.
+	Stateless bool       `yaml:"stateless,omitempty"`
+	Pool      PoolConfig `yaml:"pool,omitempty"`
+	// RequestTimeout bounds how long the gateway waits for the response to
+	// a request before answering it with a timeout error and cancelling it
+	// upstream. Zero waits indefinitely.
+	RequestTimeout Duration `yaml:"request_timeout,omitempty"`
+	// Failover is the fallback applied when a tools/call fails.
+	Failover FailoverConfig `yaml:"failover,omitempty"`
+	// Tools holds settings for individual tools, keyed by tool name.
+	Tools map[string]ToolConfig `yaml:"tools,omitempty"`
+	// Expose limits which of the server's tools, resources and prompts
+	// agents can see and use.
+	Expose ExposeConfig `yaml:"expose,omitempty"`
+	// Validation controls the checks of tool calls against the schemas of
+	// the server's tools.
+	Validation ValidationConfig `yaml:"validation,omitempty"`
+	// Approval holds calls of the server's tools that need a human's
+	// approval until they are approved.
+	Approval ApprovalConfig `yaml:"approval,omitempty"`
+	// Pinning adjusts the pinning of the server's tool definitions.
+	Pinning ServerPinningConfig `yaml:"pinning,omitempty"`
+	// Cache controls caching of the server's responses.
+	Cache CacheConfig `yaml:"cache,omitempty"`
+	// ServerRequests restricts the requests the server may send to agents.
+	ServerRequests ServerRequestsConfig `yaml:"server_requests,omitempty"`
+
+	// Source is the included fragment file the server was defined in, or
+	// empty when it was defined in the main configuration file.
+	Source string `yaml:"-"`
+}
+
+// ReplicaEndpoints returns the server's replicas: Endpoints, or Address as a
+// single replica of weight 1.
+func (s ServerConfig) ReplicaEndpoints() []EndpointConfig {
+	if len(s.Endpoints) > 0 {
+		return s.Endpoints
+	}
+	return []EndpointConfig{{Address: s.Address, Weight: 1}}
+}
+
+// EndpointConfig is one replica of an upstream server.
+type EndpointConfig struct {
+	Address string `yaml:"address"`
+	// Weight is the replica's share of sessions relative to the other
+	// replicas. Zero counts as 1.
+	Weight int `yaml:"weight,omitempty"`
+}
+
+// BalancingConfig controls how sessions are spread across a server's
+// replicas. Zero values select the defaults.
+type BalancingConfig struct {
+	// Strategy is one of SupportedBalancingStrategies; the default is
+	// "round-robin".
+	Strategy string `yaml:"strategy,omitempty"`
+	// HashHeader names the request header that identifies the caller for
+	// "consistent-hash". When empty, or when the agent does not send it,
+	// the agent's IP address is used.
+	HashHeader string `yaml:"hash_header,omitempty"`
+	// Ejection takes replicas that keep failing out of rotation.
+	Ejection EjectionConfig `yaml:"ejection,omitempty"`
+}
+
+// EjectionConfig controls outlier ejection: a replica that fails
+// ConsecutiveFailures connection attempts in a row receives no new
+// sessions for Duration.
+type EjectionConfig struct {
+	ConsecutiveFailures int      `yaml:"consecutive_failures,omitempty"`
+	Duration            Duration `yaml:"duration,omitempty"`
+}
+
+// PoolConfig sizes the connection pool of a stateless server. Zero values
+// select the defaults.
+type PoolConfig struct {
+	// MaxConnections bounds the connections opened to the server.
+	MaxConnections int `yaml:"max_connections,omitempty"`
+	// IdleTimeout closes connections that carried no request for this long.
+	IdleTimeout Duration `yaml:"idle_timeout,omitempty"`
+}
+
+// Failover triggers accepted in FailoverConfig.On.
+const (
+	// FailoverOnUnavailable triggers when the upstream connection is lost
+	// before the call is answered.
+	FailoverOnUnavailable = "unavailable"
+	// FailoverOnError triggers on a JSON-RPC error response.
+	FailoverOnError = "error"
+	// FailoverOnToolError triggers on a result with isError set.
+	FailoverOnToolError = "tool_error"
+)
+
+// FailoverConfig controls what the gateway does when a tools/call fails.
+// It can retry the call on another replica of the server, then on the
+// fallback servers in order, and finally answer read-only tools with the
+// last result that succeeded. Only idempotent tools are retried unless
+// RetryNonIdempotent is set.
+type FailoverConfig struct {
+	// Disabled turns failover off, typically for a single tool.
+	Disabled bool `yaml:"disabled,omitempty"`
+	// On lists the failures that trigger failover; the default is
+	// "unavailable".
+	On []string `yaml:"on,omitempty"`
+	// MaxAttempts bounds the attempts made for one call, including the
+	// first. The default is 2.
+	MaxAttempts int `yaml:"max_attempts,omitempty"`
+	// Replicas retries the call on the server's other endpoints.
+	Replicas bool `yaml:"replicas,omitempty"`
+	// Fallbacks are alternate servers exposing an equivalent tool.
+	Fallbacks []FallbackConfig `yaml:"fallbacks,omitempty"`
+	// CachedResult answers read-only tools with their last good result
+	// when every attempt failed.
+	CachedResult       bool `yaml:"cached_result,omitempty"`
+	RetryNonIdempotent bool `yaml:"retry_non_idempotent,omitempty"`
+}
+
+// FallbackConfig names an alternate server for failed tool calls.
+type FallbackConfig struct {
+	Server string `yaml:"server"`
+	// Tool is the name of the equivalent tool on Server; the default is
+	// the name of the tool that was called.
+	Tool string `yaml:"tool,omitempty"`
+}
+
+// ToolConfig holds the settings of a single tool of a server.
+type ToolConfig struct {
+	// ReadOnly and Idempotent declare the tool's behaviour when the server
+	// does not advertise it through readOnlyHint and idempotentHint.
+	ReadOnly   bool `yaml:"read_only,omitempty"`
+	Idempotent bool `yaml:"idempotent,omitempty"`
+	// Timeout replaces the server's RequestTimeout for calls of the tool.
+	Timeout Duration `yaml:"timeout,omitempty"`
+	// Failover overrides the server's failover settings for the tool. Set
+	// fields replace the server's values.
+	Failover FailoverConfig `yaml:"failover,omitempty"`
+	// CacheTTL replaces the server's Cache.ToolTTL for calls of the tool.
+	CacheTTL Duration `yaml:"cache_ttl,omitempty"`
+	// Rename exposes the tool to agents under another name; the tool's
+	// own name is hidden.
+	Rename string `yaml:"rename,omitempty"`
+	// Description replaces the description the server gives the tool.
+	Description string `yaml:"description,omitempty"`
+	// InputSchema is applied to the tool's inputSchema as a JSON merge
+	// patch, e.g. to require arguments or narrow their values: set fields
+	// replace the server's, objects are merged and null removes a field.
+	InputSchema map[string]interface{} `yaml:"input_schema,omitempty"`
+	// Arguments transforms the arguments of calls of the tool before they
+	// are forwarded, keyed by argument name.
+	Arguments map[string]ArgumentConfig `yaml:"arguments,omitempty"`
+}
+
+// ArgumentConfig transforms one argument of a tool's calls. String values
+// of Default and Value are Go templates drawing on the agent's connection:
+// {{.Header "X-User-Id"}}, {{.RemoteAddr}}, {{.Session.ID}},
+// {{.Session.Server}}, {{.Client.Name}} and {{.Client.Version}}. Headers
+// and client info are sent by the agent and are not authenticated.
+type ArgumentConfig struct {
+	// Default is used when a call does not set the argument; the argument
+	// is no longer required in the schema advertised to agents.
+	Default interface{} `yaml:"default,omitempty"`
+	// Value replaces whatever a call sets; the argument is no longer
+	// required in the advertised schema.
+	Value interface{} `yaml:"value,omitempty"`
+	// Hidden removes the argument from the advertised schema. A value an
+	// agent sets anyway is dropped, unless Value replaces it.
+	Hidden bool `yaml:"hidden,omitempty"`
+}
+
+// ValidationConfig controls schema validation of a server's tool calls.
+// Arguments are validated against the tool's inputSchema, with the tool's
+// InputSchema override applied, unless DisableArguments is set.
+type ValidationConfig struct {
+	DisableArguments bool `yaml:"disable_arguments,omitempty"`
+	// Output validates the structuredContent of tool results against the
+	// tool's outputSchema.
+	Output bool `yaml:"output,omitempty"`
+}
+
+// ApprovalConfig holds the tool calls matching any of Rules until an
+// operator approves them through the admin API, or the agent's user through
+// an elicitation request when Elicit is set. Calls not approved within
+// Timeout are rejected.
+type ApprovalConfig struct {
+	Rules []ApprovalRule `yaml:"rules,omitempty"`
+	// Timeout bounds the wait for a decision; the default is 5 minutes.
+	Timeout Duration `yaml:"timeout,omitempty"`
+	// MaxPending bounds the server's calls awaiting a decision; calls
+	// beyond it are refused. The default is 100.
+	MaxPending int `yaml:"max_pending,omitempty"`
+	// Elicit also asks agents that support elicitation to have their user
+	// approve the call.
+	Elicit bool `yaml:"elicit,omitempty"`
+}
+
+// ApprovalRule selects tool calls that need approval. A call matches when
+// it meets every condition the rule sets.
+type ApprovalRule struct {
+	// Destructive matches tools that may destroy data: those the server
+	// does not annotate as read-only, or as not destructive, and that are
+	// not declared ReadOnly in their settings.
+	Destructive bool `yaml:"destructive,omitempty"`
+	// Tools are patterns matching the server's names of the tools, in
+	// which * matches any run of characters and ? a single one.
+	Tools []string `yaml:"tools,omitempty"`
+	// Arguments maps argument names to patterns their values must match.
+	// Values other than strings are matched in their JSON encoding.
+	Arguments map[string]string `yaml:"arguments,omitempty"`
+}
+
+// Matches reports whether r selects a call of the tool name with the given
+// arguments, in the string form Arguments patterns match. destructive
+// tells whether the tool may destroy data.
+func (r ApprovalRule) Matches(name string, destructive bool, arguments map[string]string) bool {
+	if r.Destructive && !destructive {
+		return false
+	}
+	if len(r.Tools) > 0 && !(FilterConfig{Include: r.Tools}).Allows(name) {
+		return false
+	}
+	for argument, pattern := range r.Arguments {
+		value, ok := arguments[argument]
+		if !ok || !matchPattern(pattern, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// ExposeConfig filters a server's catalogs. Tools and prompts are matched
+// by the name the server gives them and resources and resource templates
+// by URI and URI template.
+type ExposeConfig struct {
+	Tools     FilterConfig `yaml:"tools,omitempty"`
+	Resources FilterConfig `yaml:"resources,omitempty"`
+	Prompts   FilterConfig `yaml:"prompts,omitempty"`
+}
+
+// FilterConfig selects catalog items with patterns in which * matches any
+// run of characters and ? a single one. An item is exposed when it matches
+// a pattern of Include, or Include is empty, and no pattern of Exclude.
+type FilterConfig struct {
+	Include []string `yaml:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+}
+
+// Allows reports whether f exposes the item called name.
+func (f FilterConfig) Allows(name string) bool {
+	included := len(f.Include) == 0
+	for _, pattern := range f.Include {
+		if matchPattern(pattern, name) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range f.Exclude {
+		if matchPattern(pattern, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPattern reports whether name matches pattern, in which * matches any
+// run of characters and ? a single one.
+func matchPattern(pattern, name string) bool {
+	p, n := []rune(pattern), []rune(name)
+	// star is the position of the last * seen in the pattern and mark that
+	// of the name when it was; a mismatch lets the * take one more rune.
+	i, j, star, mark := 0, 0, -1, 0
+	for j < len(n) {
+		switch {
+		case i < len(p) && p[i] == '*':
+			star, mark = i, j
+			i++
+		case i < len(p) && (p[i] == '?' || p[i] == n[j]):
+			i++
+			j++
+		case star >= 0:
+			mark++
+			i, j = star+1, mark
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
+
+// CacheConfig controls which responses of a server the gateway caches and
+// for how long. Responses are cached per caller scope: the agent's protocol
+// version and capabilities and, when ScopeHeader is set, that header of the
+// agent's request. Zero values select the defaults.
+type CacheConfig struct {
+	// Disabled turns caching off for the server.
+	Disabled bool `yaml:"disabled,omitempty"`
+	// ListTTL bounds how long tools/list, resources/list,
+	// resources/templates/list and prompts/list results are cached. They
+	// are also dropped when the server sends the matching list_changed
+	// notification. The default is 5m.
+	ListTTL Duration `yaml:"list_ttl,omitempty"`
+	// ResourceTTL enables caching resources/read results for this long,
+	// or until the server reports the resource updated. Zero disables it.
+	ResourceTTL Duration `yaml:"resource_ttl,omitempty"`
+	// ToolTTL enables caching the successful tools/call results of
+	// read-only and idempotent tools for this long. Zero disables it.
+	ToolTTL Duration `yaml:"tool_ttl,omitempty"`
+	// MaxEntries bounds the responses cached for the server. The default
+	// is 1000.
+	MaxEntries int `yaml:"max_entries,omitempty"`
+	// ScopeHeader names a header of the agent's WebSocket request, such as
+	// a tenant or authorization header, whose value separates the cached
+	// responses of different callers.
+	ScopeHeader string `yaml:"scope_header,omitempty"`
+}
+
+// ServerRequestsConfig restricts the requests a server sends to agents,
+// such as sampling/createMessage.
+type ServerRequestsConfig struct {
+	// Block lists methods, from SupportedServerRequests, that the gateway
+	// refuses on the agents' behalf.
+	Block []string `yaml:"block,omitempty"`
+	// MaxTokens caps the maxTokens of sampling/createMessage requests. Zero
+	// leaves them as sent.
+	MaxTokens int `yaml:"max_tokens,omitempty"`
+}
+
+// LimitsConfig bounds the load agents can put on the gateway. Zero values
+// disable the corresponding limit.
+type LimitsConfig struct {
+	Rate        RateLimitConfig        `yaml:"rate"`
+	Concurrency ConcurrencyLimitConfig `yaml:"concurrency"`
+}
+
+// RateLimitConfig is a token bucket refilled at RequestsPerSecond that holds
+// at most Burst requests.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+}
+
+// ConcurrencyLimitConfig bounds the number of requests awaiting a response.
+type ConcurrencyLimitConfig struct {
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests"`
+}
+
+// PolicyConfig is a named set of rules that servers opt into by referencing
+// it from ServerConfig.Policy.
+type PolicyConfig struct {
+	// Limits apply to the requests sent to each server using the policy, on
+	// top of the gateway-wide limits.
+	Limits LimitsConfig `yaml:"limits"`
+}
+
+// RoutingConfig controls how sessions are routed to upstream servers.
+type RoutingConfig struct {
+	Strategy string `yaml:"strategy"`
+	// CursorSecret signs the pagination cursors of aggregated servers. When
+	// empty a random secret is used, and cursors are only accepted by the
+	// gateway instance that issued them.
+	CursorSecret string `yaml:"cursor_secret"`
+}
+
+// ReloadConfig controls how configuration changes are applied at runtime.
+type ReloadConfig struct {
+	// DrainTimeout is how long sessions on a removed or replaced server may
+	// keep running before they are closed. Zero waits indefinitely.
+	DrainTimeout Duration `yaml:"drain_timeout"`
+}
+
+// ShutdownConfig controls how the gateway stops on SIGINT or SIGTERM.
+type ShutdownConfig struct {
+	// DrainTimeout is how long requests in flight may take to complete
+	// before the remaining sessions are closed. The default is 30s.
+	DrainTimeout Duration `yaml:"drain_timeout"`
+}
+
+// Pinning actions accepted in PinningConfig.OnChange.
+const (
+	// PinningBlock hides a changed tool from agents and refuses its calls.
+	PinningBlock = "block"
+	// PinningQuarantine keeps listing the approved definition of a changed
+	// tool and holds each of its calls for approval.
+	PinningQuarantine = "quarantine"
+	// PinningFlag passes a changed tool through and only reports it.
+	PinningFlag = "flag"
+)
+
+// PinningConfig pins the definitions of the servers' tools in a lockfile:
+// a tool is pinned when it is first seen, and a definition that differs
+// from the pinned one is treated according to OnChange until an operator
+// approves it.
+type PinningConfig struct {
+	// Lockfile is the file the pins are kept in, relative to the
+	// configuration file. Pinning is off when it is empty.
+	Lockfile string `yaml:"lockfile"`
+	// OnChange is one of SupportedPinningActions; the default is "block".
+	OnChange string `yaml:"on_change"`
+}
+
+// ServerPinningConfig adjusts pinning for a single server.
+type ServerPinningConfig struct {
+	Disabled bool `yaml:"disabled,omitempty"`
+	// OnChange replaces PinningConfig.OnChange for the server's tools.
+	OnChange string `yaml:"on_change,omitempty"`
+}
+
+// SessionsConfig controls the lifetime of agent sessions.
+type SessionsConfig struct {
+	// ResumeGrace is how long a session and its upstream connection are kept
+	// after the agent's connection drops, waiting for the agent to resume it
+	// with its resume token. Zero disables resumption.
+	ResumeGrace Duration `yaml:"resume_grace"`
+	// ResumeBuffer is the maximum number of upstream messages kept for a
+	// disconnected agent. Older messages are dropped once it is exceeded.
+	ResumeBuffer int `yaml:"resume_buffer"`
+	// Reconnect controls how a session whose upstream connection drops is
+	// reconnected.
+	Reconnect ReconnectConfig `yaml:"reconnect"`
+	// Messages bounds the messages proxied in a session.
+	Messages MessagesConfig `yaml:"messages"`
+}
+
+// Send queue policies accepted in MessagesConfig.QueuePolicy.
+const (
+	// QueuePolicyBlock stops reading from the upstream until the agent has
+	// room for more messages.
+	QueuePolicyBlock = "block"
+	// QueuePolicyDropNotifications discards queued notifications, oldest
+	// first, to make room; responses and requests are never dropped.
+	QueuePolicyDropNotifications = "drop_notifications"
+	// QueuePolicyDisconnect closes the agent's connection.
+	QueuePolicyDisconnect = "disconnect"
+)
+
+// MessagesConfig bounds message sizes and the messages waiting to be sent
+// to an agent. Zero values select the defaults.
+type MessagesConfig struct {
+	// MaxAgentSize and MaxUpstreamSize bound, in bytes, a single message
+	// from the agent and from the upstream server. A connection sending a
+	// larger message is closed with close code 1009. The default is 32 MiB.
+	MaxAgentSize    int `yaml:"max_agent_size"`
+	MaxUpstreamSize int `yaml:"max_upstream_size"`
+	// QueueSize is the number of messages queued for an agent that reads
+	// them more slowly than they arrive. The default is 256.
+	QueueSize int `yaml:"queue_size"`
+	// QueuePolicy is one of SupportedQueuePolicies and says what happens
+	// when the queue is full; the default is "block".
+	QueuePolicy string `yaml:"queue_policy"`
+}
+
+// ReconnectConfig controls transparent upstream reconnection. The gateway
+// redials with exponential backoff, starting at InitialBackoff and doubling
+// up to MaxBackoff, and gives up after MaxAttempts. Zero values select the
+// defaults.
+type ReconnectConfig struct {
+	Disabled       bool     `yaml:"disabled"`
+	MaxAttempts    int      `yaml:"max_attempts"`
+	InitialBackoff Duration `yaml:"initial_backoff"`
+	MaxBackoff     Duration `yaml:"max_backoff"`
 }
 
 // Config represents the full gateway configuration.
 type Config struct {
-	Agent   AgentConfig    `yaml:"agent"`
-	Servers []ServerConfig `yaml:"servers"`
+	// Include lists files, directories or glob patterns, relative to the
+	// configuration file, whose server definitions are appended to Servers.
+	Include  []string                `yaml:"include"`
+	Agent    AgentConfig             `yaml:"agent"`
+	Admin    AdminConfig             `yaml:"admin"`
+	Routing  RoutingConfig           `yaml:"routing"`
+	Servers  []ServerConfig          `yaml:"servers"`
+	Limits   LimitsConfig            `yaml:"limits"`
+	Policies map[string]PolicyConfig `yaml:"policies"`
+	Reload   ReloadConfig            `yaml:"reload"`
+	Sessions SessionsConfig          `yaml:"sessions"`
+	Shutdown ShutdownConfig          `yaml:"shutdown"`
+	Pinning  PinningConfig           `yaml:"pinning"`
+
+	sources []string
+}
+
+// Sources returns the files and include entries the configuration was
+// assembled from, starting with the main file.
+func (c *Config) Sources() []string {
+	return append([]string(nil), c.sources...)
 }
 
-// Load reads configuration from the provided path. If the file does not exist,
-// an error is returned.
+// ErrNotFound is returned by Load when the configuration file does not exist.
+var ErrNotFound = errors.New("config file not found")
+
+// Load reads and validates configuration from the provided path. Included
+// server fragments are merged, ${VAR} references are interpolated from the
+// environment, file: values of secret settings are replaced by the content
+// of the named file and MCPGO_* environment variables override scalar settings. Unknown
+// keys and semantic mistakes are rejected; the returned error points at the
+// offending file, line and column. If the file does not exist, an error
+// wrapping ErrNotFound is returned.
 func Load(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			return nil, fmt.Errorf("config file %s not found", path)
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, path)
 		}
 		return nil, err
 	}
+	return Parse(path, data)
+}
 
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+// Parse decodes and validates configuration data. name is used to prefix
+// error positions and is usually the file path.
+func Parse(name string, data []byte) (*Config, error) {
+	doc, err := parseDocument(name, data)
+	if err != nil {
+		return nil, err
 	}
 
+	var cfg Config
+	if err := doc.decode(&cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		doc.locate(err)
+		return nil, err
+	}
+	if lockfile := cfg.Pinning.Lockfile; lockfile != "" && !filepath.IsAbs(lockfile) {
+		cfg.Pinning.Lockfile = filepath.Join(filepath.Dir(name), lockfile)
+	}
 	return &cfg, nil
 }
 
@@ -97,6 +655,11 @@ func LoadFromEnv() (*Config, string, error) {
 		if err == nil {
 			return cfg, candidate, nil
 		}
+		// Only fall back to the next candidate when the file is missing; an
+		// invalid configuration must not be silently replaced by another.
+		if !errors.Is(err, ErrNotFound) {
+			return nil, candidate, err
+		}
 		lastErr = err
 	}
 	if lastErr == nil {
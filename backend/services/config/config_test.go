@@ -1,9 +1,17 @@
 package config_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"mcpgo/backend/services/config"
 )
@@ -45,3 +53,279 @@ func TestLoadParsesServerConfiguration(t *testing.T) {
 		t.Fatalf("expected loaded config http addr %q, got %q", cfg.Agent.HTTP.Addr, loaded.Agent.HTTP.Addr)
 	}
 }
+
+func TestWatcherAppliesValidChangesOnly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+	write("servers:\n  - id: \"a\"\n    address: \"ws://localhost:1234/mcp\"\n")
+
+	applied := make(chan *config.Config, 4)
+	watcher := config.NewWatcher(path, func(cfg *config.Config) error {
+		applied <- cfg
+		return nil
+	}, log.New(io.Discard, "", 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watcher.Run(ctx)
+
+	// The watcher may not have registered yet when the file first changes,
+	// so keep rewriting it, more slowly than the watcher debounces changes,
+	// until a reload is applied.
+	deadline := time.After(5 * time.Second)
+	for reloaded := false; !reloaded; {
+		write("servers:\n  - id: \"a\"\n    address: \"ws://localhost:1234/mcp\"\n  - id: \"b\"\n    address: \"ws://localhost:5678/mcp\"\n")
+		select {
+		case cfg := <-applied:
+			if len(cfg.Servers) != 2 {
+				t.Fatalf("expected 2 servers after reload, got %d", len(cfg.Servers))
+			}
+			reloaded = true
+		case <-time.After(time.Second):
+		case <-deadline:
+			t.Fatal("timed out waiting for config reload")
+		}
+	}
+
+	cancel()
+	write("servers:\n  - id: \"a\"\n    address: \"ws://localhost:1234/mcp\"\n  - id: \"a\"\n    address: \"ftp://localhost\"\n")
+	if err := watcher.Reload(); err == nil {
+		t.Fatal("expected invalid config to be rejected")
+	}
+	select {
+	case cfg := <-applied:
+		t.Fatalf("invalid config was applied: %+v", cfg)
+	default:
+	}
+}
+
+func TestLoadReportsProblemsWithPositions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	content := "servers:\n  - id: \"a\"\n    address: \"http://localhost:9001/mcp\"\n    policy: \"strict\"\n  - id: \"a\"\n    address: \"ws://localhost:9002/mcp\"\n    protocl: \"mcp\"\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	_, err := config.Load(path)
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	if len(verr.Errors) != 1 || verr.Errors[0].Line != 7 || !strings.Contains(verr.Errors[0].Message, `unknown key "protocl"`) {
+		t.Fatalf("expected unknown key error on line 7, got %v", err)
+	}
+
+	content = strings.Replace(content, "protocl", "protocol", 1)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	_, err = config.Load(path)
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	want := map[string]int{
+		"servers[0].address": 3,
+		"servers[0].policy":  4,
+		"servers[1].id":      5,
+	}
+	if len(verr.Errors) != len(want) {
+		t.Fatalf("expected %d errors, got %v", len(want), err)
+	}
+	for _, fieldErr := range verr.Errors {
+		if line, ok := want[fieldErr.Field]; !ok || fieldErr.Line != line || fieldErr.File != path {
+			t.Fatalf("unexpected error %q (field %s, line %d)", fieldErr.Error(), fieldErr.Field, fieldErr.Line)
+		}
+	}
+
+	t.Setenv("MCPGO_CONFIG", path)
+	if _, _, err := config.LoadFromEnv(); !errors.As(err, &verr) {
+		t.Fatalf("expected invalid MCPGO_CONFIG not to fall back to another file, got %v", err)
+	}
+}
+
+func TestLoadResolvesIncludesVariablesAndSecrets(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		return path
+	}
+	write("secrets/admin-token", "s3cret\n")
+	write("servers.d/b.yaml", "- id: \"b\"\n  address: \"ws://${B_HOST:-localhost}:5678/mcp\"\n")
+	write("servers.d/c.yml", "id: \"c\"\naddress: \"ws://localhost:9012/mcp\"\n")
+	path := write("config.yaml", "include:\n  - servers.d\nadmin:\n  token: \"file:secrets/admin-token\"\nlimits:\n  rate:\n    burst: ${BURST}\nservers:\n  - id: \"a\"\n    address: \"ws://${A_HOST}:1234/mcp\"\n")
+
+	if _, err := config.Load(path); err == nil || !strings.Contains(err.Error(), "BURST") {
+		t.Fatalf("expected an error naming the unset variable, got %v", err)
+	}
+
+	t.Setenv("A_HOST", "upstream.internal")
+	t.Setenv("BURST", "5")
+	t.Setenv("MCPGO_LIMITS_RATE_REQUESTS_PER_SECOND", "2.5")
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if cfg.Admin.Token != "s3cret" {
+		t.Fatalf("expected admin token from secret file, got %q", cfg.Admin.Token)
+	}
+	if cfg.Limits.Rate.Burst != 5 || cfg.Limits.Rate.RequestsPerSecond != 2.5 {
+		t.Fatalf("unexpected rate limits %+v", cfg.Limits.Rate)
+	}
+	var ids []string
+	for _, server := range cfg.Servers {
+		ids = append(ids, server.ID+"@"+filepath.Base(server.Source))
+	}
+	if got := strings.Join(ids, " "); got != "a@. b@b.yaml c@c.yml" {
+		t.Fatalf("unexpected servers %s", got)
+	}
+	if cfg.Servers[0].Address != "ws://upstream.internal:1234/mcp" || cfg.Servers[1].Address != "ws://localhost:5678/mcp" {
+		t.Fatalf("unexpected addresses %q, %q", cfg.Servers[0].Address, cfg.Servers[1].Address)
+	}
+
+	// Only secret settings read file: values from disk; others, such as
+	// file:// URI patterns, are kept as they are.
+	uris := write("uris.yaml", "admin:\n  token: \"file:secrets/admin-token\"\nservers:\n  - id: \"files\"\n    address: \"ws://localhost:1234/mcp\"\n    expose:\n      resources:\n        exclude: [\"file:///etc/*\"]\n    approval:\n      rules:\n        - arguments:\n            path: \"file:///home/*\"\n")
+	cfg, err = config.Load(uris)
+	if err != nil {
+		t.Fatalf("failed to load a config with file:// patterns: %v", err)
+	}
+	if cfg.Admin.Token != "s3cret" || cfg.Servers[0].Expose.Resources.Exclude[0] != "file:///etc/*" || cfg.Servers[0].Approval.Rules[0].Arguments["path"] != "file:///home/*" {
+		t.Fatalf("unexpected values %q, %+v", cfg.Admin.Token, cfg.Servers[0])
+	}
+
+	t.Setenv("MCPGO_ADMIN_TOKEN", "override")
+	if cfg, err = config.Load(path); err != nil || cfg.Admin.Token != "override" {
+		t.Fatalf("expected MCPGO_ADMIN_TOKEN to override admin.token, got %v", err)
+	}
+
+	// Errors in a fragment point at the fragment file.
+	fragment := write("servers.d/c.yml", "id: \"c\"\naddress: \"http://localhost:9012/mcp\"\n")
+	_, err = config.Load(path)
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) || len(verr.Errors) != 1 || verr.Errors[0].File != fragment || verr.Errors[0].Line != 2 {
+		t.Fatalf("expected an error at %s:2, got %v", fragment, err)
+	}
+
+	// Saving servers keeps unexpanded references and leaves fragments alone.
+	cfg.Servers[0].Source = ""
+	if err := config.SaveServers(path, cfg.Servers); err != nil {
+		t.Fatalf("failed to save servers: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	if !strings.Contains(string(data), "${A_HOST}") || strings.Contains(string(data), "id: b") {
+		t.Fatalf("unexpected saved config:\n%s", data)
+	}
+	// Changing one setting of a server keeps the references of the others.
+	cfg.Servers[0].Name = "A"
+	if err := config.SaveServers(path, cfg.Servers); err != nil {
+		t.Fatalf("failed to save servers: %v", err)
+	}
+	if data, _ = os.ReadFile(path); !strings.Contains(string(data), "${A_HOST}") || strings.Contains(string(data), "upstream.internal") || !strings.Contains(string(data), "name: A") {
+		t.Fatalf("expected the changed server to keep its reference, got:\n%s", data)
+	}
+}
+
+func TestSchemaCoversConfig(t *testing.T) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal(config.Schema, &schema); err != nil {
+		t.Fatalf("schema is not valid JSON: %v", err)
+	}
+	defs, _ := schema["$defs"].(map[string]interface{})
+
+	var check func(path string, typ reflect.Type, node map[string]interface{})
+	check = func(path string, typ reflect.Type, node map[string]interface{}) {
+		if ref, ok := node["$ref"].(string); ok {
+			node, _ = defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]interface{})
+		}
+		switch typ.Kind() {
+		case reflect.Slice:
+			items, _ := node["items"].(map[string]interface{})
+			check(path+"[]", typ.Elem(), items)
+			return
+		case reflect.Map:
+			values, _ := node["additionalProperties"].(map[string]interface{})
+			check(path+".*", typ.Elem(), values)
+			return
+		case reflect.Struct:
+		default:
+			return
+		}
+		if typ == reflect.TypeOf(config.Duration{}) {
+			return
+		}
+		props, _ := node["properties"].(map[string]interface{})
+		fields := 0
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			fields++
+			prop, ok := props[name].(map[string]interface{})
+			if !ok {
+				t.Errorf("schema is missing %s.%s", path, name)
+				continue
+			}
+			check(path+"."+name, field.Type, prop)
+		}
+		if len(props) != fields {
+			t.Errorf("schema for %s has %d properties, config has %d fields", path, len(props), fields)
+		}
+	}
+	check("config", reflect.TypeOf(config.Config{}), schema)
+}
+
+func TestExampleExposeFiltersLoad(t *testing.T) {
+	example, err := os.ReadFile(filepath.Join("..", "..", "..", "configs", "config.example.yaml"))
+	if err != nil {
+		t.Fatalf("failed to read the example config: %v", err)
+	}
+	// Uncomment the example server's expose section and load it.
+	var expose []string
+	for _, line := range strings.Split(string(example), "\n") {
+		if strings.HasPrefix(line, "    # expose:") {
+			expose = append(expose, "    expose:")
+			continue
+		}
+		if len(expose) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(line, "    #   ") {
+			break
+		}
+		expose = append(expose, "    "+strings.TrimPrefix(line, "    # "))
+	}
+	if len(expose) < 2 {
+		t.Fatalf("expected an expose section in the example config")
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "servers:\n  - id: \"a\"\n    address: \"ws://localhost:1234/mcp\"\n" + strings.Join(expose, "\n") + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("failed to load the example's expose section:\n%s\n%v", content, err)
+	}
+	if resources := cfg.Servers[0].Expose.Resources; !resources.Allows("file:///public/a.txt") || resources.Allows("file:///private/b.txt") {
+		t.Fatalf("unexpected resource filter %+v", resources)
+	}
+}
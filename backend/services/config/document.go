@@ -0,0 +1,466 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// EnvPrefix prefixes the environment variables that override individual
+// scalar settings, e.g. MCPGO_ADMIN_TOKEN overrides admin.token.
+const EnvPrefix = "MCPGO_"
+
+// secretSettings are the settings whose file: values are replaced by the
+// content of the named file. Other settings take file: values literally,
+// since they are often file:// URIs.
+var secretSettings = [][]string{
+	{"admin", "token"},
+	{"routing", "cursor_secret"},
+}
+
+// document is a configuration file after includes, environment overrides,
+// variable interpolation and secret file references have been resolved. It
+// remembers which file every included node came from so errors can point at
+// the right place.
+type document struct {
+	name    string
+	root    *yaml.Node
+	origins map[*yaml.Node]string
+	sources []string
+}
+
+func parseDocument(name string, data []byte) (*document, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	if root.Kind == 0 {
+		root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: configuration must be a YAML mapping", name)
+	}
+
+	doc := &document{
+		name:    name,
+		root:    root.Content[0],
+		origins: make(map[*yaml.Node]string),
+		sources: []string{name},
+	}
+	if err := doc.resolveIncludes(); err != nil {
+		return nil, err
+	}
+	doc.applyEnvOverrides()
+	if err := doc.expand(doc.root, name); err != nil {
+		return nil, err
+	}
+	if err := doc.readSecrets(); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// resolveIncludes appends the servers defined in every file matched by the
+// top-level include list. Entries may name a file, a directory (every .yaml
+// and .yml file in it, in lexical order) or a glob pattern, relative to the
+// including file. A fragment holds either a single server or a list of them.
+func (d *document) resolveIncludes() error {
+	includes := mappingValue(d.root, "include")
+	if includes == nil {
+		return nil
+	}
+	if includes.Kind != yaml.SequenceNode {
+		return fieldErrorAt(d.name, includes, "include", "must be a list of files, directories or glob patterns")
+	}
+
+	base := filepath.Dir(d.name)
+	for _, entry := range includes.Content {
+		if err := d.expand(entry, d.name); err != nil {
+			return err
+		}
+		files, err := includeFiles(base, entry.Value)
+		if err != nil {
+			return fieldErrorAt(d.name, entry, "include", err.Error())
+		}
+		if filepath.IsAbs(entry.Value) {
+			d.sources = append(d.sources, entry.Value)
+		} else {
+			d.sources = append(d.sources, filepath.Join(base, entry.Value))
+		}
+		for _, file := range files {
+			if err := d.includeServers(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func includeFiles(base, pattern string) ([]string, error) {
+	if pattern == "" {
+		return nil, errors.New("empty include entry")
+	}
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(base, pattern)
+	}
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		var files []string
+		for _, ext := range []string{"*.yaml", "*.yml"} {
+			matches, _ := filepath.Glob(filepath.Join(pattern, ext))
+			files = append(files, matches...)
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include pattern %q: %v", pattern, err)
+	}
+	if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("included file %s not found", pattern)
+	}
+	return files, nil
+}
+
+func (d *document) includeServers(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var fragment yaml.Node
+	if err := yaml.Unmarshal(data, &fragment); err != nil {
+		return fmt.Errorf("%s: %s", file, strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	d.sources = append(d.sources, file)
+	if fragment.Kind == 0 {
+		return nil
+	}
+
+	var servers []*yaml.Node
+	switch node := fragment.Content[0]; node.Kind {
+	case yaml.MappingNode:
+		servers = []*yaml.Node{node}
+	case yaml.SequenceNode:
+		servers = node.Content
+	default:
+		return fieldErrorAt(file, node, "", "a servers fragment must contain a server mapping or a list of servers")
+	}
+
+	list := mappingValue(d.root, "servers")
+	if list == nil || list.Kind != yaml.SequenceNode || list.Tag == "!!null" {
+		list = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		setMappingValue(d.root, "servers", list)
+	}
+	for _, server := range servers {
+		if err := d.expand(server, file); err != nil {
+			return err
+		}
+		d.origins[server] = file
+		list.Content = append(list.Content, server)
+	}
+	return nil
+}
+
+// applyEnvOverrides replaces scalar settings outside of lists and maps with
+// the value of the matching MCPGO_* environment variable, e.g.
+// MCPGO_LIMITS_RATE_BURST for limits.rate.burst.
+func (d *document) applyEnvOverrides() {
+	for _, setting := range scalarSettings(reflect.TypeOf(Config{}), nil) {
+		value, ok := os.LookupEnv(EnvPrefix + envName(setting))
+		if !ok {
+			continue
+		}
+		node := d.root
+		for _, key := range setting[:len(setting)-1] {
+			next := mappingValue(node, key)
+			if next == nil || next.Kind != yaml.MappingNode {
+				next = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+				setMappingValue(node, key, next)
+			}
+			node = next
+		}
+		setMappingValue(node, setting[len(setting)-1], &yaml.Node{Kind: yaml.ScalarNode, Value: value})
+	}
+}
+
+// EnvOverrides lists the environment variables that override scalar
+// settings, mapped to the setting they override.
+func EnvOverrides() map[string]string {
+	overrides := make(map[string]string)
+	for _, setting := range scalarSettings(reflect.TypeOf(Config{}), nil) {
+		overrides[EnvPrefix+envName(setting)] = strings.Join(setting, ".")
+	}
+	return overrides
+}
+
+func envName(setting []string) string {
+	return strings.ToUpper(strings.Join(setting, "_"))
+}
+
+// scalarSettings returns the YAML key path of every scalar setting reachable
+// from typ without passing through a list or map.
+func scalarSettings(typ reflect.Type, prefix []string) [][]string {
+	var settings [][]string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		path := append(append([]string(nil), prefix...), name)
+		switch {
+		case field.Type == reflect.TypeOf(Duration{}):
+			settings = append(settings, path)
+		case field.Type.Kind() == reflect.Struct:
+			settings = append(settings, scalarSettings(field.Type, path)...)
+		case field.Type.Kind() == reflect.Slice, field.Type.Kind() == reflect.Map:
+		default:
+			settings = append(settings, path)
+		}
+	}
+	return settings
+}
+
+// readSecrets replaces the file: values of secret settings with the content
+// of the named file. Relative paths are resolved against the directory of
+// the configuration file.
+func (d *document) readSecrets() error {
+	for _, setting := range secretSettings {
+		node := d.root
+		for _, key := range setting {
+			if node = mappingValue(node, key); node == nil {
+				break
+			}
+		}
+		if node == nil || node.Kind != yaml.ScalarNode {
+			continue
+		}
+		secret, ok := strings.CutPrefix(node.Value, "file:")
+		if !ok {
+			continue
+		}
+		if !filepath.IsAbs(secret) {
+			secret = filepath.Join(filepath.Dir(d.name), secret)
+		}
+		data, err := os.ReadFile(secret)
+		if err != nil {
+			return fieldErrorAt(d.name, node, strings.Join(setting, "."), fmt.Sprintf("cannot read secret file: %v", err))
+		}
+		node.Value = strings.TrimRight(string(data), "\r\n")
+		node.Tag = ""
+		node.Style = 0
+	}
+	return nil
+}
+
+// expand interpolates environment variables into every scalar value below
+// node. file is the file node comes from, which errors point at.
+func (d *document) expand(node *yaml.Node, file string) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		value, err := interpolate(node.Value)
+		if err != nil {
+			return fieldErrorAt(file, node, "", err.Error())
+		}
+		if value != node.Value {
+			// Let the substituted value be resolved as if it had been
+			// written in place, so "${PORT}" can fill an integer setting.
+			node.Value = value
+			node.Tag = ""
+			node.Style = 0
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := d.expand(node.Content[i], file); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode, yaml.DocumentNode:
+		for _, child := range node.Content {
+			if err := d.expand(child, file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// interpolate replaces ${NAME} and ${NAME:-default} with environment
+// variables. $${ produces a literal ${.
+func interpolate(value string) (string, error) {
+	if !strings.Contains(value, "${") {
+		return value, nil
+	}
+	var b strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			b.WriteString(value)
+			return b.String(), nil
+		}
+		if start > 0 && value[start-1] == '$' {
+			b.WriteString(value[:start])
+			b.WriteString("{")
+			value = value[start+2:]
+			continue
+		}
+		end := strings.Index(value[start:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable reference in %q", value)
+		}
+		b.WriteString(value[:start])
+		expr := value[start+2 : start+end]
+		name, fallback, hasDefault := strings.Cut(expr, ":-")
+		if name == "" {
+			return "", errors.New("empty variable reference ${}")
+		}
+		resolved, ok := os.LookupEnv(name)
+		switch {
+		case ok && resolved != "":
+		case hasDefault:
+			resolved = fallback
+		case !ok:
+			return "", fmt.Errorf("environment variable %s is not set; set it or use ${%s:-default}", name, name)
+		}
+		b.WriteString(resolved)
+		value = value[start+end+1:]
+	}
+}
+
+// decode decodes the document into cfg, rejecting keys that do not exist in
+// the configuration format.
+func (d *document) decode(cfg *Config) error {
+	v := &validator{}
+	checkKnownFields(v, d.root, reflect.TypeOf(Config{}), nil)
+	if len(v.errs) > 0 {
+		err := &ValidationError{Errors: v.errs}
+		d.locate(err)
+		return err
+	}
+	if err := d.root.Decode(cfg); err != nil {
+		return decodeError(d.name, err)
+	}
+
+	if servers := mappingValue(d.root, "servers"); servers != nil && servers.Kind == yaml.SequenceNode {
+		for i, node := range servers.Content {
+			if origin, ok := d.origins[node]; ok && i < len(cfg.Servers) {
+				cfg.Servers[i].Source = origin
+			}
+		}
+	}
+	cfg.sources = d.sources
+	return nil
+}
+
+func checkKnownFields(v *validator, node *yaml.Node, typ reflect.Type, path []interface{}) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch {
+	case node.Kind == yaml.SequenceNode && typ.Kind() == reflect.Slice:
+		for i, child := range node.Content {
+			checkKnownFields(v, child, typ.Elem(), append(path, i))
+		}
+	case node.Kind == yaml.MappingNode && typ.Kind() == reflect.Map:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			checkKnownFields(v, node.Content[i+1], typ.Elem(), append(path, node.Content[i].Value))
+		}
+	case node.Kind == yaml.MappingNode && typ.Kind() == reflect.Struct && typ != reflect.TypeOf(Duration{}):
+		fields := make(map[string]reflect.Type, typ.NumField())
+		for i := 0; i < typ.NumField(); i++ {
+			name := strings.Split(typ.Field(i).Tag.Get("yaml"), ",")[0]
+			if name != "" && name != "-" {
+				fields[name] = typ.Field(i).Type
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			fieldType, ok := fields[key]
+			if !ok {
+				v.errs = append(v.errs, &FieldError{
+					Field:   formatPath(path),
+					Message: fmt.Sprintf("unknown key %q", key),
+					path:    append(append([]interface{}(nil), path...), key),
+				})
+				continue
+			}
+			checkKnownFields(v, node.Content[i+1], fieldType, append(path, key))
+		}
+	}
+}
+
+// locate fills in the file name and source position of every field error,
+// using the deepest node of the path that exists in the document.
+func (d *document) locate(err error) {
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		return
+	}
+	for _, fieldErr := range verr.Errors {
+		fieldErr.File = d.name
+		node := d.root
+		for _, elem := range fieldErr.path {
+			next := childNode(node, elem)
+			if next == nil {
+				break
+			}
+			node = next
+			if origin, ok := d.origins[node]; ok {
+				fieldErr.File = origin
+			}
+		}
+		fieldErr.Line, fieldErr.Column = node.Line, node.Column
+	}
+	sort.SliceStable(verr.Errors, func(i, j int) bool {
+		if verr.Errors[i].File != verr.Errors[j].File {
+			return verr.Errors[i].File == d.name
+		}
+		return verr.Errors[i].Line < verr.Errors[j].Line
+	})
+}
+
+// childNode returns the value under a mapping key (for unknown-key errors,
+// the key itself) or the element at a sequence index.
+func childNode(node *yaml.Node, elem interface{}) *yaml.Node {
+	switch e := elem.(type) {
+	case string:
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == e {
+				return node.Content[i+1]
+			}
+		}
+	case int:
+		if node.Kind == yaml.SequenceNode && e < len(node.Content) {
+			return node.Content[e]
+		}
+	}
+	return nil
+}
+
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func fieldErrorAt(file string, node *yaml.Node, field, message string) error {
+	return &ValidationError{Errors: []*FieldError{{
+		File:    file,
+		Line:    node.Line,
+		Column:  node.Column,
+		Field:   field,
+		Message: message,
+	}}}
+}
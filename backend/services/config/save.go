@@ -0,0 +1,183 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// SaveServers replaces the servers section of the configuration file at path
+// with the provided list. The rest of the document, including comments and
+// sections the gateway does not model, is preserved. Servers defined in an
+// included fragment are left out, and servers keep their original text
+// wherever it still holds their settings, so ${VAR} references are not
+// expanded into the file. The file is rewritten atomically so a
+// crash never leaves a truncated configuration behind.
+func SaveServers(path string, servers []ServerConfig) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("config %s is not a YAML mapping", path)
+	}
+
+	existing := make(map[string]*yaml.Node)
+	if list := mappingValue(doc.Content[0], "servers"); list != nil && list.Kind == yaml.SequenceNode {
+		for _, node := range list.Content {
+			if server, ok := decodeServer(path, node); ok {
+				existing[server.ID] = node
+			}
+		}
+	}
+
+	value := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for _, server := range servers {
+		if server.Source != "" && server.Source != path {
+			continue
+		}
+		server.Source = ""
+		if node, ok := existing[server.ID]; ok {
+			if current, _ := decodeServer(path, node); reflect.DeepEqual(current, server) {
+				value.Content = append(value.Content, node)
+				continue
+			}
+		}
+		var node yaml.Node
+		if err := node.Encode(server); err != nil {
+			return fmt.Errorf("failed to encode servers: %w", err)
+		}
+		if original, ok := existing[server.ID]; ok {
+			if encoded, ok := decodeServer(path, &node); ok {
+				keepOriginal(path, &node, &node, original, encoded)
+			}
+		}
+		value.Content = append(value.Content, &node)
+	}
+	setMappingValue(doc.Content[0], "servers", value)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// decodeServer decodes a server definition of the file at path the way Load
+// would see it, without modifying node.
+func decodeServer(path string, node *yaml.Node) (ServerConfig, bool) {
+	var server ServerConfig
+	expanded := copyNode(node)
+	if (&document{name: path}).expand(expanded, path) != nil {
+		return server, false
+	}
+	if expanded.Decode(&server) != nil {
+		return server, false
+	}
+	return server, true
+}
+
+// keepOriginal puts the parts of original, a server's text in the file at
+// path, back into updated, the same part of the server's new definition
+// root, wherever root still decodes to want with them.
+func keepOriginal(path string, root, updated, original *yaml.Node, want ServerConfig) {
+	switch {
+	case updated.Kind == yaml.MappingNode && original.Kind == yaml.MappingNode:
+		for i := 1; i < len(updated.Content); i += 2 {
+			if value := mappingValue(original, updated.Content[i-1].Value); value != nil {
+				keepNode(path, root, &updated.Content[i], value, want)
+			}
+		}
+	case updated.Kind == yaml.SequenceNode && original.Kind == yaml.SequenceNode && len(updated.Content) == len(original.Content):
+		for i := range updated.Content {
+			keepNode(path, root, &updated.Content[i], original.Content[i], want)
+		}
+	}
+}
+
+// keepNode replaces *slot with original when root still decodes to want,
+// and otherwise looks for parts of original to keep within *slot.
+func keepNode(path string, root *yaml.Node, slot **yaml.Node, original *yaml.Node, want ServerConfig) {
+	updated := *slot
+	*slot = original
+	if server, ok := decodeServer(path, root); ok && reflect.DeepEqual(server, want) {
+		return
+	}
+	*slot = updated
+	keepOriginal(path, root, updated, original, want)
+}
+
+func copyNode(node *yaml.Node) *yaml.Node {
+	clone := *node
+	clone.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		clone.Content[i] = copyNode(child)
+	}
+	return &clone
+}
+
+// setMappingValue replaces the value stored under key in a YAML mapping node,
+// appending the key when it is not present yet. Comments attached to the key
+// are kept.
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			value.HeadComment = mapping.Content[i+1].HeadComment
+			value.LineComment = mapping.Content[i+1].LineComment
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		value,
+	)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0o600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
@@ -0,0 +1,10 @@
+package config
+
+import _ "embed"
+
+// Schema is the JSON Schema describing the configuration file format. Editors
+// can use it for completion and CI can use it to lint configuration files;
+// Load performs the same checks and more.
+//
+//go:embed config.schema.json
+var Schema []byte
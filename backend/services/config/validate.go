@@ -0,0 +1,591 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// SupportedProtocols lists the values accepted for ServerConfig.Protocol. An
+// empty protocol is treated as "mcp".
+var SupportedProtocols = []string{"mcp", "mcp/v1"}
+
+// SupportedRoutingStrategies lists the values accepted for
+// RoutingConfig.Strategy. An empty strategy is treated as "simple-router".
+var SupportedRoutingStrategies = []string{"simple-router"}
+
+// SupportedBalancingStrategies lists the values accepted for
+// BalancingConfig.Strategy. An empty strategy is treated as "round-robin".
+var SupportedBalancingStrategies = []string{"round-robin", "least-connections", "consistent-hash"}
+
+// SupportedFailoverTriggers lists the values accepted in FailoverConfig.On.
+var SupportedFailoverTriggers = []string{FailoverOnUnavailable, FailoverOnError, FailoverOnToolError}
+
+// SupportedServerRequests lists the values accepted in
+// ServerRequestsConfig.Block: the requests a server can send to an agent.
+var SupportedServerRequests = []string{"sampling/createMessage", "elicitation/create", "roots/list"}
+
+// SupportedQueuePolicies lists the values accepted for
+// MessagesConfig.QueuePolicy. An empty policy is treated as "block".
+var SupportedQueuePolicies = []string{QueuePolicyBlock, QueuePolicyDropNotifications, QueuePolicyDisconnect}
+
+// SupportedPinningActions lists the values accepted for
+// PinningConfig.OnChange. An empty action is treated as "block".
+var SupportedPinningActions = []string{PinningBlock, PinningQuarantine, PinningFlag}
+
+var serverIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// FieldError describes a single problem with a configuration value. Line and
+// Column are set when the configuration was read from a file.
+type FieldError struct {
+	File    string
+	Line    int
+	Column  int
+	Field   string
+	Message string
+
+	path []interface{}
+}
+
+func (e *FieldError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File)
+		b.WriteString(":")
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "%d:", e.Line)
+		if e.Column > 0 {
+			fmt.Fprintf(&b, "%d:", e.Column)
+		}
+	}
+	if b.Len() > 0 {
+		b.WriteString(" ")
+	}
+	if e.Field != "" {
+		b.WriteString(e.Field)
+		b.WriteString(": ")
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+// ValidationError collects every problem found in a configuration.
+type ValidationError struct {
+	Errors []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Errors))
+	for i, fieldErr := range e.Errors {
+		lines[i] = fieldErr.Error()
+	}
+	if len(lines) == 1 {
+		return lines[0]
+	}
+	return fmt.Sprintf("%d configuration errors:\n  %s", len(lines), strings.Join(lines, "\n  "))
+}
+
+type validator struct {
+	errs []*FieldError
+}
+
+// addf records a problem at path, where path alternates map keys (strings)
+// and sequence indexes (ints).
+func (v *validator) addf(path []interface{}, format string, args ...interface{}) {
+	v.errs = append(v.errs, &FieldError{
+		Field:   formatPath(path),
+		Message: fmt.Sprintf(format, args...),
+		path:    append([]interface{}(nil), path...),
+	})
+}
+
+// Validate checks the configuration for mistakes that would prevent the
+// gateway from serving it. The returned error is a *ValidationError listing
+// every problem found.
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	if addr := c.Agent.HTTP.Addr; addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			v.addf(p("agent", "http", "addr"), "invalid listen address %q, use host:port or :port", addr)
+		}
+	}
+	if c.Agent.HTTP.Timeout.Duration < 0 {
+		v.addf(p("agent", "http", "timeout"), "must not be negative")
+	}
+	if addr := c.Agent.WS.Addr; addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			v.addf(p("agent", "ws", "addr"), "invalid listen address %q, use host:port or :port", addr)
+		}
+	}
+	ws := c.Agent.WS
+	for _, setting := range []struct {
+		name  string
+		value Duration
+	}{
+		{"handshake_timeout", ws.HandshakeTimeout},
+		{"write_timeout", ws.WriteTimeout},
+		{"idle_timeout", ws.IdleTimeout},
+		{"max_lifetime", ws.MaxLifetime},
+		{"ping_interval", ws.PingInterval},
+	} {
+		if setting.value.Duration < 0 {
+			v.addf(p("agent", "ws", setting.name), "must not be negative")
+		}
+	}
+
+	if strategy := c.Routing.Strategy; strategy != "" && !contains(SupportedRoutingStrategies, strategy) {
+		v.addf(p("routing", "strategy"), "unsupported strategy %q, expected one of %s", strategy, strings.Join(SupportedRoutingStrategies, ", "))
+	}
+
+	v.validateLimits(p("limits"), c.Limits)
+
+	policyNames := make([]string, 0, len(c.Policies))
+	for name := range c.Policies {
+		policyNames = append(policyNames, name)
+	}
+	sort.Strings(policyNames)
+	for _, name := range policyNames {
+		v.validateLimits(p("policies", name, "limits"), c.Policies[name].Limits)
+	}
+
+	seen := make(map[string]int, len(c.Servers))
+	for i, server := range c.Servers {
+		v.validateServer(c, p("servers", i), server)
+		if server.ID == "" {
+			continue
+		}
+		if first, dup := seen[server.ID]; dup {
+			v.addf(p("servers", i, "id"), "duplicate id %q, already used by servers[%d]", server.ID, first)
+			continue
+		}
+		seen[server.ID] = i
+	}
+
+	if c.Reload.DrainTimeout.Duration < 0 {
+		v.addf(p("reload", "drain_timeout"), "must not be negative")
+	}
+	if c.Shutdown.DrainTimeout.Duration < 0 {
+		v.addf(p("shutdown", "drain_timeout"), "must not be negative")
+	}
+	if c.Sessions.ResumeGrace.Duration < 0 {
+		v.addf(p("sessions", "resume_grace"), "must not be negative")
+	}
+	if c.Sessions.ResumeBuffer < 0 {
+		v.addf(p("sessions", "resume_buffer"), "must not be negative")
+	}
+	reconnect := c.Sessions.Reconnect
+	if reconnect.MaxAttempts < 0 {
+		v.addf(p("sessions", "reconnect", "max_attempts"), "must not be negative")
+	}
+	if reconnect.InitialBackoff.Duration < 0 {
+		v.addf(p("sessions", "reconnect", "initial_backoff"), "must not be negative")
+	}
+	if reconnect.MaxBackoff.Duration < 0 {
+		v.addf(p("sessions", "reconnect", "max_backoff"), "must not be negative")
+	} else if reconnect.MaxBackoff.Duration > 0 && reconnect.MaxBackoff.Duration < reconnect.InitialBackoff.Duration {
+		v.addf(p("sessions", "reconnect", "max_backoff"), "must not be less than initial_backoff (%s)", reconnect.InitialBackoff.Duration)
+	}
+	messages := c.Sessions.Messages
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{"max_agent_size", messages.MaxAgentSize},
+		{"max_upstream_size", messages.MaxUpstreamSize},
+		{"queue_size", messages.QueueSize},
+	} {
+		if field.value < 0 {
+			v.addf(p("sessions", "messages", field.name), "must not be negative")
+		}
+	}
+	if policy := messages.QueuePolicy; policy != "" && !contains(SupportedQueuePolicies, policy) {
+		v.addf(p("sessions", "messages", "queue_policy"), "unsupported policy %q, expected one of %s", policy, strings.Join(SupportedQueuePolicies, ", "))
+	}
+	if action := c.Pinning.OnChange; action != "" && !contains(SupportedPinningActions, action) {
+		v.addf(p("pinning", "on_change"), "unsupported action %q, expected one of %s", action, strings.Join(SupportedPinningActions, ", "))
+	}
+
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: v.errs}
+}
+
+func (v *validator) validateServer(c *Config, path []interface{}, server ServerConfig) {
+	switch {
+	case server.ID == "":
+		v.addf(append(path, "id"), "is required")
+	case !serverIDPattern.MatchString(server.ID):
+		v.addf(append(path, "id"), "invalid id %q, use letters, digits, '.', '_' and '-' only", server.ID)
+	}
+
+	switch {
+	case len(server.Aggregate) > 0:
+		v.validateAggregate(c, path, server)
+	case server.Address != "" && len(server.Endpoints) > 0:
+		v.addf(append(path, "endpoints"), "cannot be combined with address")
+	case len(server.Endpoints) > 0:
+		for i, endpoint := range server.Endpoints {
+			v.validateAddress(append(path, "endpoints", i, "address"), endpoint.Address)
+			if endpoint.Weight < 0 {
+				v.addf(append(path, "endpoints", i, "weight"), "must not be negative")
+			}
+		}
+	default:
+		v.validateAddress(append(path, "address"), server.Address)
+	}
+
+	balancing := server.Balancing
+	if balancing.Strategy != "" && !contains(SupportedBalancingStrategies, balancing.Strategy) {
+		v.addf(append(path, "balancing", "strategy"), "unsupported strategy %q, expected one of %s", balancing.Strategy, strings.Join(SupportedBalancingStrategies, ", "))
+	}
+	if balancing.HashHeader != "" && balancing.Strategy != "consistent-hash" {
+		v.addf(append(path, "balancing", "hash_header"), "only applies to the consistent-hash strategy")
+	}
+	if balancing.Ejection.ConsecutiveFailures < 0 {
+		v.addf(append(path, "balancing", "ejection", "consecutive_failures"), "must not be negative")
+	}
+	if balancing.Ejection.Duration.Duration < 0 {
+		v.addf(append(path, "balancing", "ejection", "duration"), "must not be negative")
+	}
+
+	if server.Protocol != "" && !contains(SupportedProtocols, server.Protocol) {
+		v.addf(append(path, "protocol"), "unsupported protocol %q, expected one of %s", server.Protocol, strings.Join(SupportedProtocols, ", "))
+	}
+
+	if server.Policy != "" {
+		if _, ok := c.Policies[server.Policy]; !ok {
+			v.addf(append(path, "policy"), "references undefined policy %q", server.Policy)
+		}
+	}
+
+	if server.Pool != (PoolConfig{}) && !server.Stateless {
+		v.addf(append(path, "pool"), "only applies to stateless servers")
+	}
+	if server.Pool.MaxConnections < 0 {
+		v.addf(append(path, "pool", "max_connections"), "must not be negative")
+	}
+	if server.Pool.IdleTimeout.Duration < 0 {
+		v.addf(append(path, "pool", "idle_timeout"), "must not be negative")
+	}
+
+	if server.RequestTimeout.Duration < 0 {
+		v.addf(append(path, "request_timeout"), "must not be negative")
+	}
+	if server.Cache.ListTTL.Duration < 0 {
+		v.addf(append(path, "cache", "list_ttl"), "must not be negative")
+	}
+	if server.Cache.ResourceTTL.Duration < 0 {
+		v.addf(append(path, "cache", "resource_ttl"), "must not be negative")
+	}
+	if server.Cache.ToolTTL.Duration < 0 {
+		v.addf(append(path, "cache", "tool_ttl"), "must not be negative")
+	}
+	if server.Cache.MaxEntries < 0 {
+		v.addf(append(path, "cache", "max_entries"), "must not be negative")
+	}
+	for i, method := range server.ServerRequests.Block {
+		if !contains(SupportedServerRequests, method) {
+			v.addf(append(path, "server_requests", "block", i), "unsupported method %q, expected one of %s", method, strings.Join(SupportedServerRequests, ", "))
+		}
+	}
+	if server.ServerRequests.MaxTokens < 0 {
+		v.addf(append(path, "server_requests", "max_tokens"), "must not be negative")
+	}
+	v.validateFailover(c, append(path, "failover"), server.ID, server.Failover)
+	for _, filter := range []struct {
+		name   string
+		filter FilterConfig
+	}{
+		{"tools", server.Expose.Tools},
+		{"resources", server.Expose.Resources},
+		{"prompts", server.Expose.Prompts},
+	} {
+		for i, pattern := range filter.filter.Include {
+			if pattern == "" {
+				v.addf(append(path, "expose", filter.name, "include", i), "must not be empty")
+			}
+		}
+		for i, pattern := range filter.filter.Exclude {
+			if pattern == "" {
+				v.addf(append(path, "expose", filter.name, "exclude", i), "must not be empty")
+			}
+		}
+	}
+	for i, rule := range server.Approval.Rules {
+		if !rule.Destructive && len(rule.Tools) == 0 && len(rule.Arguments) == 0 {
+			v.addf(append(path, "approval", "rules", i), "must set destructive, tools or arguments")
+		}
+		for j, pattern := range rule.Tools {
+			if pattern == "" {
+				v.addf(append(path, "approval", "rules", i, "tools", j), "must not be empty")
+			}
+		}
+	}
+	if server.Approval.Timeout.Duration < 0 {
+		v.addf(append(path, "approval", "timeout"), "must not be negative")
+	}
+	if server.Approval.MaxPending < 0 {
+		v.addf(append(path, "approval", "max_pending"), "must not be negative")
+	}
+	if action := server.Pinning.OnChange; action != "" && !contains(SupportedPinningActions, action) {
+		v.addf(append(path, "pinning", "on_change"), "unsupported action %q, expected one of %s", action, strings.Join(SupportedPinningActions, ", "))
+	}
+	tools := make([]string, 0, len(server.Tools))
+	for name := range server.Tools {
+		tools = append(tools, name)
+	}
+	sort.Strings(tools)
+	renamed := make(map[string]string)
+	for _, name := range tools {
+		tool := server.Tools[name]
+		if tool.Rename != "" {
+			if other, ok := renamed[tool.Rename]; ok {
+				v.addf(append(path, "tools", name, "rename"), "duplicates the rename of tool %q", other)
+			} else if _, ok := server.Tools[tool.Rename]; ok && server.Tools[tool.Rename].Rename == "" {
+				v.addf(append(path, "tools", name, "rename"), "collides with tool %q", tool.Rename)
+			}
+			renamed[tool.Rename] = name
+		}
+		if tool.Timeout.Duration < 0 {
+			v.addf(append(path, "tools", name, "timeout"), "must not be negative")
+		}
+		if tool.CacheTTL.Duration < 0 {
+			v.addf(append(path, "tools", name, "cache_ttl"), "must not be negative")
+		}
+		arguments := make([]string, 0, len(tool.Arguments))
+		for argument := range tool.Arguments {
+			arguments = append(arguments, argument)
+		}
+		sort.Strings(arguments)
+		for _, argument := range arguments {
+			cfg := tool.Arguments[argument]
+			argPath := append(path, "tools", name, "arguments", argument)
+			if cfg.Default != nil && cfg.Value != nil {
+				v.addf(argPath, "default and value cannot be combined")
+			}
+			for _, field := range []struct {
+				name  string
+				value interface{}
+			}{{"default", cfg.Default}, {"value", cfg.Value}} {
+				if text, ok := field.value.(string); ok {
+					if _, err := template.New(argument).Parse(text); err != nil {
+						v.addf(append(argPath, field.name), "invalid template: %v", err)
+					}
+				}
+			}
+		}
+		v.validateFailover(c, append(path, "tools", name, "failover"), server.ID, tool.Failover)
+	}
+}
+
+func (v *validator) validateFailover(c *Config, path []interface{}, serverID string, failover FailoverConfig) {
+	for i, trigger := range failover.On {
+		if !contains(SupportedFailoverTriggers, trigger) {
+			v.addf(append(path, "on", i), "unsupported trigger %q, expected one of %s", trigger, strings.Join(SupportedFailoverTriggers, ", "))
+		}
+	}
+	if failover.MaxAttempts < 0 {
+		v.addf(append(path, "max_attempts"), "must not be negative")
+	}
+	for i, fallback := range failover.Fallbacks {
+		switch {
+		case fallback.Server == "":
+			v.addf(append(path, "fallbacks", i, "server"), "is required")
+		case fallback.Server == serverID:
+			v.addf(append(path, "fallbacks", i, "server"), "must name another server")
+		case !hasServer(c, fallback.Server):
+			v.addf(append(path, "fallbacks", i, "server"), "references undefined server %q", fallback.Server)
+		case isAggregate(c, fallback.Server):
+			v.addf(append(path, "fallbacks", i, "server"), "must not name an aggregated server")
+		}
+	}
+}
+
+// validateAggregate checks a server that aggregates others: it has no
+// connection settings of its own and lists existing servers that are not
+// aggregated themselves.
+func (v *validator) validateAggregate(c *Config, path []interface{}, server ServerConfig) {
+	for _, field := range []struct {
+		name string
+		set  bool
+	}{
+		{"address", server.Address != ""},
+		{"endpoints", len(server.Endpoints) > 0},
+		{"balancing", server.Balancing != (BalancingConfig{})},
+		{"stateless", server.Stateless},
+	} {
+		if field.set {
+			v.addf(append(path, field.name), "cannot be combined with aggregate")
+		}
+	}
+	seen := make(map[string]bool, len(server.Aggregate))
+	for i, member := range server.Aggregate {
+		switch {
+		case member == server.ID:
+			v.addf(append(path, "aggregate", i), "must name another server")
+		case seen[member]:
+			v.addf(append(path, "aggregate", i), "duplicate server %q", member)
+		case !hasServer(c, member):
+			v.addf(append(path, "aggregate", i), "references undefined server %q", member)
+		case isAggregate(c, member):
+			v.addf(append(path, "aggregate", i), "must not name an aggregated server")
+		}
+		seen[member] = true
+	}
+}
+
+func hasServer(c *Config, id string) bool {
+	for _, server := range c.Servers {
+		if server.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func isAggregate(c *Config, id string) bool {
+	for _, server := range c.Servers {
+		if server.ID == id {
+			return len(server.Aggregate) > 0
+		}
+	}
+	return false
+}
+
+func (v *validator) validateAddress(path []interface{}, address string) {
+	if address == "" {
+		v.addf(path, "is required, e.g. ws://localhost:9001/mcp")
+	} else if u, err := url.Parse(address); err != nil {
+		v.addf(path, "cannot parse %q: %v", address, err)
+	} else if u.Scheme != "ws" && u.Scheme != "wss" {
+		v.addf(path, "unsupported transport %q in %q, use ws:// or wss://", u.Scheme, address)
+	} else if u.Host == "" {
+		v.addf(path, "missing host in %q", address)
+	}
+}
+
+func (v *validator) validateLimits(path []interface{}, limits LimitsConfig) {
+	rate := append(path, "rate")
+	if limits.Rate.RequestsPerSecond < 0 {
+		v.addf(append(rate, "requests_per_second"), "must not be negative")
+	}
+	if limits.Rate.Burst < 0 {
+		v.addf(append(rate, "burst"), "must not be negative")
+	}
+	if limits.Rate.Burst > 0 && limits.Rate.RequestsPerSecond == 0 {
+		v.addf(append(rate, "burst"), "has no effect without requests_per_second")
+	}
+	if limits.Concurrency.MaxConcurrentRequests < 0 {
+		v.addf(append(path, "concurrency", "max_concurrent_requests"), "must not be negative")
+	}
+}
+
+// p builds a field path from map keys and sequence indexes.
+func p(elems ...interface{}) []interface{} {
+	return elems
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func formatPath(path []interface{}) string {
+	var b strings.Builder
+	for _, elem := range path {
+		switch e := elem.(type) {
+		case int:
+			fmt.Fprintf(&b, "[%d]", e)
+		case string:
+			if b.Len() > 0 {
+				b.WriteString(".")
+			}
+			b.WriteString(e)
+		}
+	}
+	return b.String()
+}
+
+var unknownFieldPattern = regexp.MustCompile(`line (\d+): field (\S+) not found in type config\.(\w+)`)
+
+// sectionNames maps configuration types to the section a user would look
+// for in the file.
+var sectionNames = map[string]string{
+	"AgentHTTPConfig":        "agent.http",
+	"AgentWSConfig":          "agent.ws",
+	"RateLimitConfig":        "a rate limit",
+	"ConcurrencyLimitConfig": "a concurrency limit",
+	"Config":                 "the top level",
+	"AgentConfig":            "agent",
+	"AdminConfig":            "admin",
+	"ServerConfig":           "a servers entry",
+	"LimitsConfig":           "limits",
+	"PolicyConfig":           "a policies entry",
+	"RoutingConfig":          "routing",
+	"ReloadConfig":           "reload",
+	"SessionsConfig":         "sessions",
+	"ShutdownConfig":         "shutdown",
+	"ReconnectConfig":        "sessions.reconnect",
+	"MessagesConfig":         "sessions.messages",
+	"PoolConfig":             "a server's pool",
+	"EndpointConfig":         "a server's endpoints entry",
+	"BalancingConfig":        "a server's balancing",
+	"EjectionConfig":         "a server's balancing.ejection",
+	"FailoverConfig":         "a failover section",
+	"FallbackConfig":         "a failover fallbacks entry",
+	"ToolConfig":             "a server's tools entry",
+	"CacheConfig":            "a server's cache",
+	"ServerRequestsConfig":   "a server's server_requests",
+	"ExposeConfig":           "a server's expose",
+	"FilterConfig":           "an expose filter",
+	"ValidationConfig":       "a server's validation",
+	"ArgumentConfig":         "a tool's arguments entry",
+	"ApprovalConfig":         "a server's approval",
+	"ApprovalRule":           "an approval rule",
+	"PinningConfig":          "pinning",
+	"ServerPinningConfig":    "a server's pinning",
+}
+
+// decodeError rewrites YAML decoding errors into one line per problem,
+// prefixed with the file name.
+func decodeError(name string, err error) error {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return fmt.Errorf("%s: %s", name, strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+
+	verr := &ValidationError{}
+	for _, msg := range typeErr.Errors {
+		fieldErr := &FieldError{File: name, Message: msg}
+		if m := unknownFieldPattern.FindStringSubmatch(msg); m != nil {
+			fieldErr.Line, _ = strconv.Atoi(m[1])
+			section := sectionNames[m[3]]
+			if section == "" {
+				section = "its section"
+			}
+			fieldErr.Message = fmt.Sprintf("unknown key %q in %s", m[2], section)
+		} else if rest, ok := strings.CutPrefix(msg, "line "); ok {
+			if lineStr, text, ok := strings.Cut(rest, ": "); ok {
+				fieldErr.Line, _ = strconv.Atoi(lineStr)
+				fieldErr.Message = text
+			}
+		}
+		verr.Errors = append(verr.Errors, fieldErr)
+	}
+	return verr
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watcher reloads the configuration file whenever it or one of the files
+// it includes changes on disk, or Trigger is called. Every reload is
+// validated by Load before it is handed to the apply callback; a
+// configuration that fails to load, validate or apply is rejected and the
+// running configuration is kept.
+type Watcher struct {
+	path     string
+	apply    func(*Config) error
+	logger   *log.Logger
+	trigger  chan struct{}
+	debounce time.Duration
+
+	mu      sync.Mutex
+	sources []string
+}
+
+// NewWatcher creates a watcher for the configuration file at path.
+func NewWatcher(path string, apply func(*Config) error, logger *log.Logger) *Watcher {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &Watcher{
+		path:     path,
+		apply:    apply,
+		logger:   logger,
+		trigger:  make(chan struct{}, 1),
+		debounce: 250 * time.Millisecond,
+	}
+}
+
+// Trigger requests a reload, e.g. in response to SIGHUP. It never blocks.
+func (w *Watcher) Trigger() {
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Reload loads, validates and applies the configuration file once.
+func (w *Watcher) Reload() error {
+	cfg, err := Load(w.path)
+	if err == nil {
+		w.setSources(cfg.Sources())
+		err = w.apply(cfg)
+	}
+	if err != nil {
+		w.logger.Printf("warning: config reload of %s rejected, keeping previous configuration: %v", w.path, err)
+		return err
+	}
+	w.logger.Printf("config reloaded from %s", w.path)
+	return nil
+}
+
+func (w *Watcher) setSources(sources []string) {
+	w.mu.Lock()
+	w.sources = sources
+	w.mu.Unlock()
+}
+
+// watchedPaths returns the absolute paths of the configuration file and of
+// every include entry and fragment the last successful load used.
+func (w *Watcher) watchedPaths() []string {
+	w.mu.Lock()
+	sources := append([]string{w.path}, w.sources...)
+	w.mu.Unlock()
+
+	paths := make([]string, 0, len(sources))
+	for _, source := range sources {
+		if abs, err := filepath.Abs(source); err == nil {
+			paths = append(paths, abs)
+		}
+	}
+	return paths
+}
+
+// affects reports whether a change to name can alter the configuration
+// assembled from paths. Include entries may be directories or glob patterns.
+func affects(paths []string, name string) bool {
+	name = filepath.Clean(name)
+	for _, path := range paths {
+		if name == path {
+			return true
+		}
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			ext := filepath.Ext(name)
+			if filepath.Dir(name) == path && (ext == ".yaml" || ext == ".yml") {
+				return true
+			}
+			continue
+		}
+		if ok, _ := filepath.Match(path, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Run watches the configuration file and its includes until ctx is
+// cancelled. The containing directories are watched rather than the files
+// themselves so that editors and deployment tools that replace files by
+// renaming are handled.
+func (w *Watcher) Run(ctx context.Context) error {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create config watcher: %w", err)
+	}
+	defer fsWatcher.Close()
+
+	if cfg, err := Load(w.path); err == nil {
+		w.setSources(cfg.Sources())
+	}
+
+	watched := make(map[string]bool)
+	var paths []string
+	watch := func() error {
+		paths = w.watchedPaths()
+		for _, path := range paths {
+			dir := path
+			if info, err := os.Stat(path); err != nil || !info.IsDir() {
+				dir = filepath.Dir(path)
+			}
+			if watched[dir] {
+				continue
+			}
+			if err := fsWatcher.Add(dir); err != nil {
+				return fmt.Errorf("failed to watch %s: %w", dir, err)
+			}
+			watched[dir] = true
+		}
+		return nil
+	}
+	if err := watch(); err != nil {
+		return err
+	}
+	reload := func() {
+		_ = w.Reload()
+		if err := watch(); err != nil {
+			w.logger.Printf("warning: config watcher error: %v", err)
+		}
+	}
+
+	// Changes usually arrive as a burst of events; wait for them to settle
+	// before reloading.
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-fsWatcher.Events:
+			if !ok {
+				return nil
+			}
+			if !affects(paths, event.Name) {
+				continue
+			}
+			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) || event.Has(fsnotify.Remove) {
+				timer.Reset(w.debounce)
+			}
+		case err, ok := <-fsWatcher.Errors:
+			if !ok {
+				return nil
+			}
+			w.logger.Printf("warning: config watcher error: %v", err)
+		case <-w.trigger:
+			reload()
+		case <-timer.C:
+			reload()
+		}
+	}
+}
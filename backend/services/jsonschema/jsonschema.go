@@ -0,0 +1,476 @@
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Error describes the first part of a value that does not match its schema.
+// Path is a JSON pointer to that part, empty for the value itself.
+type Error struct {
+	Path    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Validate checks value against schema, returning an *Error for a value
+// that does not match. It supports the keywords MCP tool schemas use: type,
+// enum and const, the object, array, string and number constraints, the
+// combinators and local $ref; annotations such as format are not checked.
+func Validate(schema, value json.RawMessage) error {
+	root, err := decode(schema)
+	if err != nil {
+		return fmt.Errorf("invalid schema: %w", err)
+	}
+	v, err := decode(value)
+	if err != nil {
+		return &Error{Message: "invalid JSON: " + err.Error()}
+	}
+	return (&validator{root: root}).check(root, v, "")
+}
+
+// decode parses data keeping numbers exact. Empty data decodes to nil.
+func decode(data json.RawMessage) (interface{}, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+type validator struct {
+	root interface{}
+	// depth bounds $ref resolution, which a schema could make circular.
+	depth int
+}
+
+func (v *validator) check(schema, value interface{}, path string) error {
+	switch s := schema.(type) {
+	case nil:
+		return nil
+	case bool:
+		if !s {
+			return &Error{Path: path, Message: "is not allowed"}
+		}
+		return nil
+	case map[string]interface{}:
+		return v.checkObject(s, value, path)
+	}
+	return nil
+}
+
+func (v *validator) checkObject(s map[string]interface{}, value interface{}, path string) error {
+	if ref, ok := s["$ref"].(string); ok {
+		target, err := v.resolve(ref)
+		if err != nil {
+			return err
+		}
+		v.depth++
+		defer func() { v.depth-- }()
+		if v.depth > 64 {
+			return fmt.Errorf("invalid schema: $ref %s nests too deeply", ref)
+		}
+		if err := v.check(target, value, path); err != nil {
+			return err
+		}
+	}
+	if t, ok := s["type"]; ok && !matchesType(t, value) {
+		return &Error{Path: path, Message: fmt.Sprintf("expected %s, got %s", typeNames(t), typeOf(value))}
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			if equal(option, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &Error{Path: path, Message: "must be one of " + encode(enum)}
+		}
+	}
+	if c, ok := s["const"]; ok && !equal(c, value) {
+		return &Error{Path: path, Message: "must be " + encode(c)}
+	}
+
+	var err error
+	switch value := value.(type) {
+	case map[string]interface{}:
+		err = v.checkProperties(s, value, path)
+	case []interface{}:
+		err = v.checkItems(s, value, path)
+	case string:
+		err = checkString(s, value, path)
+	case json.Number:
+		err = checkNumber(s, value, path)
+	}
+	if err != nil {
+		return err
+	}
+	return v.checkCombinators(s, value, path)
+}
+
+func (v *validator) checkProperties(s map[string]interface{}, value map[string]interface{}, path string) error {
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, ok := value[name]; !ok {
+					return &Error{Path: path + "/" + escape(name), Message: "is required"}
+				}
+			}
+		}
+	}
+	if n, ok := limit(s, "minProperties"); ok && float64(len(value)) < n {
+		return &Error{Path: path, Message: fmt.Sprintf("must have at least %v properties", n)}
+	}
+	if n, ok := limit(s, "maxProperties"); ok && float64(len(value)) > n {
+		return &Error{Path: path, Message: fmt.Sprintf("must have at most %v properties", n)}
+	}
+
+	properties, _ := s["properties"].(map[string]interface{})
+	patterns, _ := s["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := s["additionalProperties"]
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child := path + "/" + escape(name)
+		matched := false
+		if schema, ok := properties[name]; ok {
+			matched = true
+			if err := v.check(schema, value[name], child); err != nil {
+				return err
+			}
+		}
+		for pattern, schema := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid schema: pattern %q: %w", pattern, err)
+			}
+			if re.MatchString(name) {
+				matched = true
+				if err := v.check(schema, value[name], child); err != nil {
+					return err
+				}
+			}
+		}
+		if !matched && hasAdditional {
+			if err := v.check(additional, value[name], child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (v *validator) checkItems(s map[string]interface{}, value []interface{}, path string) error {
+	if n, ok := limit(s, "minItems"); ok && float64(len(value)) < n {
+		return &Error{Path: path, Message: fmt.Sprintf("must have at least %v items", n)}
+	}
+	if n, ok := limit(s, "maxItems"); ok && float64(len(value)) > n {
+		return &Error{Path: path, Message: fmt.Sprintf("must have at most %v items", n)}
+	}
+	if unique, _ := s["uniqueItems"].(bool); unique {
+		for i := range value {
+			for j := 0; j < i; j++ {
+				if equal(value[i], value[j]) {
+					return &Error{Path: path + "/" + strconv.Itoa(i), Message: fmt.Sprintf("duplicates item %d", j)}
+				}
+			}
+		}
+	}
+
+	// Tuples are prefixItems with items for the rest, or an items array
+	// with additionalItems in older drafts.
+	prefix, _ := s["prefixItems"].([]interface{})
+	rest, hasRest := s["items"]
+	if tuple, ok := rest.([]interface{}); ok {
+		prefix = tuple
+		rest, hasRest = s["additionalItems"]
+	}
+	for i, item := range value {
+		child := path + "/" + strconv.Itoa(i)
+		var err error
+		switch {
+		case i < len(prefix):
+			err = v.check(prefix[i], item, child)
+		case hasRest:
+			err = v.check(rest, item, child)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if contains, ok := s["contains"]; ok {
+		for i, item := range value {
+			if v.check(contains, item, path+"/"+strconv.Itoa(i)) == nil {
+				return nil
+			}
+		}
+		return &Error{Path: path, Message: "contains no matching item"}
+	}
+	return nil
+}
+
+func checkString(s map[string]interface{}, value, path string) error {
+	length := float64(utf8.RuneCountInString(value))
+	if n, ok := limit(s, "minLength"); ok && length < n {
+		return &Error{Path: path, Message: fmt.Sprintf("must be at least %v characters long", n)}
+	}
+	if n, ok := limit(s, "maxLength"); ok && length > n {
+		return &Error{Path: path, Message: fmt.Sprintf("must be at most %v characters long", n)}
+	}
+	if pattern, ok := s["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid schema: pattern %q: %w", pattern, err)
+		}
+		if !re.MatchString(value) {
+			return &Error{Path: path, Message: fmt.Sprintf("must match pattern %q", pattern)}
+		}
+	}
+	return nil
+}
+
+func checkNumber(s map[string]interface{}, value json.Number, path string) error {
+	n, err := value.Float64()
+	if err != nil {
+		return &Error{Path: path, Message: "is not a valid number"}
+	}
+	if min, ok := limit(s, "minimum"); ok && n < min {
+		return &Error{Path: path, Message: fmt.Sprintf("must be at least %v", min)}
+	}
+	if max, ok := limit(s, "maximum"); ok && n > max {
+		return &Error{Path: path, Message: fmt.Sprintf("must be at most %v", max)}
+	}
+	if min, ok := limit(s, "exclusiveMinimum"); ok && n <= min {
+		return &Error{Path: path, Message: fmt.Sprintf("must be greater than %v", min)}
+	}
+	if max, ok := limit(s, "exclusiveMaximum"); ok && n >= max {
+		return &Error{Path: path, Message: fmt.Sprintf("must be less than %v", max)}
+	}
+	if m, ok := limit(s, "multipleOf"); ok && m > 0 {
+		if q := n / m; math.Abs(q-math.Round(q)) > 1e-9 {
+			return &Error{Path: path, Message: fmt.Sprintf("must be a multiple of %v", m)}
+		}
+	}
+	return nil
+}
+
+func (v *validator) checkCombinators(s map[string]interface{}, value interface{}, path string) error {
+	if all, ok := s["allOf"].([]interface{}); ok {
+		for _, schema := range all {
+			if err := v.check(schema, value, path); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]interface{}); ok {
+		var first error
+		for _, schema := range anyOf {
+			err := v.check(schema, value, path)
+			if err == nil {
+				first = nil
+				break
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		if first != nil {
+			return &Error{Path: path, Message: "matches none of the allowed schemas: " + first.Error()}
+		}
+	}
+	if oneOf, ok := s["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, schema := range oneOf {
+			if v.check(schema, value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return &Error{Path: path, Message: fmt.Sprintf("must match exactly one schema, matches %d", matches)}
+		}
+	}
+	if not, ok := s["not"]; ok && v.check(not, value, path) == nil {
+		return &Error{Path: path, Message: "matches a schema it must not"}
+	}
+	if cond, ok := s["if"]; ok {
+		branch := "else"
+		if v.check(cond, value, path) == nil {
+			branch = "then"
+		}
+		if schema, ok := s[branch]; ok {
+			return v.check(schema, value, path)
+		}
+	}
+	return nil
+}
+
+// resolve looks up a $ref within the schema document.
+func (v *validator) resolve(ref string) (interface{}, error) {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("invalid schema: only local $ref is supported, got %q", ref)
+	}
+	node := v.root
+	for _, token := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"), "/") {
+		if token == "" {
+			continue
+		}
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		switch n := node.(type) {
+		case map[string]interface{}:
+			node = n[token]
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, fmt.Errorf("invalid schema: unresolvable $ref %q", ref)
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("invalid schema: unresolvable $ref %q", ref)
+		}
+		if node == nil {
+			return nil, fmt.Errorf("invalid schema: unresolvable $ref %q", ref)
+		}
+	}
+	return node, nil
+}
+
+func matchesType(t, value interface{}) bool {
+	switch t := t.(type) {
+	case string:
+		return isType(t, value)
+	case []interface{}:
+		for _, name := range t {
+			if name, ok := name.(string); ok && isType(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func isType(name string, value interface{}) bool {
+	switch name {
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := n.Float64()
+		return err == nil && f == math.Trunc(f)
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	}
+	return typeOf(value) == name
+}
+
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+func typeNames(t interface{}) string {
+	names, ok := t.([]interface{})
+	if !ok {
+		return fmt.Sprint(t)
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprint(name)
+	}
+	return strings.Join(parts, " or ")
+}
+
+// limit returns the numeric value of keyword.
+func limit(s map[string]interface{}, keyword string) (float64, bool) {
+	n, ok := s[keyword].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// equal compares JSON values, treating numbers of equal value as equal.
+func equal(a, b interface{}) bool {
+	if x, ok := a.(json.Number); ok {
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fx, errx := x.Float64()
+		fy, erry := y.Float64()
+		return errx == nil && erry == nil && fx == fy
+	}
+	switch x := a.(type) {
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for key, value := range x {
+			other, ok := y[key]
+			if !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func escape(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+func encode(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
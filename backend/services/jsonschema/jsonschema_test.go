@@ -0,0 +1,55 @@
+package jsonschema_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"mcpgo/backend/services/jsonschema"
+)
+
+func TestValidateReportsTheFailingField(t *testing.T) {
+	schema := json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"query": {"type": "string", "minLength": 1},
+			"limit": {"type": "integer", "minimum": 1, "maximum": 100},
+			"sort": {"enum": ["asc", "desc"]},
+			"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "uniqueItems": true},
+			"filter": {"anyOf": [{"type": "string"}, {"type": "object", "required": ["field"]}]}
+		},
+		"required": ["query"],
+		"additionalProperties": false,
+		"$defs": {"tag": {"type": "string", "pattern": "^[a-z]+$"}}
+	}`)
+	tests := []struct {
+		value string
+		path  string
+	}{
+		{`{"query": "q", "limit": 10, "sort": "asc", "tags": ["a", "b"], "filter": {"field": "x"}}`, ""},
+		{`{"limit": 10}`, "/query"},
+		{`{"query": 1}`, "/query"},
+		{`{"query": ""}`, "/query"},
+		{`{"query": "q", "limit": 2.5}`, "/limit"},
+		{`{"query": "q", "limit": 1000}`, "/limit"},
+		{`{"query": "q", "sort": "up"}`, "/sort"},
+		{`{"query": "q", "tags": ["a", "B"]}`, "/tags/1"},
+		{`{"query": "q", "tags": ["a", "a"]}`, "/tags/1"},
+		{`{"query": "q", "filter": {}}`, "/filter"},
+		{`{"query": "q", "extra": true}`, "/extra"},
+		{`[]`, ""},
+	}
+	for _, test := range tests {
+		err := jsonschema.Validate(schema, json.RawMessage(test.value))
+		if test.value == tests[0].value {
+			if err != nil {
+				t.Fatalf("expected %s to be valid, got %v", test.value, err)
+			}
+			continue
+		}
+		var verr *jsonschema.Error
+		if !errors.As(err, &verr) || verr.Path != test.path {
+			t.Fatalf("expected %s to fail at %q, got %v", test.value, test.path, err)
+		}
+	}
+}
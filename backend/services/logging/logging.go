@@ -0,0 +1,104 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Level is the minimum severity of the messages a logger writes.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[string]Level{
+	"debug":   LevelDebug,
+	"info":    LevelInfo,
+	"warn":    LevelWarn,
+	"warning": LevelWarn,
+	"error":   LevelError,
+}
+
+// ParseLevel parses a level name: debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	level, ok := levelNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return LevelInfo, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", name)
+	}
+	return level, nil
+}
+
+// New returns a standard logger writing to w that drops messages below
+// level. The gateway logs through *log.Logger, so a message states its
+// severity with a "debug: ", "warning: " or "error: " prefix; messages
+// without one are informational. Errors are written at every level. At
+// debug level file and line are included.
+func New(w io.Writer, level Level) *log.Logger {
+	flags := log.LstdFlags
+	if level == LevelDebug {
+		flags |= log.Lmicroseconds | log.Lshortfile
+	}
+	return log.New(&filter{w: w, level: level, flags: flags}, "", flags)
+}
+
+type filter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	flags int
+}
+
+func (f *filter) Write(p []byte) (int, error) {
+	if classify(message(p, f.flags)) < f.level {
+		return len(p), nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.w.Write(p)
+}
+
+// message returns the text of a formatted log line, skipping the date, time
+// and file prefix the logger added according to flags.
+func message(line []byte, flags int) []byte {
+	header := 0
+	if flags&log.Ldate != 0 {
+		header += len("2006/01/02 ")
+	}
+	if flags&(log.Ltime|log.Lmicroseconds) != 0 {
+		header += len("15:04:05 ")
+	}
+	if flags&log.Lmicroseconds != 0 {
+		header += len(".000000")
+	}
+	if header > len(line) {
+		return line
+	}
+	line = line[header:]
+	if flags&(log.Lshortfile|log.Llongfile) != 0 {
+		if i := bytes.Index(line, []byte(": ")); i >= 0 {
+			line = line[i+2:]
+		}
+	}
+	return line
+}
+
+// classify determines the severity of a message from its level prefix.
+func classify(msg []byte) Level {
+	switch {
+	case bytes.HasPrefix(msg, []byte("debug: ")):
+		return LevelDebug
+	case bytes.HasPrefix(msg, []byte("warning: ")):
+		return LevelWarn
+	case bytes.HasPrefix(msg, []byte("error: ")):
+		return LevelError
+	}
+	return LevelInfo
+}
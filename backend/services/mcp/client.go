@@ -0,0 +1,175 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client is a minimal MCP client used by the gateway to talk to upstream
+// servers on its own behalf, e.g. to probe capabilities or list tools. It
+// issues one request at a time and is not safe for concurrent use.
+type Client struct {
+	conn   *websocket.Conn
+	nextID int64
+}
+
+// ClientInfo identifies the gateway when it initializes upstream sessions.
+var ClientInfo = Implementation{Name: "mcpgo", Version: "1.0"}
+
+// Dial opens a WebSocket connection to an upstream MCP server.
+func Dial(ctx context.Context, address string, timeout time.Duration) (*Client, error) {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	originScheme := "http"
+	if parsed.Scheme == "wss" {
+		originScheme = "https"
+	}
+	dialer := websocket.Dialer{
+		HandshakeTimeout: timeout,
+		Subprotocols:     []string{"mcp"},
+	}
+	header := http.Header{"Origin": {fmt.Sprintf("%s://%s", originScheme, parsed.Host)}}
+	conn, resp, err := dialer.DialContext(ctx, address, header)
+	if resp != nil && resp.Body != nil {
+		_ = resp.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Close closes the underlying connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Initialize performs the MCP initialize/initialized handshake.
+func (c *Client) Initialize(ctx context.Context) (*InitializeResult, error) {
+	params := InitializeParams{
+		ProtocolVersion: LatestProtocolVersion,
+		Capabilities:    json.RawMessage("{}"),
+		ClientInfo:      ClientInfo,
+	}
+	var result InitializeResult
+	if err := c.Call(ctx, "initialize", params, &result); err != nil {
+		return nil, err
+	}
+	if err := c.Notify(ctx, "notifications/initialized", nil); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ListTools pages through tools/list and returns the complete catalog.
+func (c *Client) ListTools(ctx context.Context) ([]Tool, error) {
+	var tools []Tool
+	cursor := ""
+	for {
+		var page ListToolsResult
+		if err := c.Call(ctx, "tools/list", PaginatedParams{Cursor: cursor}, &page); err != nil {
+			return nil, err
+		}
+		tools = append(tools, page.Tools...)
+		if page.NextCursor == "" || page.NextCursor == cursor {
+			return tools, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// Notify sends a notification.
+func (c *Client) Notify(ctx context.Context, method string, params interface{}) error {
+	msg, err := NewNotification(method, params)
+	if err != nil {
+		return err
+	}
+	return c.send(ctx, msg)
+}
+
+// Call sends a request and waits for its response, decoding the result into
+// out when it is non-nil. Notifications received in the meantime are
+// discarded and pings from the server are answered.
+func (c *Client) Call(ctx context.Context, method string, params interface{}, out interface{}) error {
+	c.nextID++
+	id := json.RawMessage(strconv.FormatInt(c.nextID, 10))
+	req, err := NewRequest(id, method, params)
+	if err != nil {
+		return err
+	}
+	if err := c.send(ctx, req); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := c.receive(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", method, err)
+		}
+		switch {
+		case msg.IsRequest():
+			reply := NewError(msg.ID, CodeMethodNotFound, "method not supported by gateway probe")
+			if msg.Method == "ping" {
+				reply = &Message{JSONRPC: "2.0", ID: msg.ID, Result: json.RawMessage("{}")}
+			}
+			if err := c.send(ctx, reply); err != nil {
+				return err
+			}
+		case msg.IsResponse() && string(msg.ID) == string(id):
+			if msg.Error != nil {
+				return fmt.Errorf("%s: %w", method, msg.Error)
+			}
+			if out == nil {
+				return nil
+			}
+			if err := json.Unmarshal(msg.Result, out); err != nil {
+				return fmt.Errorf("%s: invalid result: %w", method, err)
+			}
+			return nil
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.applyDeadline(ctx)
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *Client) receive(ctx context.Context) (*Message, error) {
+	c.applyDeadline(ctx)
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, errors.New("upstream sent invalid JSON-RPC message")
+	}
+	return &msg, nil
+}
+
+func (c *Client) applyDeadline(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Time{}
+	}
+	_ = c.conn.SetReadDeadline(deadline)
+	_ = c.conn.SetWriteDeadline(deadline)
+}
@@ -0,0 +1,76 @@
+package mcp
+
+import "encoding/json"
+
+// LatestProtocolVersion is the MCP revision the gateway speaks by default.
+const LatestProtocolVersion = "2025-06-18"
+
+// SupportedProtocolVersions lists the MCP revisions the gateway can
+// translate between, oldest first. Revisions are dates, so they order as
+// strings.
+var SupportedProtocolVersions = []string{"2024-11-05", "2025-03-26", "2025-06-18"}
+
+// Implementation identifies an MCP client or server.
+type Implementation struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// InitializeParams is sent by a client to open an MCP session.
+type InitializeParams struct {
+	ProtocolVersion string          `json:"protocolVersion"`
+	Capabilities    json.RawMessage `json:"capabilities"`
+	ClientInfo      Implementation  `json:"clientInfo"`
+}
+
+// InitializeResult is the server's answer to initialize.
+type InitializeResult struct {
+	ProtocolVersion string          `json:"protocolVersion"`
+	Capabilities    json.RawMessage `json:"capabilities,omitempty"`
+	ServerInfo      Implementation  `json:"serverInfo"`
+	Instructions    string          `json:"instructions,omitempty"`
+}
+
+// ToolAnnotations carries the behavioural hints a server attaches to a tool.
+type ToolAnnotations struct {
+	Title           string `json:"title,omitempty"`
+	ReadOnlyHint    *bool  `json:"readOnlyHint,omitempty"`
+	DestructiveHint *bool  `json:"destructiveHint,omitempty"`
+	IdempotentHint  *bool  `json:"idempotentHint,omitempty"`
+	OpenWorldHint   *bool  `json:"openWorldHint,omitempty"`
+}
+
+// Tool describes a tool advertised by tools/list.
+type Tool struct {
+	Name         string           `json:"name"`
+	Title        string           `json:"title,omitempty"`
+	Description  string           `json:"description,omitempty"`
+	InputSchema  json.RawMessage  `json:"inputSchema,omitempty" swaggertype:"object"`
+	OutputSchema json.RawMessage  `json:"outputSchema,omitempty" swaggertype:"object"`
+	Annotations  *ToolAnnotations `json:"annotations,omitempty"`
+}
+
+// ListToolsResult is a single page of tools/list.
+type ListToolsResult struct {
+	Tools      []Tool `json:"tools"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// PaginatedParams carries the cursor of a paginated list request.
+type PaginatedParams struct {
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// CallToolParams invokes a tool with tools/call.
+type CallToolParams struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+// CallToolResult is the outcome of tools/call. IsError reports a failure of
+// the tool itself, as opposed to a protocol error.
+type CallToolResult struct {
+	Content           []json.RawMessage `json:"content"`
+	StructuredContent json.RawMessage   `json:"structuredContent,omitempty"`
+	IsError           bool              `json:"isError,omitempty"`
+}
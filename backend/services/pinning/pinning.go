@@ -0,0 +1,353 @@
+// Package pinning records the definitions of upstream tools in a lockfile
+// so that later changes to them are noticed. A tool is pinned the first
+// time it is seen; a definition that differs from the pinned one is kept
+// as a change until it is approved, which makes it the new pin.
+package pinning
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const lockfileVersion = 1
+
+// ErrNotChanged is returned when approving a tool that has no change
+// awaiting approval.
+var ErrNotChanged = errors.New("tool has no change awaiting approval")
+
+// Pin is the approved definition of a tool.
+type Pin struct {
+	Hash       string          `json:"hash"`
+	Definition json.RawMessage `json:"definition"`
+	ApprovedAt time.Time       `json:"approvedAt"`
+	// Changed is the definition the server advertised since, until it is
+	// approved or the server reverts to the pinned definition.
+	Changed *Change `json:"changed,omitempty"`
+}
+
+// Change is a definition that differs from the pinned one.
+type Change struct {
+	Hash       string          `json:"hash"`
+	Definition json.RawMessage `json:"definition"`
+	DetectedAt time.Time       `json:"detectedAt"`
+}
+
+// Entry is the pin of a server's tool.
+type Entry struct {
+	Server string
+	Tool   string
+	Pin    Pin
+}
+
+type lockfile struct {
+	Version int                        `json:"version"`
+	Servers map[string]map[string]*Pin `json:"servers"`
+}
+
+// Store keeps the pins of a lockfile. It rereads the file when another
+// process, such as the CLI approving a change, rewrote it.
+type Store struct {
+	path string
+
+	mu   sync.Mutex
+	lock lockfile
+	// modTime and size identify the version of the file last read or
+	// written.
+	modTime time.Time
+	size    int64
+}
+
+// Open loads the lockfile at path. A missing file is created on the first
+// pin.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Path returns the lockfile's path.
+func (s *Store) Path() string {
+	return s.path
+}
+
+// reload rereads the lockfile if it changed since it was last read. The
+// caller holds s.mu, except in Open.
+func (s *Store) reload() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		if s.lock.Servers == nil {
+			s.lock = lockfile{Version: lockfileVersion, Servers: make(map[string]map[string]*Pin)}
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.lock.Servers != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var lock lockfile
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return fmt.Errorf("invalid lockfile %s: %w", s.path, err)
+	}
+	if lock.Version != lockfileVersion {
+		return fmt.Errorf("lockfile %s has unsupported version %d", s.path, lock.Version)
+	}
+	if lock.Servers == nil {
+		lock.Servers = make(map[string]map[string]*Pin)
+	}
+	s.lock, s.modTime, s.size = lock, info.ModTime(), info.Size()
+	return nil
+}
+
+// save writes the lockfile. The caller holds s.mu.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, append(data, '\n')); err != nil {
+		return err
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.modTime, s.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// Observe compares the definitions of server's tools, by name, with their
+// pins. Tools without a pin are pinned. It returns the pins of the tools
+// whose definitions differ, with the change recorded, and the changes
+// that were not recorded before.
+func (s *Store) Observe(server string, definitions map[string]json.RawMessage) (changed map[string]Pin, detected []Entry, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, nil, err
+	}
+	pins := s.lock.Servers[server]
+	if pins == nil {
+		pins = make(map[string]*Pin)
+	}
+	names := make([]string, 0, len(definitions))
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	now := time.Now().UTC()
+	dirty := false
+	changed = make(map[string]Pin)
+	for _, name := range names {
+		definition, hash, err := canonical(definitions[name])
+		if err != nil {
+			return nil, nil, fmt.Errorf("tool %s: %w", name, err)
+		}
+		pin, ok := pins[name]
+		switch {
+		case !ok:
+			pins[name] = &Pin{Hash: hash, Definition: definition, ApprovedAt: now}
+			dirty = true
+		case pin.Hash == hash:
+			if pin.Changed != nil {
+				pin.Changed = nil
+				dirty = true
+			}
+		default:
+			if pin.Changed == nil || pin.Changed.Hash != hash {
+				pin.Changed = &Change{Hash: hash, Definition: definition, DetectedAt: now}
+				detected = append(detected, Entry{Server: server, Tool: name, Pin: *pin})
+				dirty = true
+			}
+			changed[name] = *pin
+		}
+	}
+	if !dirty {
+		return changed, nil, nil
+	}
+	s.lock.Servers[server] = pins
+	if err := s.save(); err != nil {
+		return changed, detected, err
+	}
+	return changed, detected, nil
+}
+
+// Changed returns the pin of server's tool name when it has a change
+// awaiting approval.
+func (s *Store) Changed(server, name string) (Pin, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return Pin{}, false, err
+	}
+	pin, ok := s.lock.Servers[server][name]
+	if !ok || pin.Changed == nil {
+		return Pin{}, false, nil
+	}
+	return *pin, true, nil
+}
+
+// Changes returns the pins with a change awaiting approval, by server and
+// tool.
+func (s *Store) Changes() ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for server, pins := range s.lock.Servers {
+		for name, pin := range pins {
+			if pin.Changed != nil {
+				entries = append(entries, Entry{Server: server, Tool: name, Pin: *pin})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Server != entries[j].Server {
+			return entries[i].Server < entries[j].Server
+		}
+		return entries[i].Tool < entries[j].Tool
+	})
+	return entries, nil
+}
+
+// Approve makes the change of server's tool name its pin.
+func (s *Store) Approve(server, name string) (Pin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return Pin{}, err
+	}
+	pin, ok := s.lock.Servers[server][name]
+	if !ok || pin.Changed == nil {
+		return Pin{}, fmt.Errorf("%w: %s/%s", ErrNotChanged, server, name)
+	}
+	*pin = Pin{Hash: pin.Changed.Hash, Definition: pin.Changed.Definition, ApprovedAt: time.Now().UTC()}
+	if err := s.save(); err != nil {
+		return Pin{}, err
+	}
+	return *pin, nil
+}
+
+// canonical returns definition with its object keys sorted and
+// insignificant whitespace removed, and its hash.
+func canonical(definition json.RawMessage) (json.RawMessage, string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(definition))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, "", err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(data)
+	return data, "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// Diff describes how the definition after differs from before, one line
+// per changed field: "- path: value" for the old value and "+ path: value"
+// for the new one, with paths such as inputSchema.properties.repo.
+func Diff(before, after json.RawMessage) []string {
+	var old, updated interface{}
+	for _, v := range []struct {
+		data json.RawMessage
+		into *interface{}
+	}{{before, &old}, {after, &updated}} {
+		decoder := json.NewDecoder(bytes.NewReader(v.data))
+		decoder.UseNumber()
+		_ = decoder.Decode(v.into)
+	}
+	var lines []string
+	diffValue("", old, updated, &lines)
+	return lines
+}
+
+func diffValue(path string, before, after interface{}, lines *[]string) {
+	oldFields, oldIsObject := before.(map[string]interface{})
+	newFields, newIsObject := after.(map[string]interface{})
+	if oldIsObject && newIsObject {
+		keys := make([]string, 0, len(oldFields)+len(newFields))
+		for key := range oldFields {
+			keys = append(keys, key)
+		}
+		for key := range newFields {
+			if _, ok := oldFields[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field := key
+			if path != "" {
+				field = path + "." + key
+			}
+			oldValue, inOld := oldFields[key]
+			newValue, inNew := newFields[key]
+			switch {
+			case !inNew:
+				*lines = append(*lines, fmt.Sprintf("- %s: %s", field, encode(oldValue)))
+			case !inOld:
+				*lines = append(*lines, fmt.Sprintf("+ %s: %s", field, encode(newValue)))
+			default:
+				diffValue(field, oldValue, newValue, lines)
+			}
+		}
+		return
+	}
+	if reflect.DeepEqual(before, after) {
+		return
+	}
+	if path == "" {
+		path = "(definition)"
+	}
+	*lines = append(*lines,
+		fmt.Sprintf("- %s: %s", path, encode(before)),
+		fmt.Sprintf("+ %s: %s", path, encode(after)))
+}
+
+func encode(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
@@ -0,0 +1,37 @@
+// © 2025 Amir. All rights reserved.
+// Licensed under the MIT License with Commons Clause restriction.
+// You may use this software freely for non-commercial purposes.
+// Commercial use, resale, or offering as part of a paid service
+// requires a separate commercial license from Amir.
+// Contact: licensing@mcpgo.io
+
+// @title MCPGo API
+// @version 1.0
+// @description This is a sample server for MCPGo.
+// @termsOfService http://swagger.io/terms/
+
+// @contact.name API Support
+// @contact.url http://www.swagger.io/support
+// @contact.email support@swagger.io
+
+// @license.name Apache 2.0
+// @license.url http://www.apache.org/licenses/LICENSE-2.0.html
+
+// @BasePath /
+// @schemes https
+
+// @securityDefinitions.apikey AdminToken
+// @in header
+// @name Authorization
+// @description Admin API bearer token, sent as "Bearer <admin.token>".
+package main
+
+import (
+	"os"
+
+	"mcpgo/backend/cli"
+)
+
+func main() {
+	os.Exit(cli.Run(os.Args[1:], os.Stdout, os.Stderr))
+}